@@ -0,0 +1,377 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+/*
+	地址交易记录：
+	扫描器提取到关注地址的输入输出时，按地址保存到扫描器数据库，
+	GetTransactionsByAddress从本地分页查询，不再依赖浏览器接口。
+	AddressTx只保存排序用的索引，分页时不解码提取数据，当前页的数据再从AddressTxData读取。
+	地址在首次交易之后才加入关注的，可以用BackfillAddressHistory补扫历史区块。
+	未确认的交易单以高度0保存，上链后被区块中的记录覆盖，离开内存池且节点上查不到时删除。
+*/
+
+//AddressTx 地址的交易记录索引
+type AddressTx struct {
+	ID      string `storm:"id"` //address_txid
+	Address string `storm:"index"`
+	TxID    string
+	Height  uint64 `storm:"index"`
+	SortKey uint64 `storm:"index"` //排序值，未确认的交易单排在最前
+}
+
+//AddressTxData 地址交易记录的提取数据，只包含地址相关的输入输出
+type AddressTxData struct {
+	ID   string `storm:"id"` //address_txid，与AddressTx相同
+	Data *openwallet.TxExtractData
+}
+
+//newAddressTx 从提取数据中筛选出地址相关的输入输出
+func newAddressTx(address string, height uint64, data *openwallet.TxExtractData) (*AddressTx, *AddressTxData) {
+
+	if data == nil || data.Transaction == nil {
+		return nil, nil
+	}
+
+	addrData := openwallet.NewBlockExtractData()
+	addrData.Transaction = data.Transaction
+	for _, input := range data.TxInputs {
+		if input.Address == address {
+			addrData.TxInputs = append(addrData.TxInputs, input)
+		}
+	}
+	for _, output := range data.TxOutputs {
+		if output.Address == address {
+			addrData.TxOutputs = append(addrData.TxOutputs, output)
+		}
+	}
+
+	if len(addrData.TxInputs) == 0 && len(addrData.TxOutputs) == 0 {
+		return nil, nil
+	}
+
+	sortKey := height
+	if height == 0 {
+		sortKey = math.MaxUint64
+	}
+
+	id := address + "_" + data.Transaction.TxID
+	record := &AddressTx{
+		ID:      id,
+		Address: address,
+		TxID:    data.Transaction.TxID,
+		Height:  height,
+		SortKey: sortKey,
+	}
+	return record, &AddressTxData{ID: id, Data: addrData}
+}
+
+//extractDataAddresses 提取数据涉及的地址
+func extractDataAddresses(data *openwallet.TxExtractData) []string {
+	exist := make(map[string]bool)
+	addresses := make([]string, 0)
+	for _, input := range data.TxInputs {
+		if !exist[input.Address] {
+			exist[input.Address] = true
+			addresses = append(addresses, input.Address)
+		}
+	}
+	for _, output := range data.TxOutputs {
+		if !exist[output.Address] {
+			exist[output.Address] = true
+			addresses = append(addresses, output.Address)
+		}
+	}
+	return addresses
+}
+
+//saveAddressHistory 按地址保存提取数据，返回保存的记录数
+func (bs *HNSBlockScanner) saveAddressHistory(height uint64, data *openwallet.TxExtractData) (int, error) {
+
+	if data == nil || data.Transaction == nil {
+		return 0, nil
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return 0, err
+	}
+
+	//索引和数据在同一个事务中保存
+	tx, err := db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	saved := 0
+	for _, address := range extractDataAddresses(data) {
+		record, recordData := newAddressTx(address, height, data)
+		if record == nil {
+			continue
+		}
+		if err := tx.Save(record); err != nil {
+			return 0, err
+		}
+		if err := tx.Save(recordData); err != nil {
+			return 0, err
+		}
+		saved++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return saved, nil
+}
+
+//deleteAddressTxs 删除地址交易记录的索引和数据
+func deleteAddressTxs(node storm.Node, records []*AddressTx) error {
+	for _, record := range records {
+		if err := node.DeleteStruct(record); err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		if err := node.DeleteStruct(&AddressTxData{ID: record.ID}); err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+//deleteAddressHistory 删除回滚区块的地址交易记录
+func (bs *HNSBlockScanner) deleteAddressHistory(height uint64) error {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var records []*AddressTx
+	err = tx.Select(q.Eq("Height", height)).Find(&records)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	if err := deleteAddressTxs(tx, records); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//pruneAddressMempoolHistory 删除已离开内存池的未确认交易记录
+//已被区块确认的保留，扫描区块时被覆盖
+func (bs *HNSBlockScanner) pruneAddressMempoolHistory(txids []string) error {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	//零值不写入索引，不能用db.Find查询
+	var records []*AddressTx
+	err = db.Select(q.Eq("Height", uint64(0))).Find(&records)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	inMempool := make(map[string]bool)
+	for _, txid := range txids {
+		inMempool[txid] = true
+	}
+
+	removed := make(map[string]bool)
+	for _, record := range records {
+
+		if inMempool[record.TxID] {
+			continue
+		}
+
+		gone, checked := removed[record.TxID]
+		if !checked {
+			gone = bs.txDropped(record.TxID)
+			removed[record.TxID] = gone
+		}
+		if !gone {
+			//已被区块确认，或无法确认状态，下次再检查
+			continue
+		}
+
+		if err := deleteAddressTxs(db, []*AddressTx{record}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//GetTransactionsByAddress 查询地址的交易记录，按区块高度倒序，未确认的交易单排在最前
+//limit <= 0 时返回offset之后的全部记录，多个地址出现在同一交易单时合并为一条
+func (bs *HNSBlockScanner) GetTransactionsByAddress(offset, limit int, coin openwallet.Coin, address ...string) ([]*openwallet.TxExtractData, error) {
+
+	array := make([]*openwallet.TxExtractData, 0)
+
+	if coin.IsContract || len(address) == 0 {
+		return array, nil
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	//单个地址每笔交易单只有一条索引，直接在查询中分页
+	query := tx.Select(q.In("Address", address)).OrderBy("SortKey", "TxID").Reverse()
+	if len(address) == 1 {
+		query = query.Skip(offset)
+		if limit > 0 {
+			query = query.Limit(limit)
+		}
+	}
+
+	var records []*AddressTx
+	err = query.Find(&records)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			return array, nil
+		}
+		return nil, err
+	}
+
+	//多个地址时按交易单去重后再分页，避免同一交易单占用多条
+	pageIDs := make([]string, 0)
+	recordIDs := make(map[string][]string)
+	for _, record := range records {
+		if _, exist := recordIDs[record.TxID]; !exist {
+			pageIDs = append(pageIDs, record.TxID)
+		}
+		recordIDs[record.TxID] = append(recordIDs[record.TxID], record.ID)
+	}
+	if len(address) > 1 {
+		if offset >= len(pageIDs) {
+			return array, nil
+		}
+		pageIDs = pageIDs[offset:]
+		if limit > 0 && limit < len(pageIDs) {
+			pageIDs = pageIDs[:limit]
+		}
+	}
+
+	//只读取当前页的提取数据，同一交易单的多个地址合并为一条
+	for _, txid := range pageIDs {
+		var data *openwallet.TxExtractData
+		for _, id := range recordIDs[txid] {
+			var recordData AddressTxData
+			if err := tx.One("ID", id, &recordData); err != nil {
+				if err == storm.ErrNotFound {
+					continue
+				}
+				return nil, err
+			}
+			if data == nil {
+				data = recordData.Data
+			} else {
+				data.TxInputs = append(data.TxInputs, recordData.Data.TxInputs...)
+				data.TxOutputs = append(data.TxOutputs, recordData.Data.TxOutputs...)
+			}
+		}
+		if data != nil {
+			array = append(array, data)
+		}
+	}
+
+	return array, nil
+}
+
+//BackfillAddressHistory 补扫区块范围内地址的交易记录，不通知观测者，返回保存的记录数
+//用于地址在首次交易之后才加入关注的情况
+func (bs *HNSBlockScanner) BackfillAddressHistory(startHeight, endHeight uint64, address ...string) (int, error) {
+
+	if len(address) == 0 {
+		return 0, nil
+	}
+
+	if startHeight == 0 {
+		startHeight = 1
+	}
+
+	if endHeight < startHeight {
+		return 0, fmt.Errorf("invalid backfill range: %d - %d", startHeight, endHeight)
+	}
+
+	watched := make(map[string]bool)
+	for _, a := range address {
+		watched[a] = true
+	}
+
+	//只匹配需要补扫的地址，sourceKey为地址本身
+	scanTargetFunc := func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		return openwallet.ScanTargetResult{
+			SourceKey: target.ScanTarget,
+			Exist:     watched[target.ScanTarget],
+		}
+	}
+
+	saved := 0
+	for height := startHeight; height <= endHeight; height++ {
+
+		err := bs.walkAddressBlock(height, scanTargetFunc, func(block *Block, result *ExtractResult) error {
+			for _, data := range result.extractData {
+				n, err := bs.saveAddressHistory(block.Height, data)
+				saved += n
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return saved, fmt.Errorf("backfill height %d: %v", height, err)
+		}
+
+		if height%100 == 0 {
+			bs.wm.Log.Std.Info("block scanner backfill address history height: %d, saved: %d", height, saved)
+		}
+	}
+
+	return saved, nil
+}
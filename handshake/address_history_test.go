@@ -0,0 +1,160 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func newTestAddressData(txid string, height uint64, addresses ...string) *openwallet.TxExtractData {
+	data := openwallet.NewBlockExtractData()
+	data.Transaction = &openwallet.Transaction{TxID: txid, BlockHeight: height}
+	for i, address := range addresses {
+		output := &openwallet.TxOutPut{}
+		output.TxID = txid
+		output.Address = address
+		output.Index = uint64(i)
+		data.TxOutputs = append(data.TxOutputs, output)
+	}
+	return data
+}
+
+func TestGetTransactionsByAddress(t *testing.T) {
+
+	wm, cleanup := newTestScannerWallet(t, "")
+	defer cleanup()
+	bs := wm.Blockscanner
+
+	bs.saveAddressHistory(10, newTestAddressData("aa", 10, "addr1"))
+	bs.saveAddressHistory(12, newTestAddressData("bb", 12, "addr1", "addr2"))
+	bs.saveAddressHistory(0, newTestAddressData("cc", 0, "addr2"))
+	bs.saveAddressHistory(11, newTestAddressData("dd", 11, "addr3"))
+
+	list, err := bs.GetTransactionsByAddress(0, 0, openwallet.Coin{}, "addr1", "addr2")
+	if err != nil {
+		t.Fatalf("GetTransactionsByAddress failed: %v", err)
+	}
+
+	want := []string{"cc", "bb", "aa"}
+	if len(list) != len(want) {
+		t.Fatalf("got %d transactions, want %d", len(list), len(want))
+	}
+	for i, data := range list {
+		if data.Transaction.TxID != want[i] {
+			t.Errorf("list[%d] = %s, want %s", i, data.Transaction.TxID, want[i])
+		}
+	}
+	if len(list[1].TxOutputs) != 2 {
+		t.Errorf("merged outputs = %d, want 2", len(list[1].TxOutputs))
+	}
+
+	//同一交易单的多条记录合并后再分页
+	page, err := bs.GetTransactionsByAddress(0, 2, openwallet.Coin{}, "addr1", "addr2")
+	if err != nil || len(page) != 2 || page[1].Transaction.TxID != "bb" || len(page[1].TxOutputs) != 2 {
+		t.Fatalf("first page of addr1, addr2 = %v, %v", page, err)
+	}
+	page, err = bs.GetTransactionsByAddress(2, 2, openwallet.Coin{}, "addr1", "addr2")
+	if err != nil || len(page) != 1 || page[0].Transaction.TxID != "aa" {
+		t.Fatalf("second page of addr1, addr2 = %v, %v", page, err)
+	}
+
+	page, err = bs.GetTransactionsByAddress(2, 1, openwallet.Coin{}, "addr1")
+	if err != nil {
+		t.Fatalf("GetTransactionsByAddress failed: %v", err)
+	}
+	if len(page) != 0 {
+		t.Errorf("page beyond history returned %d transactions", len(page))
+	}
+
+	page, err = bs.GetTransactionsByAddress(1, 1, openwallet.Coin{}, "addr1")
+	if err != nil || len(page) != 1 || page[0].Transaction.TxID != "aa" {
+		t.Errorf("second page of addr1 = %v, %v", page, err)
+	}
+
+	bs.deleteAddressHistory(12)
+	list, _ = bs.GetTransactionsByAddress(0, 0, openwallet.Coin{}, "addr1")
+	if len(list) != 1 || list[0].Transaction.TxID != "aa" {
+		t.Errorf("history after revert = %v", list)
+	}
+
+	//回滚时提取数据一起删除
+	db, _ := bs.scannerDB()
+	var recordData AddressTxData
+	if err := db.One("ID", "addr2_bb", &recordData); err == nil {
+		t.Errorf("history data not deleted: %+v", recordData)
+	}
+}
+
+func TestPruneAddressMempoolHistory(t *testing.T) {
+
+	server := newTestRPCServer()
+	defer server.Close()
+
+	bs := newTestWorkerScanner(t, server.URL)
+	cleanup := useTestScannerDB(t, bs)
+	defer cleanup()
+
+	bs.saveAddressHistory(0, newTestAddressData("m1", 0, "addr1"))
+	bs.saveAddressHistory(0, newTestAddressData("bad2", 0, "addr1", "addr2"))
+	bs.saveAddressHistory(0, newTestAddressData("c3", 0, "addr1"))
+	bs.saveAddressHistory(10, newTestAddressData("bad4", 10, "addr1"))
+
+	//m1仍在内存池，bad2已被丢弃，c3已上链等待扫描
+	if err := bs.pruneAddressMempoolHistory([]string{"m1"}); err != nil {
+		t.Fatalf("pruneAddressMempoolHistory failed: %v", err)
+	}
+
+	list, _ := bs.GetTransactionsByAddress(0, 0, openwallet.Coin{}, "addr1", "addr2")
+	got := make([]string, 0)
+	for _, data := range list {
+		got = append(got, data.Transaction.TxID)
+	}
+	if strings.Join(got, ",") != "m1,c3,bad4" {
+		t.Fatalf("history after prune = %v", got)
+	}
+}
+
+func TestBackfillAddressHistory(t *testing.T) {
+
+	server := newTestAddressChainServer()
+	defer server.Close()
+
+	wm, cleanup := newTestScannerWallet(t, server.URL)
+	defer cleanup()
+	bs := wm.Blockscanner
+
+	address := "hs1qkvpfvra3vvj4uw4ls4d6h4ra58vpnwu9hpr9lt"
+	if saved, err := bs.BackfillAddressHistory(10, 12, "hs1qtsevyrskarucasazwgs7rk8stc36lky7wqrh5k"); err != nil || saved != 0 {
+		t.Fatalf("backfill of unrelated address = %d, %v", saved, err)
+	}
+
+	saved, err := bs.BackfillAddressHistory(10, 12, address)
+	if err != nil || saved != 3 {
+		t.Fatalf("BackfillAddressHistory = %d, %v", saved, err)
+	}
+
+	list, _ := bs.GetTransactionsByAddress(0, 0, openwallet.Coin{}, address)
+	got := make([]string, 0)
+	for _, data := range list {
+		got = append(got, data.Transaction.TxID)
+	}
+	if strings.Join(got, ",") != "c12,c11,c10" {
+		t.Fatalf("backfilled history = %v", got)
+	}
+}
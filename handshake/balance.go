@@ -0,0 +1,219 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"sync/atomic"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	defaultCoinbaseMaturity = 100 //coinbase输出成熟需要的确认数
+)
+
+//BalanceDetail 地址余额明细
+type BalanceDetail struct {
+	Symbol      string
+	Address     string
+	Confirmed   decimal.Decimal //已确认的普通输出，转账选币可以使用
+	Unconfirmed decimal.Decimal //未确认的普通输出
+	Immature    decimal.Decimal //未成熟的coinbase输出
+	Locked      decimal.Decimal //锁定在域名契约中不能花费的输出，例如竞价、揭示、领取、持有的域名
+	Redeemed    decimal.Decimal //OPEN、REDEEM契约的输出，节点允许花费，但转账选币只使用普通输出
+
+	covenantUnconfirmed decimal.Decimal //Locked和Redeemed中未确认的部分
+}
+
+//newBalanceDetail 创建空的余额明细
+func newBalanceDetail(symbol, address string) *BalanceDetail {
+	return &BalanceDetail{
+		Symbol:      symbol,
+		Address:     address,
+		Confirmed:   decimal.Zero,
+		Unconfirmed: decimal.Zero,
+		Immature:    decimal.Zero,
+		Locked:      decimal.Zero,
+		Redeemed:    decimal.Zero,
+
+		covenantUnconfirmed: decimal.Zero,
+	}
+}
+
+//Total 地址的全部余额
+func (d *BalanceDetail) Total() decimal.Decimal {
+	return d.Confirmed.Add(d.Unconfirmed).Add(d.Immature).Add(d.Locked).Add(d.Redeemed)
+}
+
+//Balance 转换为openwallet的余额，Balance包含未成熟和契约中的部分，
+//ConfirmBalance和UnconfirmBalance按确认数划分，两者之和等于Balance
+func (d *BalanceDetail) Balance() *openwallet.Balance {
+	unconfirmed := d.Unconfirmed.Add(d.covenantUnconfirmed)
+	return &openwallet.Balance{
+		Symbol:           d.Symbol,
+		Address:          d.Address,
+		Balance:          d.Total().String(),
+		ConfirmBalance:   d.Total().Sub(unconfirmed).String(),
+		UnconfirmBalance: unconfirmed.String(),
+	}
+}
+
+//isLockedCovenant 契约输出是否不能花费，与hsd的isNonspendable一致，只有NONE、OPEN、REDEEM可以花费
+func isLockedCovenant(covenantType uint64) bool {
+	switch covenantType {
+	case CovenantNone, CovenantOpen, CovenantRedeem:
+		return false
+	}
+	return true
+}
+
+//coinbaseMaturity coinbase输出成熟需要的确认数
+func (wm *WalletManager) coinbaseMaturity() uint64 {
+	if wm.Config.CoinbaseMaturity > 0 {
+		return wm.Config.CoinbaseMaturity
+	}
+	return defaultCoinbaseMaturity
+}
+
+//isImmature 未花是否为未成熟的coinbase输出
+func (wm *WalletManager) isImmature(utxo *Unspent) bool {
+	return utxo.Coinbase && utxo.Confirmations < wm.coinbaseMaturity()
+}
+
+//chainTipHeight 计算确认数使用的最新高度，使用本地未花时优先使用扫描器记录的高度
+func (wm *WalletManager) chainTipHeight() (uint64, error) {
+
+	if wm.Config.EnableLocalUnspent && wm.Blockscanner != nil {
+		tip := atomic.LoadUint64(&wm.Blockscanner.tipHeight)
+		if scanned := wm.Blockscanner.GetScannedBlockHeight(); scanned > tip {
+			tip = scanned
+		}
+		if tip > 0 {
+			return tip, nil
+		}
+	}
+
+	return wm.GetBlockHeight()
+}
+
+//setUnspentConfirmations 按未花所在高度和最新高度计算确认数
+func setUnspentConfirmations(utxos []*Unspent, tip uint64) {
+	for _, utxo := range utxos {
+		switch {
+		case utxo.Height == 0:
+			utxo.Confirmations = 0
+		case tip < utxo.Height:
+			utxo.Confirmations = 1
+		default:
+			utxo.Confirmations = tip - utxo.Height + 1
+		}
+	}
+}
+
+//listAddressCoins 获取地址的全部未花，包括带契约的输出
+func (wm *WalletManager) listAddressCoins(addresses ...string) ([]*Unspent, error) {
+
+	utxos := make([]*Unspent, 0)
+
+	if wm.Config.EnableLocalUnspent && wm.Blockscanner != nil {
+		list, err := wm.Blockscanner.ListLocalUnspent(false, addresses...)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range list {
+			utxos = append(utxos, u.Unspent())
+		}
+	} else {
+		for _, address := range addresses {
+			coins, err := wm.NodeClient.getAddressCoins(address)
+			if err != nil {
+				return nil, err
+			}
+			for _, coin := range coins {
+				utxos = append(utxos, NewUnspent(&coin))
+			}
+		}
+	}
+
+	tip, err := wm.chainTipHeight()
+	if err != nil {
+		return nil, err
+	}
+	setUnspentConfirmations(utxos, tip)
+
+	return utxos, nil
+}
+
+//calculateBalanceDetail 按确认数和契约把未花分到各个余额
+func (wm *WalletManager) calculateBalanceDetail(utxos []*Unspent) map[string]*BalanceDetail {
+
+	details := make(map[string]*BalanceDetail)
+
+	for _, utxo := range utxos {
+
+		detail, exist := details[utxo.Address]
+		if !exist {
+			detail = newBalanceDetail(wm.Symbol(), utxo.Address)
+			details[utxo.Address] = detail
+		}
+
+		amount, _ := decimal.NewFromString(utxo.Amount)
+
+		switch {
+		case isLockedCovenant(utxo.Type):
+			detail.Locked = detail.Locked.Add(amount)
+			if utxo.Confirmations == 0 {
+				detail.covenantUnconfirmed = detail.covenantUnconfirmed.Add(amount)
+			}
+		case utxo.Type != CovenantNone:
+			//转账选币不使用契约输出
+			detail.Redeemed = detail.Redeemed.Add(amount)
+			if utxo.Confirmations == 0 {
+				detail.covenantUnconfirmed = detail.covenantUnconfirmed.Add(amount)
+			}
+		case wm.isImmature(utxo):
+			detail.Immature = detail.Immature.Add(amount)
+		case utxo.Confirmations > 0:
+			detail.Confirmed = detail.Confirmed.Add(amount)
+		default:
+			detail.Unconfirmed = detail.Unconfirmed.Add(amount)
+		}
+	}
+
+	return details
+}
+
+//GetBalanceDetail 获取地址的余额明细：已确认、未确认、未成熟的coinbase、锁定在域名契约中、可花费的契约输出
+func (wm *WalletManager) GetBalanceDetail(address ...string) ([]*BalanceDetail, error) {
+
+	utxos, err := wm.listAddressCoins(address...)
+	if err != nil {
+		return nil, err
+	}
+
+	details := wm.calculateBalanceDetail(utxos)
+	list := make([]*BalanceDetail, 0, len(address))
+	for _, a := range address {
+		detail, exist := details[a]
+		if !exist {
+			detail = newBalanceDetail(wm.Symbol(), a)
+		}
+		list = append(list, detail)
+	}
+
+	return list, nil
+}
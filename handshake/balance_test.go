@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"testing"
+)
+
+func TestCalculateBalanceDetail(t *testing.T) {
+
+	wm := NewWalletManager()
+
+	const addr = "hs1qtsevyrskarucasazwgs7rk8stc36lky7wqrh5k"
+	utxos := []*Unspent{
+		{Address: addr, Amount: "1", Height: 100},                            //已确认
+		{Address: addr, Amount: "2", Height: 0},                              //未确认
+		{Address: addr, Amount: "4", Height: 150, Coinbase: true},            //未成熟
+		{Address: addr, Amount: "8", Height: 10, Coinbase: true},             //已成熟
+		{Address: addr, Amount: "16", Height: 120, Type: 3},                  //竞价锁定
+		{Address: addr, Amount: "32", Height: 130, Type: 5},                  //赎回的出价，选币不使用
+		{Address: addr, Amount: "64", Height: 0, Type: 4},                    //未确认的揭示
+		{Address: addr, Amount: "128", Height: 140, Type: 1, Coinbase: true}, //领取，不能花费
+		{Address: addr, Amount: "256", Height: 140, Type: 11},                //撤销，不能花费
+		{Address: addr, Amount: "512", Height: 0, Type: 2},                   //未确认的开启竞拍
+	}
+	setUnspentConfirmations(utxos, 200)
+
+	if utxos[0].Confirmations != 101 || utxos[1].Confirmations != 0 {
+		t.Errorf("confirmations = %d, %d", utxos[0].Confirmations, utxos[1].Confirmations)
+	}
+
+	detail := wm.calculateBalanceDetail(utxos)[addr]
+	if detail == nil {
+		t.Fatal("missing balance detail")
+	}
+
+	check := func(name, got, want string) {
+		if got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+	check("confirmed", detail.Confirmed.String(), "9")
+	check("unconfirmed", detail.Unconfirmed.String(), "2")
+	check("immature", detail.Immature.String(), "4")
+	check("locked", detail.Locked.String(), "464")
+	check("redeemed", detail.Redeemed.String(), "544")
+
+	//与按确认数划分的余额一致
+	balance := detail.Balance()
+	check("balance", balance.Balance, "1023")
+	check("confirm balance", balance.ConfirmBalance, "445")
+	check("unconfirm balance", balance.UnconfirmBalance, "578")
+}
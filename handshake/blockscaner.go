@@ -16,24 +16,23 @@
 package handshake
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net/url"
-	"strings"
+	"net/http"
 	"sync"
 	"time"
 
-	"github.com/blocktree/openwallet/v2/common"
+	"github.com/blocktree/handshake-adapter/handshakeTransaction"
 	"github.com/blocktree/openwallet/v2/openwallet"
-	"github.com/graarh/golang-socketio"
-	"github.com/graarh/golang-socketio/transport"
 	"github.com/shopspring/decimal"
+	"github.com/tidwall/gjson"
 )
 
 const (
 	//blockchainBucket = "blockchain" //区块链数据集合
 	//periodOfTask      = 5 * time.Second //定时任务执行隔间
-	maxExtractingSize = 6 //并发的扫描线程数
+	defaultExtractWorkers = 6 //并发的扫描线程数
 
 	//RPCServerCore     = 0 //RPC服务，handshake核心钱包
 	//RPCServerExplorer = 1 //RPC服务，insight-API
@@ -43,18 +42,42 @@ const (
 type HNSBlockScanner struct {
 	*openwallet.BlockScannerBase
 
-	CurrentBlockHeight   uint64             //当前区块高度
-	extractingCH         chan struct{}      //扫描工作令牌
-	wm                   *WalletManager     //钱包管理者
-	IsScanMemPool        bool               //是否扫描交易池
-	RescanLastBlockCount uint64             //重扫上N个区块数量
-	socketIO             *gosocketio.Client //socketIO客户端
-	setupSocketIOOnce    sync.Once
-	stopSocketIO         chan struct{}
+	CurrentBlockHeight   uint64         //当前区块高度
+	wm                   *WalletManager //钱包管理者
+	IsScanMemPool        bool           //是否扫描交易池
+	RescanLastBlockCount uint64         //重扫上N个区块数量
+	socket               *hsdSocket     //hsd websocket客户端
+	socketMu             sync.Mutex
+	scanSignal           chan struct{}  //新区块通知
+	scanMu               sync.Mutex     //扫描任务锁，定时任务和新区块通知不同时扫描
+	addrFilter           *addressFilter //地址布隆过滤器
+	store                *scannerStore  //扫描器数据库
+	storeOnce            sync.Once
+	tipHeight            uint64          //节点最新高度，用于计算确认数
+	extractCtx           context.Context //提取任务的上下文，停止扫描时取消
+	extractCancel        context.CancelFunc
+	extractCtxMu         sync.Mutex
+	watchedNames         map[string]*WatchedName //关注的名称哈希
+	watchedNamesMu       sync.RWMutex
+	watchedNamesOnce     sync.Once
+	expiryCheckedHeight  uint64                    //已检查名称过期的高度
+	addressRescans       map[string]*addressRescan //后台执行的地址重扫
+	addressRescansMu     sync.Mutex
+	addressRescanSeq     uint64
+	mempoolMu            sync.Mutex      //内存池视图锁
+	metrics              *scannerMetrics //扫描器运行指标
+	metricsServer        *http.Server
+	metricsMu            sync.Mutex
+	state                string         //扫描器状态
+	stop                 chan struct{}  //本次运行的停止通知
+	tasks                sync.WaitGroup //进行中的任务，停止时等待结束
+	lifecycleMu          sync.Mutex
 
 	//用于实现浏览器
 	IsSkipFailedBlock bool                                    //是否跳过失败区块
 	HNSBlockObservers map[HNSBlockScanNotificationObject]bool //观察者
+
+	HNSMempoolObservers map[HNSMempoolNotificationObject]bool //内存池事件观察者
 }
 
 //ExtractResult 扫描完成的提取结果
@@ -65,6 +88,11 @@ type ExtractResult struct {
 	BlockHeight uint64
 	Success     bool
 	//IsOmniTransfer  bool
+	contractData map[string][]*openwallet.SmartContractReceipt //名称事件
+	unspents     []*LocalUnspent                               //关注地址的新增未花
+	spends       []*LocalUnspent                               //关注地址花费的未花
+	err          error                                         //提取失败的原因
+	outpoints    []string                                      //花费的输出，用于发现内存池冲突
 }
 
 //SaveResult 保存结果
@@ -80,12 +108,17 @@ func NewHNSBlockScanner(wm *WalletManager) *HNSBlockScanner {
 		BlockScannerBase: openwallet.NewBlockScannerBase(),
 	}
 
-	bs.extractingCH = make(chan struct{}, maxExtractingSize)
+	bs.extractCtx, bs.extractCancel = context.WithCancel(context.Background())
 	bs.wm = wm
 	bs.IsScanMemPool = true
 	bs.RescanLastBlockCount = 0
-	bs.stopSocketIO = make(chan struct{})
+	bs.state = ScannerStateIdle
+	bs.scanSignal = make(chan struct{}, 1)
+	bs.addrFilter = newAddressFilter(defaultBloomFilterRate, defaultBloomFilterMaxRate)
 	bs.HNSBlockObservers = make(map[HNSBlockScanNotificationObject]bool)
+	bs.addressRescans = make(map[string]*addressRescan)
+	bs.HNSMempoolObservers = make(map[HNSMempoolNotificationObject]bool)
+	bs.metrics = newScannerMetrics()
 	//bs.RPCServer = RPCServerCore
 
 	//设置扫描任务
@@ -114,6 +147,30 @@ func (bs *HNSBlockScanner) SetRescanBlockHeight(height uint64) error {
 //ScanBlockTask 扫描任务
 func (bs *HNSBlockScanner) ScanBlockTask() {
 
+	if !bs.beginTask() {
+		return
+	}
+	defer bs.endTask()
+
+	//过滤器模式下，新区块由节点推送匹配的交易单，定时任务只重扫失败记录
+	if bs.isFilterScanActive() {
+		if !bs.filterScanBehind() {
+			bs.RescanFailedRecord()
+			return
+		}
+		//推送的新区块丢失时，逐块扫描补齐
+		bs.addrFilter.setResync(true)
+	}
+
+	bs.scanBlockTask()
+}
+
+//scanBlockTask 按高度逐个扫描新区块
+func (bs *HNSBlockScanner) scanBlockTask() {
+
+	bs.scanMu.Lock()
+	defer bs.scanMu.Unlock()
+
 	//获取本地区块高度
 	blockHeader, err := bs.GetScannedBlockHeader()
 	if err != nil {
@@ -124,10 +181,22 @@ func (bs *HNSBlockScanner) ScanBlockTask() {
 	currentHeight := blockHeader.Height
 	currentHash := blockHeader.Hash
 
+	//节点同步中时最新高度已过期，等待同步完成
+	if err := bs.wm.ensureNodeSynced(); err != nil {
+		bs.wm.Log.Std.Info("block scanner waiting for node sync: %v", err)
+		return
+	}
+
+	//追赶模式的区块预取
+	var prefetcher *blockPrefetcher
+	defer func() {
+		prefetcher.stop()
+	}()
+
 	for {
 
-		if !bs.Scanning {
-			//区块扫描器已暂停，马上结束本次任务
+		if !bs.isRunning() {
+			//区块扫描器已暂停或停止，马上结束本次任务
 			return
 		}
 
@@ -139,48 +208,69 @@ func (bs *HNSBlockScanner) ScanBlockTask() {
 			break
 		}
 
+		bs.setTipHeight(maxHeight)
+
 		//是否已到最新高度
 		if currentHeight >= maxHeight {
 			bs.wm.Log.Std.Info("block scanner has scanned full chain data. Current height: %d", maxHeight)
+			//已追上节点，回到过滤器模式
+			bs.addrFilter.setResync(false)
 			break
 		}
 
 		//继续扫描下一个区块
 		currentHeight = currentHeight + 1
 
+		//已追上预取的最后高度，交回逐块扫描
+		if prefetcher != nil && currentHeight > prefetcher.end {
+			bs.wm.Log.Std.Info("block scanner caught up to height: %d", prefetcher.end)
+			prefetcher.stop()
+			prefetcher = nil
+		}
+
 		bs.wm.Log.Std.Info("block scanner scanning height: %d ...", currentHeight)
 
-		hash, err := bs.wm.GetBlockHash(currentHeight)
-		if err != nil {
-			//下一个高度找不到会报异常
-			bs.wm.Log.Std.Info("block scanner can not get new block hash; unexpected error: %v", err)
-			break
+		//落后较多时进入追赶模式，并行预取后面的区块
+		if prefetcher == nil && bs.shouldCatchUp(currentHeight, maxHeight) {
+			prefetcher = bs.newBlockPrefetcher(currentHeight, maxHeight)
 		}
 
-		//if bs.wm.Config.OmniSupport {
-		//	//判断omni的区块高度是否一致
-		//	omniBlockHash, err := bs.wm.GetOmniBlockHash(currentHeight)
-		//	if err != nil {
-		//		bs.wm.Log.Std.Error("omni block is not synced to the same height of mainnet")
-		//		return
-		//	}
-		//
-		//	//判断omni的hash是否与hc节点的hash一致
-		//	if omniBlockHash != hash {
-		//		bs.wm.Log.Std.Error("omni block is not synced to the same hash of mainnet")
-		//		return
-		//	}
-		//}
+		//追赶模式下使用预取的区块，预取失败时再逐个获取
+		hash, block := prefetcher.take(currentHeight)
+		if block == nil {
 
-		block, err := bs.wm.GetBlock(hash)
-		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
+			hash, err = bs.wm.GetBlockHash(currentHeight)
+			if err != nil {
+				//下一个高度找不到会报异常
+				bs.wm.Log.Std.Info("block scanner can not get new block hash; unexpected error: %v", err)
+				break
+			}
 
-			//记录未扫区块
-			unscanRecord := openwallet.NewUnscanRecord(currentHeight, "", err.Error(), bs.wm.Symbol())
-			bs.SaveUnscanRecord(unscanRecord)
-			bs.wm.Log.Std.Info("block height: %d extract failed.", currentHeight)
-			continue
+			//if bs.wm.Config.OmniSupport {
+			//	//判断omni的区块高度是否一致
+			//	omniBlockHash, err := bs.wm.GetOmniBlockHash(currentHeight)
+			//	if err != nil {
+			//		bs.wm.Log.Std.Error("omni block is not synced to the same height of mainnet")
+			//		return
+			//	}
+			//
+			//	//判断omni的hash是否与hc节点的hash一致
+			//	if omniBlockHash != hash {
+			//		bs.wm.Log.Std.Error("omni block is not synced to the same hash of mainnet")
+			//		return
+			//	}
+			//}
+
+			block, err = bs.wm.GetBlock(hash)
+			if err != nil {
+				bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
+
+				//记录未扫区块
+				unscanRecord := openwallet.NewUnscanRecord(currentHeight, "", err.Error(), bs.wm.Symbol())
+				bs.SaveUnscanRecord(unscanRecord)
+				bs.wm.Log.Std.Info("block height: %d extract failed.", currentHeight)
+				continue
+			}
 		}
 
 		isFork := false
@@ -192,62 +282,44 @@ func (bs *HNSBlockScanner) ScanBlockTask() {
 			bs.wm.Log.Std.Info("block height: %d local hash = %s ", currentHeight-1, currentHash)
 			bs.wm.Log.Std.Info("block height: %d mainnet hash = %s ", currentHeight-1, block.Previousblockhash)
 
-			bs.wm.Log.Std.Info("delete recharge records on block height: %d.", currentHeight-1)
-
-			//查询本地分叉的区块
-			forkBlock, _ := bs.GetLocalBlock(currentHeight - 1)
-
-			//删除上一区块链的所有充值记录
-			//bs.DeleteRechargesByHeight(currentHeight - 1)
-			//删除上一区块链的未扫记录
-			bs.DeleteUnscanRecord(currentHeight - 1)
-			currentHeight = currentHeight - 2 //倒退2个区块重新扫描
-			if currentHeight <= 0 {
-				currentHeight = 1
-			}
-
-			localBlock, err := bs.GetLocalBlock(currentHeight)
+			//往回查找共同祖先区块，回滚分叉的区块
+			ancestor, err := bs.handleFork(currentHeight - 1)
 			if err != nil {
-				bs.wm.Log.Std.Error("block scanner can not get local block; unexpected error: %v", err)
-
-				//查找core钱包的RPC
-				bs.wm.Log.Info("block scanner prev block height:", currentHeight)
-
-				prevHash, err := bs.wm.GetBlockHash(currentHeight)
-				if err != nil {
-					bs.wm.Log.Std.Error("block scanner can not get prev block; unexpected error: %v", err)
-					break
-				}
-
-				localBlock, err = bs.wm.GetBlock(prevHash)
-				if err != nil {
-					bs.wm.Log.Std.Error("block scanner can not get prev block; unexpected error: %v", err)
-					break
-				}
-
+				bs.wm.Log.Std.Error("block scanner can not handle fork; unexpected error: %v", err)
+				break
 			}
 
-			//重置当前区块的hash
-			currentHash = localBlock.Hash
-
-			bs.wm.Log.Std.Info("rescan block on height: %d, hash: %s .", currentHeight, currentHash)
+			//重置当前区块的高度和hash
+			currentHeight = ancestor.Height
+			currentHash = ancestor.Hash
 
-			//重新记录一个新扫描起点
-			bs.SaveLocalNewBlock(localBlock.Height, localBlock.Hash)
+			//预取的区块可能已在分叉上，重新预取
+			prefetcher.stop()
+			prefetcher = nil
 
-			isFork = true
+			bs.wm.Log.Std.Info("rescan block on height: %d, hash: %s .", currentHeight+1, currentHash)
 
-			if forkBlock != nil {
+		} else {
 
-				//通知分叉区块给观测者，异步处理
-				bs.newBlockNotify(forkBlock, isFork)
+			//区块观测者需要全部交易单，先获取详情，提取时不再重复查询
+			if bs.hasHNSBlockObservers() {
+				err = bs.loadBlockTxs(block)
+				if err != nil {
+					bs.wm.Log.Std.Info("block scanner can not load block transactions; unexpected error: %v", err)
+					if !bs.IsSkipFailedBlock {
+						//不保存区块，下次重扫
+						break
+					}
+				}
 			}
 
-		} else {
-
-			err = bs.BatchExtractTransaction(block.Height, block.Hash, block.tx)
+			err = bs.extractBlock(block)
 			if err != nil {
 				bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+				//扫描器已停止，不保存区块
+				if isExtractCanceled(err) {
+					break
+				}
 			}
 
 			//重置当前区块的hash
@@ -256,15 +328,26 @@ func (bs *HNSBlockScanner) ScanBlockTask() {
 			//保存本地新高度
 			bs.SaveLocalNewBlock(currentHeight, currentHash)
 			bs.SaveLocalBlock(block)
+			bs.saveHeader(block)
+			bs.metrics.blockScanned()
 
 			isFork = false
 
 			//通知新区块给观测者，异步处理
 			bs.newBlockNotify(block, isFork)
+
+			//通知区块和交易单详情给区块观测者
+			bs.newHNSBlockNotify(block, isFork)
 		}
 
 	}
 
+	//通知达到确认数的交易单
+	bs.notifyConfirmations()
+
+	//检查关注名称是否临近过期
+	bs.checkNameExpiry()
+
 	//重扫前N个块，为保证记录找到
 	for i := currentHeight - bs.RescanLastBlockCount; i < currentHeight; i++ {
 		bs.scanBlock(i)
@@ -316,7 +399,7 @@ func (bs *HNSBlockScanner) scanBlock(height uint64) (*Block, error) {
 
 	bs.wm.Log.Std.Info("block scanner scanning height: %d ...", block.Height)
 
-	err = bs.BatchExtractTransaction(block.Height, block.Hash, block.tx)
+	err = bs.extractBlock(block)
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
 	}
@@ -339,84 +422,35 @@ func (bs *HNSBlockScanner) ScanTxMemPool() {
 		return
 	}
 
-	if txIDsInMemPool == nil || len(txIDsInMemPool) == 0 {
-		return
-	}
+	bs.metrics.setMempoolSize(len(txIDsInMemPool))
 
-	err = bs.BatchExtractTransaction(0, "", txIDsInMemPool)
+	//通知已离开内存池的关注交易单
+	err = bs.pruneMempoolView(txIDsInMemPool)
 	if err != nil {
-		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+		bs.wm.Log.Std.Info("block scanner can not prune mempool view; unexpected error: %v", err)
 	}
 
-}
-
-//rescanFailedRecord 重扫失败记录
-func (bs *HNSBlockScanner) RescanFailedRecord() {
-
-	var (
-		blockMap = make(map[uint64][]string)
-	)
-
-	list, err := bs.GetUnscanRecords()
+	//清除已离开内存池的未确认地址交易记录
+	err = bs.pruneAddressMempoolHistory(txIDsInMemPool)
 	if err != nil {
-		bs.wm.Log.Std.Info("block scanner can not get rescan data; unexpected error: %v", err)
+		bs.wm.Log.Std.Info("block scanner can not prune address mempool history; unexpected error: %v", err)
 	}
 
-	//组合成批处理
-	for _, r := range list {
-
-		if _, exist := blockMap[r.BlockHeight]; !exist {
-			blockMap[r.BlockHeight] = make([]string, 0)
-		}
-
-		if len(r.TxID) > 0 {
-			arr := blockMap[r.BlockHeight]
-			arr = append(arr, r.TxID)
-
-			blockMap[r.BlockHeight] = arr
-		}
+	//清除已不在内存池的本地未花记录
+	err = bs.syncMempoolUnspent(txIDsInMemPool)
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not sync mempool unspent; unexpected error: %v", err)
 	}
 
-	for height, txs := range blockMap {
-
-		if height == 0 {
-			continue
-		}
-
-		var hash string
-
-		bs.wm.Log.Std.Info("block scanner rescanning height: %d ...", height)
-
-		if len(txs) == 0 {
-
-			hash, err := bs.wm.GetBlockHash(height)
-			if err != nil {
-				//下一个高度找不到会报异常
-				bs.wm.Log.Std.Info("block scanner can not get new block hash; unexpected error: %v", err)
-				continue
-			}
-
-			block, err := bs.wm.GetBlock(hash)
-			if err != nil {
-				bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
-				continue
-			}
-
-			txs = block.tx
-		}
-
-		err = bs.BatchExtractTransaction(height, hash, txs)
-		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
-			continue
-		}
+	if txIDsInMemPool == nil || len(txIDsInMemPool) == 0 {
+		return
+	}
 
-		//删除未扫记录
-		bs.DeleteUnscanRecord(height)
+	err = bs.BatchExtractTransaction(0, "", txIDsInMemPool)
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
 	}
 
-	//删除未没有找到交易记录的重扫记录
-	bs.DeleteUnscanRecordNotFindTX()
 }
 
 //newBlockNotify 获得新区块后，通知给观测者
@@ -426,136 +460,137 @@ func (bs *HNSBlockScanner) newBlockNotify(block *Block, isFork bool) {
 	bs.NewBlockNotify(header)
 }
 
+//extractBlock 提取区块的交易单
+//区块已包含交易详情时直接提取，只有未能解析的交易单才逐笔查询节点
+func (bs *HNSBlockScanner) extractBlock(block *Block) error {
+	return bs.batchExtractTransaction(block.Height, block.Hash, block.tx, block.txDetails)
+}
+
 //BatchExtractTransaction 批量提取交易单
 //handshake 1M的区块链可以容纳3000笔交易，批量多线程处理，速度更快
 func (bs *HNSBlockScanner) BatchExtractTransaction(blockHeight uint64, blockHash string, txs []string) error {
+	return bs.batchExtractTransaction(blockHeight, blockHash, txs, nil)
+}
 
-	var (
-		quit       = make(chan struct{})
-		done       = 0 //完成标记
-		failed     = 0
-		shouldDone = len(txs) //需要完成的总数
-	)
+//batchExtractTransaction 批量提取交易单，txs需要向节点查询详情，txDetails为已获取详情的交易单
+//固定数量的工作线程提取交易单，当前线程按完成顺序保存结果，扫描器停止时取消未开始的提取
+func (bs *HNSBlockScanner) batchExtractTransaction(blockHeight uint64, blockHash string, txs []string, txDetails []*Transaction) error {
 
-	if len(txs) == 0 {
-		return errors.New("BatchExtractTransaction block is nil.")
+	jobs := make([]extractJob, 0, len(txs)+len(txDetails))
+	for _, trx := range txDetails {
+		jobs = append(jobs, extractJob{txid: trx.TxID, trx: trx})
+	}
+	for _, txid := range txs {
+		jobs = append(jobs, extractJob{txid: txid})
 	}
 
-	//生产通道
-	producer := make(chan ExtractResult)
-	defer close(producer)
-
-	//消费通道
-	worker := make(chan ExtractResult)
-	defer close(worker)
-
-	//保存工作
-	saveWork := func(height uint64, result chan ExtractResult) {
-		//回收创建的地址
-		for gets := range result {
+	if len(jobs) == 0 {
+		return errors.New("BatchExtractTransaction block is nil.")
+	}
 
-			if gets.Success {
+	ctx := bs.extractContext()
+	results := bs.runExtractJobs(ctx, blockHeight, blockHash, jobs)
 
-				notifyErr := bs.newExtractDataNotify(height, gets.extractData)
-				//saveErr := bs.SaveRechargeToWalletDB(height, gets.Recharges)
-				if notifyErr != nil {
-					failed++ //标记保存失败数
-					bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
-				}
+	//保存工作，只在当前线程执行
+	extractErr := &ExtractErrors{BlockHeight: blockHeight}
+	for gets := range results {
 
-				//notifyErr = nil
-				//notifyErr = bs.newExtractDataNotify(height, gets.extractOmniData)
-				//if notifyErr != nil {
-				//	failed++ //标记保存失败数
-				//	bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
-				//}
+		if gets.Success {
 
-			} else {
-				//记录未扫区块
-				unscanRecord := openwallet.NewUnscanRecord(height, "", "", bs.wm.Symbol())
-				bs.SaveUnscanRecord(unscanRecord)
-				bs.wm.Log.Std.Info("block height: %d extract failed.", height)
-				failed++ //标记保存失败数
+			notifyErr := bs.newExtractDataNotify(blockHeight, blockHash, gets.extractData)
+			bs.updateMempoolView(blockHeight, blockHash, &gets)
+			contractErr := bs.newExtractContractDataNotify(blockHeight, gets.TxID, gets.contractData)
+			if saveErr := bs.saveUnspentChanges(blockHeight, blockHash, &gets); saveErr != nil {
+				bs.wm.Log.Std.Info("saveUnspentChanges unexpected error: %v", saveErr)
 			}
-			//累计完成的线程数
-			done++
-			if done == shouldDone {
-				//bs.wm.Log.Std.Info("done = %d, shouldDone = %d ", done, len(txs))
-				close(quit) //关闭通道，等于给通道传入nil
+			if notifyErr == nil {
+				notifyErr = contractErr
+			}
+			if notifyErr != nil {
+				//标记保存失败
+				extractErr.add(gets.TxID, notifyErr)
+				bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
 			}
-		}
-	}
-
-	//提取工作
-	extractWork := func(eblockHeight uint64, eBlockHash string, mTxs []string, eProducer chan ExtractResult) {
-		for _, txid := range mTxs {
-			bs.extractingCH <- struct{}{}
-			//shouldDone++
-			go func(mBlockHeight uint64, mTxid string, end chan struct{}, mProducer chan<- ExtractResult) {
-
-				//导出提出的交易
-				mProducer <- bs.ExtractTransaction(mBlockHeight, eBlockHash, mTxid, bs.ScanTargetFunc)
-				//释放
-				<-end
 
-			}(eblockHeight, txid, bs.extractingCH, eProducer)
+		} else {
+			reason := "extract transaction failed"
+			if gets.err != nil {
+				reason = gets.err.Error()
+			}
+			//记录未扫的交易单
+			unscanRecord := openwallet.NewUnscanRecord(blockHeight, gets.TxID, reason, bs.wm.Symbol())
+			bs.SaveUnscanRecord(unscanRecord)
+			bs.wm.Log.Std.Info("block height: %d tx: %s extract failed.", blockHeight, gets.TxID)
+			extractErr.add(gets.TxID, errors.New(reason))
 		}
 	}
 
-	/*	开启导出的线程	*/
-
-	//独立线程运行消费
-	go saveWork(blockHeight, worker)
-
-	//独立线程运行生产
-	go extractWork(blockHeight, blockHash, txs, producer)
-
-	//以下使用生产消费模式
-	bs.extractRuntime(producer, worker, quit)
-
-	if failed > 0 {
-		return fmt.Errorf("block scanner saveWork failed")
-	} else {
-		return nil
+	//扫描器停止，未完成的交易单不保存，由调用者决定是否保存区块
+	if ctx.Err() != nil {
+		extractErr.Canceled = true
 	}
 
-	//return nil
+	if extractErr.Failed() {
+		return extractErr
+	}
+	return nil
 }
 
-//extractRuntime 提取运行时
-func (bs *HNSBlockScanner) extractRuntime(producer chan ExtractResult, worker chan ExtractResult, quit chan struct{}) {
-
-	var (
-		values = make([]ExtractResult, 0)
-	)
-
-	for {
-
-		var activeWorker chan<- ExtractResult
-		var activeValue ExtractResult
+//runExtractJobs 启动工作线程提取交易单，全部完成或取消后关闭结果通道
+func (bs *HNSBlockScanner) runExtractJobs(ctx context.Context, blockHeight uint64, blockHash string, jobs []extractJob) <-chan ExtractResult {
 
-		//当数据队列有数据时，释放顶部，传输给消费者
-		if len(values) > 0 {
-			activeWorker = worker
-			activeValue = values[0]
+	workers := bs.extractWorkers()
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
 
+	jobCh := make(chan extractJob)
+	results := make(chan ExtractResult)
+
+	//分发任务
+	go func() {
+		defer close(jobCh)
+		for _, job := range jobs {
+			select {
+			case jobCh <- job:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		select {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+
+				start := time.Now()
+				var result ExtractResult
+				if job.trx != nil {
+					result = bs.extractTransactionDetail(job.trx)
+				} else {
+					result = bs.ExtractTransaction(blockHeight, blockHash, job.txid, bs.ScanTargetFunc)
+				}
+				bs.metrics.observeExtract(time.Since(start))
 
-		//生成者不断生成数据，插入到数据队列尾部
-		case pa := <-producer:
-			values = append(values, pa)
-		case <-quit:
-			//退出
-			//bs.wm.Log.Std.Info("block scanner have been scanned!")
-			return
-		case activeWorker <- activeValue:
-			//wm.Log.Std.Info("Get %d", len(activeValue))
-			values = values[1:]
-		}
+				select {
+				case results <- result:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
 	}
 
+	//所有工作线程退出后关闭结果通道
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
 }
 
 //ExtractTransaction 提取交易单
@@ -577,6 +612,7 @@ func (bs *HNSBlockScanner) ExtractTransaction(blockHeight uint64, blockHash stri
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not extract transaction data; unexpected error: %v", err)
 		result.Success = false
+		result.err = err
 		return result
 	}
 
@@ -608,6 +644,43 @@ func (bs *HNSBlockScanner) ExtractTransaction(blockHeight uint64, blockHash stri
 
 }
 
+//extractTransactionDetail 提取区块中已包含详情的交易单
+func (bs *HNSBlockScanner) extractTransactionDetail(trx *Transaction) ExtractResult {
+
+	result := ExtractResult{
+		BlockHeight: trx.BlockHeight,
+		TxID:        trx.TxID,
+		extractData: make(map[string]*openwallet.TxExtractData),
+	}
+
+	trx.Decimals = bs.wm.Decimal()
+	bs.extractTransaction(trx, &result, bs.ScanTargetFuncV2)
+
+	return result
+}
+
+//fillTxInputs 补全交易单输入的地址和数量，input中没有地址时查上一笔交易单的输出
+func (bs *HNSBlockScanner) fillTxInputs(trx *Transaction) error {
+
+	for _, input := range trx.Vins {
+
+		if input.IsCoinbase() || len(input.Addr) > 0 {
+			//coinbase的输入没有上一笔输出
+			continue
+		}
+
+		//只需要上一笔交易单的输出，节点客户端会缓存结果
+		preOut, err := bs.wm.GetTxOut(input.TxID, input.Vout)
+		if err != nil {
+			return err
+		}
+		input.Addr = preOut.Addr
+		input.Value = preOut.Value
+	}
+
+	return nil
+}
+
 //ExtractTransactionData 提取交易单
 func (bs *HNSBlockScanner) extractTransaction(trx *Transaction, result *ExtractResult, scanAddressFunc openwallet.BlockScanTargetFuncV2) {
 
@@ -619,46 +692,16 @@ func (bs *HNSBlockScanner) extractTransaction(trx *Transaction, result *ExtractR
 	if trx == nil {
 		//记录哪个区块哪个交易单没有完成扫描
 		success = false
+		result.err = errors.New("transaction is nil")
 	} else {
 
-		vin := trx.Vins
 		blocktime := trx.Blocktime
+		result.outpoints = txOutpoints(trx)
 
 		//检查交易单输入信息是否完整，不完整查上一笔交易单的输出填充数据
-		for _, input := range vin {
-
-			if len(input.Coinbase) > 0 {
-				//coinbase skip
-				success = true
-				break
-			}
-
-			//如果input中没有地址，需要查上一笔交易的output提取
-			if len(input.Addr) == 0 {
-
-				intxid := input.TxID
-				vout := input.Vout
-
-				preTx, err := bs.wm.GetTransaction(intxid)
-				if err != nil {
-					success = false
-					break
-				} else {
-					preVouts := preTx.Vouts
-					if len(preVouts) > int(vout) {
-						preOut := preVouts[vout]
-						input.Addr = preOut.Addr
-						input.Value = preOut.Value
-						//vinout = append(vinout, output[vout])
-						success = true
-
-						//bs.wm.Log.Debug("GetTxOut:", output[vout])
-
-					}
-				}
-
-			}
-
+		if err := bs.fillTxInputs(trx); err != nil {
+			success = false
+			result.err = err
 		}
 
 		if success {
@@ -669,13 +712,24 @@ func (bs *HNSBlockScanner) extractTransaction(trx *Transaction, result *ExtractR
 
 			//提取入账部分记录
 			to, totalReceived := bs.extractTxOutput(trx, result, scanAddressFunc)
+
+			//提取本地未花的变化
+			bs.extractUnspent(trx, result, scanAddressFunc)
+
+			//提取名称事件
+			bs.extractNameEvents(trx, result, scanAddressFunc)
 			//bs.wm.Log.Debug("to:", to, "totalReceived:", totalReceived)
 
+			fees := totalSpent.Sub(totalReceived)
+			if trx.IsCoinBase {
+				fees = decimal.Zero
+			}
+
 			for _, extractData := range result.extractData {
 				tx := &openwallet.Transaction{
 					From: from,
 					To:   to,
-					Fees: totalSpent.Sub(totalReceived).StringFixed(bs.wm.Decimal()),
+					Fees: fees.StringFixed(bs.wm.Decimal()),
 					Coin: openwallet.Coin{
 						Symbol:     bs.wm.Symbol(),
 						IsContract: false,
@@ -690,6 +744,10 @@ func (bs *HNSBlockScanner) extractTransaction(trx *Transaction, result *ExtractR
 				}
 				wxID := openwallet.GenTransactionWxID(tx)
 				tx.WxID = wxID
+				if trx.IsCoinBase {
+					tx.SetExtParam("coinbase", true)
+					tx.SetExtParam("maturity", bs.wm.coinbaseMaturity())
+				}
 				extractData.Transaction = tx
 
 				//bs.wm.Log.Debug("Transaction:", extractData.Transaction)
@@ -697,8 +755,6 @@ func (bs *HNSBlockScanner) extractTransaction(trx *Transaction, result *ExtractR
 
 		}
 
-		success = true
-
 	}
 	result.Success = success
 }
@@ -721,6 +777,11 @@ func (bs *HNSBlockScanner) extractTxInput(trx *Transaction, result *ExtractResul
 	createAt := time.Now().Unix()
 	for i, output := range trx.Vins {
 
+		//coinbase的输入没有来源地址
+		if output.IsCoinbase() {
+			continue
+		}
+
 		//in := vin[i]
 
 		txid := output.TxID
@@ -834,6 +895,11 @@ func (bs *HNSBlockScanner) extractTxOutput(trx *Transaction, result *ExtractResu
 
 			//保存utxo到扩展字段
 			outPut.SetExtParam("scriptPubKey", output.ScriptPubKey)
+			if trx.IsCoinBase {
+				//coinbase输出达到成熟确认数后才能花费
+				outPut.SetExtParam("coinbase", true)
+				outPut.SetExtParam("maturity", bs.wm.coinbaseMaturity())
+			}
 			outPut.CreateAt = createAt
 			outPut.BlockHeight = trx.BlockHeight
 			outPut.BlockHash = trx.BlockHash
@@ -862,7 +928,20 @@ func (bs *HNSBlockScanner) extractTxOutput(trx *Transaction, result *ExtractResu
 }
 
 //newExtractDataNotify 发送通知
-func (bs *HNSBlockScanner) newExtractDataNotify(height uint64, extractData map[string]*openwallet.TxExtractData) error {
+func (bs *HNSBlockScanner) newExtractDataNotify(height uint64, blockHash string, extractData map[string]*openwallet.TxExtractData) error {
+
+	//记录区块已通知的数据，分叉时通知撤销
+	for key, data := range extractData {
+		bs.prepareConfirm(height, blockHash, key, data)
+		err := bs.saveExtractJournal(height, blockHash, key, data)
+		if err != nil {
+			bs.wm.Log.Std.Error("block height: %d, save extract journal failed. unexpected error: %v", height, err)
+		}
+		_, err = bs.saveAddressHistory(height, data)
+		if err != nil {
+			bs.wm.Log.Std.Error("block height: %d, save address history failed. unexpected error: %v", height, err)
+		}
+	}
 
 	for o, _ := range bs.Observers {
 		for key, data := range extractData {
@@ -883,29 +962,6 @@ func (bs *HNSBlockScanner) newExtractDataNotify(height uint64, extractData map[s
 	return nil
 }
 
-//DeleteUnscanRecordNotFindTX 删除未没有找到交易记录的重扫记录
-func (bs *HNSBlockScanner) DeleteUnscanRecordNotFindTX() error {
-
-	//删除找不到交易单
-	reason := "[-5]No information available about transaction"
-
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
-	}
-
-	list, err := bs.BlockchainDAI.GetUnscanRecords(bs.wm.Symbol())
-	if err != nil {
-		return err
-	}
-
-	for _, r := range list {
-		if strings.HasPrefix(r.Reason, reason) {
-			bs.BlockchainDAI.DeleteUnscanRecordByID(r.ID, bs.wm.Symbol())
-		}
-	}
-	return nil
-}
-
 //SaveRechargeToWalletDB 保存交易单内的充值记录到钱包数据库
 //func (bs *HNSBlockScanner) SaveRechargeToWalletDB(height uint64, list []*openwallet.Recharge) error {
 //
@@ -1100,16 +1156,6 @@ func (bs *HNSBlockScanner) ExtractTransactionData(txid string, scanTargetFunc op
 //	return nil
 //}
 
-//SaveTxToWalletDB 保存交易记录到钱包数据库
-func (bs *HNSBlockScanner) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
-
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
-	}
-
-	return bs.BlockchainDAI.SaveUnscanRecord(record)
-}
-
 //GetWalletByAddress 获取地址对应的钱包
 //func (bs *HNSBlockScanner) GetWalletByAddress(address string) (*openwallet.Wallet, bool) {
 //	bs.mu.RLock()
@@ -1226,6 +1272,11 @@ func (wm *WalletManager) GetTxOut(txid string, vout uint64) (*Vout, error) {
 	return wm.NodeClient.getVout(txid, vout)
 }
 
+//GetNodeCacheStats 获取节点数据缓存的命中统计
+func (wm *WalletManager) GetNodeCacheStats() NodeCacheStats {
+	return wm.NodeClient.CacheStats()
+}
+
 //获取未扫记录
 func (bs *HNSBlockScanner) GetUnscanRecords() ([]*openwallet.UnscanRecord, error) {
 
@@ -1236,15 +1287,6 @@ func (bs *HNSBlockScanner) GetUnscanRecords() ([]*openwallet.UnscanRecord, error
 	return bs.BlockchainDAI.GetUnscanRecords(bs.wm.Symbol())
 }
 
-//DeleteUnscanRecord 删除指定高度的未扫记录
-func (bs *HNSBlockScanner) DeleteUnscanRecord(height uint64) error {
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
-	}
-
-	return bs.BlockchainDAI.DeleteUnscanRecordByHeight(height, bs.wm.Symbol())
-}
-
 //GetAssetsAccountBalanceByAddress 查询账户相关地址的交易记录
 func (bs *HNSBlockScanner) GetBalanceByAddress(address ...string) ([]*openwallet.Balance, error) {
 
@@ -1255,272 +1297,185 @@ func (bs *HNSBlockScanner) GetBalanceByAddress(address ...string) ([]*openwallet
 //getBalanceByExplorer 获取地址余额
 func (wm *WalletManager) getBalanceCalUnspent(address ...string) ([]*openwallet.Balance, error) {
 
-	utxos, err := wm.ListUnspent(0, address...)
+	details, err := wm.GetBalanceDetail(address...)
 	if err != nil {
 		return nil, err
 	}
 
-	addrBalanceMap := wm.calculateUnspent(utxos)
-	addrBalanceArr := make([]*openwallet.Balance, 0)
-	for _, a := range address {
-
-		var obj *openwallet.Balance
-		if b, exist := addrBalanceMap[a]; exist {
-			obj = b
-		} else {
-			obj = &openwallet.Balance{
-				Symbol:           wm.Symbol(),
-				Address:          a,
-				Balance:          "0",
-				UnconfirmBalance: "0",
-				ConfirmBalance:   "0",
-			}
-		}
-
-		addrBalanceArr = append(addrBalanceArr, obj)
+	addrBalanceArr := make([]*openwallet.Balance, 0, len(details))
+	for _, detail := range details {
+		addrBalanceArr = append(addrBalanceArr, detail.Balance())
 	}
 
 	return addrBalanceArr, nil
 }
 
-//calculateUnspentByExplorer 通过未花计算余额
-func (wm *WalletManager) calculateUnspent(utxos []*Unspent) map[string]*openwallet.Balance {
-
-	addrBalanceMap := make(map[string]*openwallet.Balance)
+/******************* 使用hsd websocket 监听区块和交易 *******************/
 
-	for _, utxo := range utxos {
+//hsd websocket事件
+const (
+	socketEventChainConnect    = "chain connect"    //新区块连接到主链
+	socketEventBlockConnect    = "block connect"    //新区块连接到主链，附带交易单
+	socketEventChainDisconnect = "chain disconnect" //区块从主链断开，发生分叉
+	socketEventChainReset      = "chain reset"      //节点重置链高度
+	socketEventTx              = "tx"               //内存池新交易单
 
-		obj, exist := addrBalanceMap[utxo.Address]
-		if !exist {
-			obj = &openwallet.Balance{}
-		}
+	socketAckTimeout = 10 * time.Second //调用节点的等待时间
+)
 
-		tu, _ := decimal.NewFromString(obj.UnconfirmBalance)
-		tb, _ := decimal.NewFromString(obj.ConfirmBalance)
+//signalScan 通知扫描线程立即扫描新区块，扫描进行中时合并通知
+func (bs *HNSBlockScanner) signalScan() {
+	select {
+	case bs.scanSignal <- struct{}{}:
+	default:
+	}
+}
 
-		if utxo.Spendable {
-			if utxo.Confirmations > 0 {
-				b, _ := decimal.NewFromString(utxo.Amount)
-				tb = tb.Add(b)
-			} else {
-				u, _ := decimal.NewFromString(utxo.Amount)
-				tu = tu.Add(u)
+//runScanSignal 收到新区块通知后执行扫描任务，定时任务作为后备
+func (bs *HNSBlockScanner) runScanSignal(stop <-chan struct{}) {
+	for {
+		select {
+		case <-bs.scanSignal:
+			if bs.beginTask() {
+				bs.scanBlockTask()
+				bs.endTask()
 			}
+		case <-stop:
+			return
 		}
-
-		obj.Symbol = wm.Symbol()
-		obj.Address = utxo.Address
-		obj.ConfirmBalance = tb.String()
-		obj.UnconfirmBalance = tu.String()
-		obj.Balance = tb.Add(tu).String()
-
-		addrBalanceMap[utxo.Address] = obj
 	}
-
-	return addrBalanceMap
-
 }
 
-//GetAssetsAccountTransactionsByAddress 查询账户相关地址的交易记录
-func (bs *HNSBlockScanner) GetTransactionsByAddress(offset, limit int, coin openwallet.Coin, address ...string) ([]*openwallet.TxExtractData, error) {
+//extractSocketTx 提取websocket推送的内存池交易单
+func (bs *HNSBlockScanner) extractSocketTx(rawHex string) {
 
-	//var (
-	//	array = make([]*openwallet.TxExtractData, 0)
-	//)
-	//
-	//trxs, err := bs.wm.getMultiAddrTransactionsByExplorer(offset, limit, address...)
-	//if err != nil {
-	//	return nil, err
-	//}
-	//
-	//key := "account"
-	//
-	////提取账户相关的交易单
-	//var scanAddressFunc openwallet.BlockScanAddressFunc = func(findAddr string) (string, bool) {
-	//	for _, a := range address {
-	//		if findAddr == a {
-	//			return key, true
-	//		}
-	//	}
-	//	return "", false
-	//}
-	//
-	////要检查一下tx.BlockHeight是否有值
-	//
-	//for _, tx := range trxs {
-	//
-	//	result := ExtractResult{
-	//		BlockHeight: tx.BlockHeight,
-	//		TxID:        tx.TxID,
-	//		extractData: make(map[string]*openwallet.TxExtractData),
-	//	}
-	//
-	//	bs.extractTransaction(tx, &result, scanAddressFunc)
-	//	data := result.extractData
-	//	txExtract := data[key]
-	//	if txExtract != nil {
-	//		array = append(array, txExtract)
-	//	}
-	//}
-	//
-	//return array, nil
-
-	return nil, nil
-}
-
-//Run 运行
-func (bs *HNSBlockScanner) Run() error {
-
-	//使用浏览器，开启socketIO监听内存池交易
-	//if bs.wm.Config.RPCServerType == RPCServerExplorer {
-	//	if bs.socketIO == nil {
-	//		go bs.setupSocketIO()
-	//	}
-	//}
-
-	bs.BlockScannerBase.Run()
-
-	return nil
-}
-
-////Stop 停止扫描
-func (bs *HNSBlockScanner) Stop() error {
+	if !bs.IsScanMemPool {
+		return
+	}
 
-	if bs.socketIO != nil {
-		bs.socketIO.Close()
-		bs.socketIO = nil
+	txid, err := handshakeTransaction.GetTxID(rawHex)
+	if err != nil {
+		//无法解析推送内容，扫描整个内存池
+		bs.ScanTxMemPool()
+		return
 	}
 
-	//通知停止线程
-	bs.stopSocketIO <- struct{}{}
+	if bs.isFilterScanActive() {
+		bs.trackFilterOutputsAsync([]string{txid})
+	}
 
-	bs.BlockScannerBase.Stop()
-	return nil
+	err = bs.BatchExtractTransaction(0, "", []string{txid})
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+	}
 }
 
-//
-////Pause 暂停扫描
-//func (bs *HNSBlockScanner) Pause() error {
-//	if bs.wm.Config.RPCServerType == RPCServerExplorer {
-//		return nil
-//	} else {
-//		bs.BlockScannerBase.Pause()
-//	}
-//	return nil
-//}
-//
-////Restart 继续扫描
-//func (bs *HNSBlockScanner) Restart() error {
-//	if bs.wm.Config.RPCServerType == RPCServerExplorer {
-//		return nil
-//	} else {
-//		bs.BlockScannerBase.Restart()
-//	}
-//	return nil
-//}
-
-/******************* 使用insight socket.io 监听区块 *******************/
-
-func (bs *HNSBlockScanner) connectSocketIO(disconnected chan struct{}) (*gosocketio.Client, error) {
-
-	var (
-		room = "inv"
-	)
+func (bs *HNSBlockScanner) connectSocketIO(disconnected chan struct{}) (*hsdSocket, error) {
 
-	apiUrl, err := url.Parse(bs.wm.Config.NodeAPI)
-	if err != nil {
-		return nil, err
-	}
-	domain := apiUrl.Hostname()
-	port := common.NewString(apiUrl.Port()).Int()
 	bs.wm.Log.Info("block scanner socketIO connecting")
-	socketIO, err := gosocketio.Dial(
-		gosocketio.GetUrl(domain, port, false),
-		transport.GetDefaultWebsocketTransport())
+	socket, err := dialHSDSocket(bs.wm.Config.NodeAPI, func() {
+		bs.wm.Log.Info("block scanner socketIO disconnected")
+		select {
+		case disconnected <- struct{}{}:
+		default:
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	err = socketIO.On("tx", func(h *gosocketio.Channel, args interface{}) {
-		//bs.wm.Log.Info("block scanner socketIO get new transaction received: ", args)
-		txMap, ok := args.(map[string]interface{})
-		if ok {
-			txid := txMap["txid"].(string)
-			//bs.wm.Log.Debugf("new tx: %s", txid)
-			errInner := bs.BatchExtractTransaction(0, "", []string{txid})
-			if errInner != nil {
-				bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", errInner)
+	onBlock := func(args []gjson.Result) {
+		bs.signalScan()
+	}
+
+	socket.On(socketEventChainConnect, func(args []gjson.Result) {
+		//过滤器模式下由block connect处理
+		if bs.isFilterScanActive() {
+			return
+		}
+		bs.signalScan()
+	})
+	socket.On(socketEventChainDisconnect, onBlock)
+	socket.On(socketEventChainReset, onBlock)
+	socket.On(socketEventBlockConnect, func(args []gjson.Result) {
+		//过滤器模式下，节点只推送匹配过滤器的交易单
+		if bs.isFilterScanActive() {
+			if bs.beginTask() {
+				bs.extractFilteredBlock(args)
+				bs.endTask()
 			}
+			return
 		}
-
+		bs.signalScan()
 	})
+	socket.On(socketEventTx, func(args []gjson.Result) {
+		if len(args) > 0 && bs.beginTask() {
+			bs.extractSocketTx(args[0].String())
+			bs.endTask()
+		}
+	})
+
+	bs.wm.Log.Info("block scanner socketIO connected")
+
+	err = bs.watchSocketIO(socket)
 	if err != nil {
-		socketIO.Close()
+		socket.Close()
 		return nil, err
 	}
 
-	/*
-		err = bs.socketIO.On("block", func(h *gosocketio.Channel, args interface{}) {
-			bs.wm.Log.Info("block scanner socketIO get new block received: ", args)
-			hash, ok := args.(string)
-			if ok {
-
-				block, errInner := bs.wm.GetBlock(hash)
-				if errInner != nil {
-					bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", errInner)
-				}
+	return socket, nil
+}
 
-				errInner = bs.scanBlock(block)
-				if errInner != nil {
-					bs.wm.Log.Std.Info("block scanner can not block: %d; unexpected error: %v", block.Height, errInner)
-				}
-			}
+//watchSocketIO 认证并订阅链和内存池事件
+func (bs *HNSBlockScanner) watchSocketIO(socket *hsdSocket) error {
 
-		})
-		if err != nil {
+	if len(bs.wm.Config.RpcPassword) > 0 {
+		if _, err := socket.Call(socketAckTimeout, "auth", bs.wm.Config.RpcPassword); err != nil {
 			return err
 		}
-	*/
+	}
 
-	err = socketIO.On(gosocketio.OnDisconnection, func(h *gosocketio.Channel) {
-		bs.wm.Log.Info("block scanner socketIO disconnected")
-		disconnected <- struct{}{}
-	})
-	if err != nil {
-		socketIO.Close()
-		return nil, err
+	//过滤器需要在订阅前加载，避免收到未过滤的数据
+	if bs.wm.Config.EnableBloomFilter {
+		if err := bs.loadFilter(socket); err != nil {
+			bs.wm.Log.Errorf("block scanner load bloom filter failed unexpected error: %v", err)
+		}
 	}
 
-	err = socketIO.On(gosocketio.OnConnection, func(h *gosocketio.Channel) {
-		bs.wm.Log.Info("block scanner socketIO connected")
-		h.Emit("subscribe", room)
-	})
-	if err != nil {
-		socketIO.Close()
-		return nil, err
+	if _, err := socket.Call(socketAckTimeout, "watch chain"); err != nil {
+		return err
+	}
+
+	if bs.IsScanMemPool {
+		if _, err := socket.Call(socketAckTimeout, "watch mempool"); err != nil {
+			bs.wm.Log.Errorf("block scanner socketIO watch mempool failed unexpected error: %v", err)
+		}
 	}
-	return socketIO, nil
+
+	//连接成功后补扫断线期间的区块
+	bs.signalScan()
+
+	return nil
 }
 
 //setupSocketIO 配置socketIO监听新区块
-func (bs *HNSBlockScanner) setupSocketIO() error {
+func (bs *HNSBlockScanner) setupSocketIO(stop <-chan struct{}) error {
 
 	bs.wm.Log.Info("block scanner use socketIO to listen new data")
 
 	var (
-		err error
 		//连接状态通道
 		reconnect = make(chan bool, 1)
 		//断开状态通道
 		disconnected = make(chan struct{}, 1)
 		//重连时的等待时间
 		reconnectWait = 5
-		socketIO      *gosocketio.Client
 	)
 
-	defer func() {
-		close(reconnect)
-		close(disconnected)
+	bs.tasks.Add(1)
+	go func() {
+		defer bs.endTask()
+		bs.runScanSignal(stop)
 	}()
 
 	//启动连接
@@ -1531,30 +1486,70 @@ func (bs *HNSBlockScanner) setupSocketIO() error {
 		select {
 		case <-reconnect:
 			//重新连接
-			socketIO, err = bs.connectSocketIO(disconnected)
-			bs.socketIO = socketIO
+			socket, err := bs.connectSocketIO(disconnected)
 			if err != nil {
 				bs.wm.Log.Errorf("Connect socketIO failed unexpected error: %v", err)
-				disconnected <- struct{}{}
+				//认证或订阅失败时，关闭连接已经通知了断开
+				select {
+				case disconnected <- struct{}{}:
+				case <-stop:
+					bs.wm.Log.Info("block scanner socketIO has been stopped")
+					return nil
+				default:
+				}
+				continue
 			}
+			bs.setSocket(socket)
 
 		case <-disconnected:
 
-			if bs.socketIO != nil {
-				bs.socketIO.Close()
-			}
+			bs.closeSocket()
 
 			//重新连接，前等待
 			bs.wm.Log.Info("Auto reconnect after", reconnectWait, "seconds...")
-			time.Sleep(time.Duration(reconnectWait) * time.Second)
-			reconnect <- true
-		case <-bs.stopSocketIO:
+			select {
+			case <-time.After(time.Duration(reconnectWait) * time.Second):
+				reconnect <- true
+			case <-stop:
+				bs.wm.Log.Info("block scanner socketIO has been stopped")
+				return nil
+			}
+		case <-stop:
+			bs.closeSocket()
 			bs.wm.Log.Info("block scanner socketIO has been stopped")
 			return nil
 		}
 	}
+}
 
-	return nil
+//setSocket 设置当前的websocket连接
+func (bs *HNSBlockScanner) setSocket(socket *hsdSocket) {
+	bs.socketMu.Lock()
+	bs.socket = socket
+	bs.socketMu.Unlock()
+}
+
+//getSocket 当前已连接的websocket，没有连接返回nil
+func (bs *HNSBlockScanner) getSocket() *hsdSocket {
+	bs.socketMu.Lock()
+	defer bs.socketMu.Unlock()
+	if bs.socket == nil || bs.socket.Closed() {
+		return nil
+	}
+	return bs.socket
+}
+
+//closeSocket 关闭当前的websocket连接
+func (bs *HNSBlockScanner) closeSocket() {
+	bs.socketMu.Lock()
+	socket := bs.socket
+	bs.socket = nil
+	bs.socketMu.Unlock()
+
+	if socket != nil {
+		socket.Close()
+	}
+	bs.addrFilter.setLoaded(false)
 }
 
 //SupportBlockchainDAI 支持外部设置区块链数据访问接口
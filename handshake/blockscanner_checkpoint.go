@@ -0,0 +1,404 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+/*
+	扫描检查点：
+	扫描器迁移到新主机时，导出扫描器数据库的全部数据：当前扫描的区块头、区块头窗口、已通知的提取数据、
+	等待确认数通知的记录、重扫队列（含死信）、内存池视图、本地未花、地址交易记录和关注的名称，
+	在新主机导入后从导出时的高度继续扫描，不需要从旧高度重扫，窗口内的区块被回滚时照常通知观测者撤销。
+	导出在同一个只读事务中读取，扫描器运行时也可以导出，高于当前区块的记录属于正在扫描的区块，不导出。
+	检查点是带版本号的JSON文件，导入时检查版本、币种，以及新主机的节点是否包含导出时的区块。
+	导入只能在扫描器未运行时进行，导入会替换本地的区块头窗口、已通知的提取数据和等待确认数的记录，
+	其余数据按主键合并。
+*/
+
+const (
+	checkpointVersion = 1 //检查点文件的版本
+)
+
+//ScanCheckpoint 扫描器状态的检查点
+type ScanCheckpoint struct {
+	Version      int                 `json:"version"`
+	Symbol       string              `json:"symbol"`
+	CreatedAt    int64               `json:"createdAt"`
+	Head         *LocalBlockHeader   `json:"head"`         //当前扫描的区块
+	Headers      []*LocalBlockHeader `json:"headers"`      //区块头窗口，按高度排序
+	Journals     []*ExtractJournal   `json:"journals"`     //已通知的提取数据，区块回滚时撤销
+	Confirms     []*ConfirmRecord    `json:"confirms"`     //等待确认数通知的提取数据
+	RetryItems   []*RetryItem        `json:"retryItems"`   //重扫队列和死信
+	Mempool      []*MempoolTx        `json:"mempool"`      //内存池视图
+	Unspents     []*LocalUnspent     `json:"unspents"`     //本地未花
+	History      []*AddressTx        `json:"history"`      //地址交易记录索引
+	HistoryData  []*AddressTxData    `json:"historyData"`  //地址交易记录的提取数据
+	WatchedNames []*WatchedName      `json:"watchedNames"` //关注的名称
+}
+
+//readAll 读取一种记录的全部数据，没有记录时不返回错误
+func readAll(node storm.Node, to interface{}) error {
+	err := node.All(to)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+//readHeaders 读取区块头窗口，按高度排序
+func readHeaders(node storm.Node) ([]*LocalBlockHeader, error) {
+	headers := make([]*LocalBlockHeader, 0)
+	if err := readAll(node, &headers); err != nil {
+		return nil, err
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Height < headers[j].Height
+	})
+	return headers, nil
+}
+
+//localHeaders 本地的区块头窗口，按高度排序
+func (bs *HNSBlockScanner) localHeaders() ([]*LocalBlockHeader, error) {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return nil, err
+	}
+	return readHeaders(db)
+}
+
+//read 从扫描器数据库读取检查点数据，去掉高于当前区块的记录
+func (cp *ScanCheckpoint) read(node storm.Node) error {
+
+	head := cp.Head.Height
+
+	headers, err := readHeaders(node)
+	if err != nil {
+		return err
+	}
+	for _, header := range headers {
+		if header.Height > head {
+			continue
+		}
+		cp.Headers = append(cp.Headers, header)
+		if header.Height == head && header.Hash == cp.Head.Hash {
+			cp.Head = header
+		}
+	}
+
+	var journals []*ExtractJournal
+	if err := readAll(node, &journals); err != nil {
+		return err
+	}
+	for _, journal := range journals {
+		if journal.Height <= head {
+			cp.Journals = append(cp.Journals, journal)
+		}
+	}
+
+	var confirms []*ConfirmRecord
+	if err := readAll(node, &confirms); err != nil {
+		return err
+	}
+	for _, record := range confirms {
+		if record.Height <= head {
+			cp.Confirms = append(cp.Confirms, record)
+		}
+	}
+
+	if err := readAll(node, &cp.RetryItems); err != nil {
+		return err
+	}
+	if err := readAll(node, &cp.Mempool); err != nil {
+		return err
+	}
+
+	var unspents []*LocalUnspent
+	if err := readAll(node, &unspents); err != nil {
+		return err
+	}
+	for _, u := range unspents {
+		if u.Height > head {
+			continue
+		}
+		//正在扫描的区块中的花费，导入后重新扫描
+		if u.SpentHeight > head {
+			u.SpentTxID = ""
+			u.SpentHeight = 0
+		}
+		cp.Unspents = append(cp.Unspents, u)
+	}
+
+	var history []*AddressTx
+	if err := readAll(node, &history); err != nil {
+		return err
+	}
+	for _, record := range history {
+		if record.Height > head {
+			continue
+		}
+		var recordData AddressTxData
+		if err := node.One("ID", record.ID, &recordData); err != nil {
+			if err == storm.ErrNotFound {
+				continue
+			}
+			return err
+		}
+		cp.History = append(cp.History, record)
+		cp.HistoryData = append(cp.HistoryData, &recordData)
+	}
+
+	return readAll(node, &cp.WatchedNames)
+}
+
+//ExportCheckpoint 导出扫描器状态
+func (bs *HNSBlockScanner) ExportCheckpoint() (*ScanCheckpoint, error) {
+
+	height, hash, err := bs.GetLocalNewBlock()
+	if err != nil {
+		return nil, err
+	}
+	if height == 0 {
+		return nil, fmt.Errorf("block scanner has not scanned any block")
+	}
+
+	//未迁移的旧失败记录一起导出
+	bs.migrateUnscanRecords()
+
+	cp := &ScanCheckpoint{
+		Version:   checkpointVersion,
+		Symbol:    bs.wm.Symbol(),
+		CreatedAt: time.Now().Unix(),
+		Head:      &LocalBlockHeader{Height: height, Hash: hash},
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return nil, err
+	}
+
+	//同一个只读事务中读取，扫描器运行时数据保持一致
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := cp.read(tx); err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+//ImportCheckpoint 导入扫描器状态，扫描器运行时不能导入
+func (bs *HNSBlockScanner) ImportCheckpoint(cp *ScanCheckpoint) error {
+
+	switch state := bs.State(); state {
+	case ScannerStateIdle, ScannerStateStopped:
+	default:
+		return fmt.Errorf("block scanner is %s, stop it before importing a checkpoint", state)
+	}
+
+	if cp.Version != checkpointVersion {
+		return fmt.Errorf("unsupported checkpoint version: %d", cp.Version)
+	}
+	if cp.Symbol != bs.wm.Symbol() {
+		return fmt.Errorf("checkpoint symbol %s does not match %s", cp.Symbol, bs.wm.Symbol())
+	}
+	if cp.Head == nil || cp.Head.Height == 0 || len(cp.Head.Hash) == 0 {
+		return fmt.Errorf("checkpoint has no head block")
+	}
+
+	//新主机的节点需要在同一条链上
+	hash, err := bs.wm.GetBlockHash(cp.Head.Height)
+	if err != nil {
+		return err
+	}
+	if hash != cp.Head.Hash {
+		return fmt.Errorf("checkpoint head %d %s is not on the node chain, node hash: %s", cp.Head.Height, cp.Head.Hash, hash)
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//区块头窗口和区块相关的记录以检查点为准
+	for _, kind := range []interface{}{&LocalBlockHeader{}, &ExtractJournal{}, &ConfirmRecord{}} {
+		if err := tx.Select().Delete(kind); err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+	for _, header := range cp.Headers {
+		if header.Height > cp.Head.Height {
+			continue
+		}
+		if err := tx.Save(header); err != nil {
+			return err
+		}
+	}
+	for _, journal := range cp.Journals {
+		if err := tx.Save(journal); err != nil {
+			return err
+		}
+	}
+	for _, record := range cp.Confirms {
+		if err := tx.Save(record); err != nil {
+			return err
+		}
+	}
+	for _, item := range cp.RetryItems {
+		if err := tx.Save(item); err != nil {
+			return err
+		}
+	}
+	for _, mtx := range cp.Mempool {
+		if err := tx.Save(mtx); err != nil {
+			return err
+		}
+		for _, outpoint := range mtx.Outpoints {
+			if err := tx.Save(&MempoolSpend{Outpoint: outpoint, TxID: mtx.TxID}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, u := range cp.Unspents {
+		if err := tx.Save(u); err != nil {
+			return err
+		}
+	}
+	for _, record := range cp.History {
+		if err := tx.Save(record); err != nil {
+			return err
+		}
+	}
+	for _, recordData := range cp.HistoryData {
+		if err := tx.Save(recordData); err != nil {
+			return err
+		}
+	}
+	for _, w := range cp.WatchedNames {
+		if err := tx.Save(w); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	//已加载的关注名称同时更新
+	bs.watchedNamesMu.Lock()
+	if bs.watchedNames != nil {
+		for _, w := range cp.WatchedNames {
+			bs.watchedNames[w.NameHash] = w
+		}
+	}
+	bs.watchedNamesMu.Unlock()
+
+	//区块头同时保存到BlockchainDAI，窗口外回退时使用
+	for _, header := range cp.Headers {
+		if header.Height > cp.Head.Height {
+			continue
+		}
+		block := &Block{
+			Hash:              header.Hash,
+			Height:            header.Height,
+			Previousblockhash: header.PrevHash,
+			Time:              header.Time,
+		}
+		if err := bs.SaveLocalBlock(block); err != nil {
+			return err
+		}
+	}
+
+	if err := bs.SaveLocalNewBlock(cp.Head.Height, cp.Head.Hash); err != nil {
+		return err
+	}
+
+	bs.wm.Log.Std.Info("block scanner checkpoint imported, head: %d %s, headers: %d, journals: %d, retry items: %d, mempool txs: %d, unspents: %d, history: %d, watched names: %d",
+		cp.Head.Height, cp.Head.Hash, len(cp.Headers), len(cp.Journals), len(cp.RetryItems), len(cp.Mempool), len(cp.Unspents), len(cp.History), len(cp.WatchedNames))
+
+	return nil
+}
+
+//WriteCheckpoint 导出扫描器状态到w
+func (bs *HNSBlockScanner) WriteCheckpoint(w io.Writer) error {
+	cp, err := bs.ExportCheckpoint()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(cp)
+}
+
+//ReadCheckpoint 从r导入扫描器状态
+func (bs *HNSBlockScanner) ReadCheckpoint(r io.Reader) error {
+	cp := &ScanCheckpoint{}
+	if err := json.NewDecoder(r).Decode(cp); err != nil {
+		return fmt.Errorf("invalid checkpoint: %v", err)
+	}
+	return bs.ImportCheckpoint(cp)
+}
+
+//ExportCheckpointFile 导出扫描器状态到文件
+func (bs *HNSBlockScanner) ExportCheckpointFile(path string) error {
+
+	//先写临时文件，避免导出失败时留下不完整的检查点
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = bs.WriteCheckpoint(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+//ImportCheckpointFile 从文件导入扫描器状态
+func (bs *HNSBlockScanner) ImportCheckpointFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return bs.ReadCheckpoint(f)
+}
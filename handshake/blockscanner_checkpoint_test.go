@@ -0,0 +1,245 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//testBlockchainDAI 内存中的BlockchainDAI
+type testBlockchainDAI struct {
+	openwallet.BlockchainDAIBase
+	head   *openwallet.BlockHeader
+	blocks map[uint64]*openwallet.BlockHeader
+}
+
+func newTestBlockchainDAI() *testBlockchainDAI {
+	return &testBlockchainDAI{blocks: make(map[uint64]*openwallet.BlockHeader)}
+}
+
+func (dai *testBlockchainDAI) SaveCurrentBlockHead(header *openwallet.BlockHeader) error {
+	dai.head = header
+	return nil
+}
+
+func (dai *testBlockchainDAI) GetCurrentBlockHead(symbol string) (*openwallet.BlockHeader, error) {
+	if dai.head == nil {
+		return &openwallet.BlockHeader{}, nil
+	}
+	return dai.head, nil
+}
+
+func (dai *testBlockchainDAI) SaveLocalBlockHead(header *openwallet.BlockHeader) error {
+	dai.blocks[header.Height] = header
+	return nil
+}
+
+func (dai *testBlockchainDAI) GetLocalBlockHeadByHeight(height uint64, symbol string) (*openwallet.BlockHeader, error) {
+	header, ok := dai.blocks[height]
+	if !ok {
+		return nil, fmt.Errorf("block %d not found", height)
+	}
+	return header, nil
+}
+
+func (dai *testBlockchainDAI) GetUnscanRecords(symbol string) ([]*openwallet.UnscanRecord, error) {
+	return nil, nil
+}
+
+func newTestCheckpointScanner(t *testing.T, url string) (*HNSBlockScanner, *testBlockchainDAI, func()) {
+
+	bs := newTestWorkerScanner(t, url)
+	cleanup := useTestScannerDB(t, bs)
+	dai := newTestBlockchainDAI()
+	bs.SetBlockchainDAI(dai)
+
+	return bs, dai, cleanup
+}
+
+func TestScanCheckpoint_ExportImport(t *testing.T) {
+
+	server := newTestChainServer()
+	defer server.Close()
+
+	src, _, cleanup := newTestCheckpointScanner(t, server.URL)
+	defer cleanup()
+
+	for height := uint64(10); height <= 12; height++ {
+		block := &Block{Height: height, Hash: fmt.Sprintf("h%d", height), Previousblockhash: fmt.Sprintf("h%d", height-1), Time: 1600000000 + height}
+		if err := src.saveHeader(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.SaveLocalNewBlock(12, "h12")
+	src.recordRetryFailure(11, "t1", "connection refused")
+
+	db, err := src.scannerDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Save(&MempoolTx{TxID: "m1", SourceKeys: []string{"acc1"}, Outpoints: []string{"p1:0"}, FirstSeen: 1600000000})
+	src.saveExtractJournal(11, "h11", "acc1", newTestAddressData("t11", 11, "addr1"))
+	db.Save(&ConfirmRecord{ID: "acc1_t11", Height: 11, BlockHash: "h11", SourceKey: "acc1", Notified: 1})
+	db.Save(&LocalUnspent{Key: "t11_0", TxID: "t11", Address: "addr1", Amount: "1", Height: 11, BlockHash: "h11", SpentTxID: "t13", SpentHeight: 13})
+	src.saveAddressHistory(11, newTestAddressData("t11", 11, "addr1"))
+	db.Save(&WatchedName{NameHash: "nh1", Name: "example", SourceKey: "names"})
+
+	//正在扫描的区块13不导出
+	src.saveHeader(&Block{Height: 13, Hash: "h13", Previousblockhash: "h12"})
+	src.saveExtractJournal(13, "h13", "acc1", newTestAddressData("t13", 13, "addr1"))
+	db.Save(&LocalUnspent{Key: "t13_0", TxID: "t13", Address: "addr1", Amount: "1", Height: 13, BlockHash: "h13"})
+	src.saveAddressHistory(13, newTestAddressData("t13", 13, "addr1"))
+
+	path := filepath.Join(src.wm.Config.DBPath, "checkpoint.json")
+	if err := src.ExportCheckpointFile(path); err != nil {
+		t.Fatalf("ExportCheckpointFile: %v", err)
+	}
+
+	dst, dai, cleanup := newTestCheckpointScanner(t, server.URL)
+	defer cleanup()
+
+	//导入替换原有的区块头窗口和已通知的提取数据
+	dst.saveHeader(&Block{Height: 50, Hash: "h50"})
+	dst.saveExtractJournal(50, "h50", "acc1", newTestAddressData("t50", 50, "addr1"))
+	dst.loadWatchedNames()
+
+	if err := dst.ImportCheckpointFile(path); err != nil {
+		t.Fatalf("ImportCheckpointFile: %v", err)
+	}
+
+	height, hash, _ := dst.GetLocalNewBlock()
+	if height != 12 || hash != "h12" {
+		t.Fatalf("head = %d %s, want 12 h12", height, hash)
+	}
+
+	headers, err := dst.localHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 3 || headers[0].Height != 10 || headers[2].PrevHash != "h11" || headers[2].Time != 1600000012 {
+		t.Fatalf("unexpected headers: %+v", headers)
+	}
+	if block, err := dst.GetLocalBlock(11); err != nil || block.Hash != "h11" {
+		t.Fatalf("local block 11 = %+v, %v", block, err)
+	}
+	if dai.blocks[11].Previousblockhash != "h10" {
+		t.Fatalf("local block 11 prev hash = %s", dai.blocks[11].Previousblockhash)
+	}
+
+	queue, err := dst.GetRetryQueue()
+	if err != nil || len(queue) != 1 || queue[0].TxID != "t1" || queue[0].Attempts != 1 {
+		t.Fatalf("retry queue = %+v, %v", queue, err)
+	}
+
+	view, err := dst.GetMempoolView()
+	if err != nil || len(view) != 1 || view[0].TxID != "m1" {
+		t.Fatalf("mempool view = %+v, %v", view, err)
+	}
+	db, err = dst.scannerDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := &MempoolSpend{}
+	if err := db.One("Outpoint", "p1:0", spend); err != nil || spend.TxID != "m1" {
+		t.Fatalf("mempool spend = %+v, %v", spend, err)
+	}
+
+	//窗口内的区块回滚时可以撤销
+	if journals, err := dst.getExtractJournals(11, "h11"); err != nil || len(journals) != 1 || journals[0].Data.Transaction.TxID != "t11" {
+		t.Fatalf("journals of block 11 = %+v, %v", journals, err)
+	}
+	if journals, _ := dst.getExtractJournals(50, "h50"); len(journals) != 0 {
+		t.Fatalf("old journals not replaced: %+v", journals)
+	}
+	if journals, _ := dst.getExtractJournals(13, "h13"); len(journals) != 0 {
+		t.Fatalf("journals above head imported: %+v", journals)
+	}
+	confirm := &ConfirmRecord{}
+	if err := db.One("ID", "acc1_t11", confirm); err != nil || confirm.Notified != 1 {
+		t.Fatalf("confirm record = %+v, %v", confirm, err)
+	}
+
+	//区块13中的花费导入后重新扫描
+	unspents, err := dst.ListLocalUnspent(false, "addr1")
+	if err != nil || len(unspents) != 1 || unspents[0].Key != "t11_0" || unspents[0].IsSpent() {
+		t.Fatalf("local unspents = %+v, %v", unspents, err)
+	}
+
+	history, err := dst.GetTransactionsByAddress(0, 0, openwallet.Coin{}, "addr1")
+	if err != nil || len(history) != 1 || history[0].Transaction.TxID != "t11" {
+		t.Fatalf("address history = %+v, %v", history, err)
+	}
+
+	if w, ok := dst.getWatchedName("nh1"); !ok || w.Name != "example" {
+		t.Fatalf("watched name = %+v, %v", w, ok)
+	}
+}
+
+func TestScanCheckpoint_ImportRejected(t *testing.T) {
+
+	server := newTestChainServer()
+	defer server.Close()
+
+	bs, _, cleanup := newTestCheckpointScanner(t, server.URL)
+	defer cleanup()
+
+	newCheckpoint := func() *ScanCheckpoint {
+		return &ScanCheckpoint{
+			Version: checkpointVersion,
+			Symbol:  bs.wm.Symbol(),
+			Head:    &LocalBlockHeader{Height: 12, Hash: "h12"},
+		}
+	}
+
+	cp := newCheckpoint()
+	cp.Version = checkpointVersion + 1
+	if err := bs.ImportCheckpoint(cp); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("import newer version: %v", err)
+	}
+
+	cp = newCheckpoint()
+	cp.Symbol = "BTC"
+	if err := bs.ImportCheckpoint(cp); err == nil {
+		t.Fatalf("import other symbol should fail")
+	}
+
+	//节点上没有该区块
+	cp = newCheckpoint()
+	cp.Head.Hash = "x12"
+	if err := bs.ImportCheckpoint(cp); err == nil || !strings.Contains(err.Error(), "not on the node chain") {
+		t.Fatalf("import orphaned head: %v", err)
+	}
+
+	if err := bs.ReadCheckpoint(strings.NewReader("{")); err == nil {
+		t.Fatalf("import invalid json should fail")
+	}
+
+	bs.lifecycleMu.Lock()
+	bs.state = ScannerStateRunning
+	bs.lifecycleMu.Unlock()
+	if err := bs.ImportCheckpoint(newCheckpoint()); err == nil || !strings.Contains(err.Error(), "running") {
+		t.Fatalf("import while running: %v", err)
+	}
+
+	if height, _, _ := bs.GetLocalNewBlock(); height != 0 {
+		t.Fatalf("rejected import changed head to %d", height)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+/*
+	确认数策略：
+	交易单首次发现时通知一次，之后每达到配置的确认数再通知一次，
+	达到最终确认数时标记为最终状态，并停止跟踪。
+	确认数由节点最新高度计算，写入Transaction、TxInput、TxOutPut的Confirm，
+	并在Transaction.ExtParam中记录confirmations和final。
+*/
+
+//ConfirmRecord 等待达到确认数的提取数据
+type ConfirmRecord struct {
+	ID        string `storm:"id"` //sourceKey_txid
+	Height    uint64 `storm:"index"`
+	BlockHash string
+	SourceKey string
+	Notified  uint64 //已通知的确认数
+	Data      *openwallet.TxExtractData
+}
+
+//parseConfirmDepths 解析确认数配置，格式：1,3,6
+func parseConfirmDepths(s string) ([]uint64, error) {
+	depths := make([]uint64, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		depth, err := strconv.ParseUint(item, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid confirm depth: %s", item)
+		}
+		if depth > 0 {
+			depths = append(depths, depth)
+		}
+	}
+	sort.Slice(depths, func(i, j int) bool { return depths[i] < depths[j] })
+	return depths, nil
+}
+
+//confirmPolicyEnabled 是否启用确认数策略
+func (bs *HNSBlockScanner) confirmPolicyEnabled() bool {
+	return bs.wm.Config.FinalConfirmations > 0
+}
+
+//setTipHeight 更新节点最新高度
+func (bs *HNSBlockScanner) setTipHeight(height uint64) {
+	for {
+		tip := atomic.LoadUint64(&bs.tipHeight)
+		if height <= tip || atomic.CompareAndSwapUint64(&bs.tipHeight, tip, height) {
+			return
+		}
+	}
+}
+
+//confirmations 区块高度的确认数，未确认为0
+func (bs *HNSBlockScanner) confirmations(height uint64) uint64 {
+	if height == 0 {
+		return 0
+	}
+	tip := atomic.LoadUint64(&bs.tipHeight)
+	if tip < height {
+		return 1
+	}
+	return tip - height + 1
+}
+
+//nextConfirmDepth 大于notified且不超过confirm的最高通知确认数，没有则返回0
+func (bs *HNSBlockScanner) nextConfirmDepth(notified, confirm uint64) uint64 {
+	final := bs.wm.Config.FinalConfirmations
+	next := uint64(0)
+	for _, depth := range bs.wm.Config.ConfirmDepths {
+		if depth > notified && depth <= confirm && depth < final {
+			next = depth
+		}
+	}
+	if final > notified && final <= confirm {
+		next = final
+	}
+	return next
+}
+
+//setExtractDataConfirm 设置提取数据的确认数
+func (bs *HNSBlockScanner) setExtractDataConfirm(data *openwallet.TxExtractData, confirm uint64, final bool) {
+	for _, input := range data.TxInputs {
+		input.Confirm = int64(confirm)
+	}
+	for _, output := range data.TxOutputs {
+		output.Confirm = int64(confirm)
+	}
+	if data.Transaction != nil {
+		data.Transaction.Confirm = int64(confirm)
+		if bs.confirmPolicyEnabled() {
+			data.Transaction.SetExtParam("confirmations", confirm)
+			data.Transaction.SetExtParam("final", final)
+		}
+	}
+}
+
+//prepareConfirm 首次通知前设置确认数，未达到最终确认数的区块数据加入跟踪
+func (bs *HNSBlockScanner) prepareConfirm(height uint64, blockHash string, sourceKey string, data *openwallet.TxExtractData) {
+
+	confirm := bs.confirmations(height)
+	final := bs.confirmPolicyEnabled() && confirm >= bs.wm.Config.FinalConfirmations
+	bs.setExtractDataConfirm(data, confirm, final)
+
+	if !bs.confirmPolicyEnabled() || height == 0 || final || data.Transaction == nil {
+		return
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not open scanner db; unexpected error: %v", err)
+		return
+	}
+
+	record := &ConfirmRecord{
+		ID:        sourceKey + "_" + data.Transaction.TxID,
+		Height:    height,
+		BlockHash: blockHash,
+		SourceKey: sourceKey,
+		Notified:  confirm,
+		Data:      data,
+	}
+	err = db.Save(record)
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not save confirm record; unexpected error: %v", err)
+	}
+}
+
+//notifyConfirmations 通知达到配置确认数的提取数据
+func (bs *HNSBlockScanner) notifyConfirmations() {
+
+	if !bs.confirmPolicyEnabled() {
+		return
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return
+	}
+
+	var records []*ConfirmRecord
+	err = db.All(&records)
+	if err != nil {
+		return
+	}
+
+	for _, record := range records {
+
+		confirm := bs.confirmations(record.Height)
+		depth := bs.nextConfirmDepth(record.Notified, confirm)
+		if depth == 0 {
+			continue
+		}
+
+		final := confirm >= bs.wm.Config.FinalConfirmations
+		bs.setExtractDataConfirm(record.Data, confirm, final)
+
+		bs.wm.Log.Std.Info("block scanner notify tx: %s confirmations: %d, final: %v", record.Data.Transaction.TxID, confirm, final)
+
+		failed := false
+		for o := range bs.Observers {
+			err := o.BlockExtractDataNotify(record.SourceKey, record.Data)
+			if err != nil {
+				bs.wm.Log.Error("BlockExtractDataNotify unexpected error:", err)
+				failed = true
+			}
+		}
+
+		//通知失败，下一个区块再重试
+		if failed {
+			continue
+		}
+
+		if final {
+			db.DeleteStruct(record)
+		} else {
+			record.Notified = confirm
+			db.Save(record)
+		}
+	}
+}
+
+//deleteConfirmRecords 删除回滚区块的跟踪记录
+func (bs *HNSBlockScanner) deleteConfirmRecords(height uint64) error {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	err = db.Select(q.Eq("Height", height)).Delete(&ConfirmRecord{})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfirmDepths(t *testing.T) {
+	depths, err := parseConfirmDepths(" 3, 1,,0")
+	if err != nil {
+		t.Fatalf("parseConfirmDepths failed: %v", err)
+	}
+	if !reflect.DeepEqual(depths, []uint64{1, 3}) {
+		t.Errorf("depths = %v", depths)
+	}
+
+	if _, err := parseConfirmDepths("1,a"); err == nil {
+		t.Errorf("expected error for invalid depth")
+	}
+}
+
+func TestNextConfirmDepth(t *testing.T) {
+	wm := NewWalletManager()
+	wm.Config.ConfirmDepths = []uint64{1, 3, 10}
+	wm.Config.FinalConfirmations = 6
+	bs := wm.Blockscanner
+
+	tests := []struct {
+		notified uint64
+		confirm  uint64
+		depth    uint64
+	}{
+		{0, 1, 1},
+		{1, 2, 0},
+		{1, 4, 3},
+		{3, 5, 0},
+		{3, 6, 6},
+		{1, 20, 6},
+	}
+
+	for _, test := range tests {
+		depth := bs.nextConfirmDepth(test.notified, test.confirm)
+		if depth != test.depth {
+			t.Errorf("nextConfirmDepth(%d, %d) = %d, want %d", test.notified, test.confirm, depth, test.depth)
+		}
+	}
+}
@@ -0,0 +1,515 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"sync"
+
+	"github.com/blocktree/handshake-adapter/handshakeTransaction"
+	"github.com/tidwall/gjson"
+)
+
+/*
+	过滤器扫描模式：
+	扫描器把关注的地址哈希加入布隆过滤器，通过websocket的set filter加载到节点，
+	节点推送新区块时只附带匹配过滤器的交易单，扫描器只提取这些交易单。
+	节点匹配到输出后，会把该输出加入过滤器，以便匹配之后花费该输出的交易单，
+	扫描器在本地同步添加，估算误报率，误报率过高时重建过滤器并重新加载。
+	过滤器只包含SetFilterAddresses和AddFilterAddress设置的地址，没有地址时不使用过滤器模式，
+	扫描目标函数无法列出关注的地址，需要在每次启动后调用SetFilterAddresses。
+	节点按输入花费的输出匹配花费，设置地址时把地址已有的未花输出一起加入过滤器。
+	过滤器重建或发现遗漏的区块后，逐块扫描追上节点的最新高度，再回到过滤器模式。
+*/
+
+const (
+	defaultBloomFilterRate    = 0.0001 //创建过滤器的误报率
+	defaultBloomFilterMaxRate = 0.001  //误报率超过该值时重建过滤器
+	minBloomFilterItems       = 1000   //过滤器最少容纳的元素数量
+	filterChunkSize           = 100    //add filter每次发送的元素数量
+)
+
+//addressFilter 关注地址的布隆过滤器
+type addressFilter struct {
+	mu        sync.Mutex
+	rate      float64
+	maxRate   float64
+	filter    *BloomFilter
+	addresses map[string][]byte //地址 -> 地址哈希
+	outpoints map[string][]byte //已匹配的输出
+	loaded    bool              //节点已加载过滤器
+	disabled  bool              //元素过多，过滤器已无法满足误报率
+	resync    bool              //需要逐块扫描追上节点
+}
+
+//newAddressFilter 创建地址过滤器
+func newAddressFilter(rate, maxRate float64) *addressFilter {
+	f := &addressFilter{
+		rate:      rate,
+		maxRate:   maxRate,
+		addresses: make(map[string][]byte),
+		outpoints: make(map[string][]byte),
+	}
+	f.rebuild()
+	return f
+}
+
+//setRate 设置误报率
+func (f *addressFilter) setRate(rate, maxRate float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if rate > 0 {
+		f.rate = rate
+	}
+	if maxRate > 0 {
+		f.maxRate = maxRate
+	}
+	f.rebuild()
+}
+
+//rebuild 按当前元素数量的两倍重建过滤器，调用前需要加锁
+func (f *addressFilter) rebuild() {
+	items := uint32(2 * (len(f.addresses) + len(f.outpoints)))
+	if items < minBloomFilterItems {
+		items = minBloomFilterItems
+	}
+	f.filter = NewBloomFilter(items, f.rate, rand.Uint32(), BloomUpdateAll)
+	for _, data := range f.addresses {
+		f.filter.Add(data)
+	}
+	for _, data := range f.outpoints {
+		f.filter.Add(data)
+	}
+	f.disabled = f.filter.FalsePositiveRate() > f.maxRate
+	f.loaded = false
+}
+
+//add 添加元素，返回新增的元素，过滤器需要重建时rebuilt为true
+func (f *addressFilter) add(set map[string][]byte, items map[string][]byte) (added [][]byte, rebuilt bool) {
+	for key, data := range items {
+		if _, exist := set[key]; exist {
+			continue
+		}
+		set[key] = data
+		f.filter.Add(data)
+		added = append(added, data)
+	}
+	if f.filter.FalsePositiveRate() > f.maxRate {
+		f.rebuild()
+		f.resync = true
+		return nil, true
+	}
+	return added, false
+}
+
+//setLoaded 设置节点是否已加载过滤器
+func (f *addressFilter) setLoaded(loaded bool) {
+	f.mu.Lock()
+	f.loaded = loaded
+	f.mu.Unlock()
+}
+
+//active 过滤器是否可用
+func (f *addressFilter) active() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.loaded && !f.disabled && !f.resync && len(f.addresses) > 0
+}
+
+//setResync 设置是否需要逐块扫描追上节点
+func (f *addressFilter) setResync(resync bool) {
+	f.mu.Lock()
+	f.resync = resync
+	f.mu.Unlock()
+}
+
+//hasAddress 地址哈希是否关注
+func (f *addressFilter) hasAddress(address string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.addresses[address]
+	return ok
+}
+
+//outpointBytes 输出的序列化：txid + u32 index
+func outpointBytes(txid string, index uint32) ([]byte, error) {
+	hash, err := hex.DecodeString(txid)
+	if err != nil || len(hash) != 32 {
+		return nil, errors.New("invalid txid")
+	}
+	b := make([]byte, 36)
+	copy(b, hash)
+	binary.LittleEndian.PutUint32(b[32:], index)
+	return b, nil
+}
+
+//isFilterScanActive 是否使用过滤器模式扫描
+func (bs *HNSBlockScanner) isFilterScanActive() bool {
+	//过滤器不匹配名称，区块观测者需要完整的区块，这两种情况逐块扫描
+	return bs.wm.Config.EnableBloomFilter && bs.getSocket() != nil && bs.addrFilter.active() &&
+		!bs.hasWatchedNames() && !bs.hasHNSBlockObservers()
+}
+
+//filterScanBehind 过滤器模式下是否落后节点，推送的新区块可能丢失
+func (bs *HNSBlockScanner) filterScanBehind() bool {
+
+	local, err := bs.GetScannedBlockHeader()
+	if err != nil {
+		return false
+	}
+
+	maxHeight, err := bs.wm.GetBlockHeight()
+	if err != nil {
+		return false
+	}
+
+	return maxHeight > local.Height
+}
+
+//SetFilterAddresses 重新设置过滤器关注的地址
+func (bs *HNSBlockScanner) SetFilterAddresses(addresses []string) error {
+
+	items, err := decodeFilterAddresses(addresses)
+	if err != nil {
+		return err
+	}
+
+	outpoints, err := bs.filterAddressCoins(addresses)
+	if err != nil {
+		return err
+	}
+
+	f := bs.addrFilter
+	f.mu.Lock()
+	f.addresses = items
+	f.outpoints = outpoints
+	f.rebuild()
+	f.resync = true
+	f.mu.Unlock()
+
+	err = bs.reloadFilter()
+	bs.signalScan()
+	return err
+}
+
+//AddFilterAddress 添加过滤器关注的地址
+func (bs *HNSBlockScanner) AddFilterAddress(addresses ...string) error {
+
+	items, err := decodeFilterAddresses(addresses)
+	if err != nil {
+		return err
+	}
+
+	outpoints, err := bs.filterAddressCoins(addresses)
+	if err != nil {
+		return err
+	}
+
+	f := bs.addrFilter
+	f.mu.Lock()
+	added, rebuilt := f.add(f.addresses, items)
+	if rebuilt {
+		for key, data := range outpoints {
+			f.outpoints[key] = data
+		}
+		f.rebuild()
+	} else {
+		var more [][]byte
+		more, rebuilt = f.add(f.outpoints, outpoints)
+		added = append(added, more...)
+	}
+	f.mu.Unlock()
+
+	return bs.updateFilter(added, rebuilt)
+}
+
+//AddFilterOutpoint 添加过滤器关注的输出，用于匹配花费该输出的交易单
+func (bs *HNSBlockScanner) AddFilterOutpoint(txid string, index uint32) error {
+
+	data, err := outpointBytes(txid, index)
+	if err != nil {
+		return err
+	}
+
+	f := bs.addrFilter
+	f.mu.Lock()
+	added, rebuilt := f.add(f.outpoints, map[string][]byte{string(data): data})
+	f.mu.Unlock()
+
+	return bs.updateFilter(added, rebuilt)
+}
+
+//filterAddressCoins 地址已有的未花输出，开启本地未花时读取本地集合，否则向节点查询
+func (bs *HNSBlockScanner) filterAddressCoins(addresses []string) (map[string][]byte, error) {
+
+	items := make(map[string][]byte)
+	add := func(txid string, index uint64) error {
+		data, err := outpointBytes(txid, uint32(index))
+		if err != nil {
+			return err
+		}
+		items[string(data)] = data
+		return nil
+	}
+
+	if bs.localUnspentEnabled() {
+		list, err := bs.ListLocalUnspent(false, addresses...)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range list {
+			if err := add(u.TxID, u.Vout); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	for _, address := range addresses {
+		coins, err := bs.wm.NodeClient.getAddressCoins(address)
+		if err != nil {
+			return nil, err
+		}
+		for _, coin := range coins {
+			if err := add(coin.Get("hash").String(), coin.Get("index").Uint()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return items, nil
+}
+
+//decodeFilterAddresses 地址解码为地址哈希
+func decodeFilterAddresses(addresses []string) (map[string][]byte, error) {
+	items := make(map[string][]byte)
+	for _, address := range addresses {
+		hash, err := handshakeTransaction.AddressDecode(address)
+		if err != nil {
+			return nil, err
+		}
+		items[address] = hash
+	}
+	return items, nil
+}
+
+//updateFilter 把新增的元素发送给节点，过滤器重建后重新加载
+func (bs *HNSBlockScanner) updateFilter(added [][]byte, rebuilt bool) error {
+
+	if rebuilt {
+		bs.wm.Log.Std.Info("block scanner bloom filter false positive rate too high, rebuild filter")
+		err := bs.reloadFilter()
+		//重建期间推送的区块使用旧的过滤器，逐块扫描补齐
+		bs.signalScan()
+		return err
+	}
+
+	socket := bs.getSocket()
+	if socket == nil || len(added) == 0 || !bs.addrFilter.active() {
+		return nil
+	}
+
+	for i := 0; i < len(added); i += filterChunkSize {
+		end := i + filterChunkSize
+		if end > len(added) {
+			end = len(added)
+		}
+		chunks := make([]string, 0, end-i)
+		for _, data := range added[i:end] {
+			chunks = append(chunks, hex.EncodeToString(data))
+		}
+		if _, err := socket.Call(socketAckTimeout, "add filter", chunks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//reloadFilter 连接可用时重新加载过滤器
+func (bs *HNSBlockScanner) reloadFilter() error {
+	socket := bs.getSocket()
+	if socket == nil || !bs.wm.Config.EnableBloomFilter {
+		return nil
+	}
+	return bs.loadFilter(socket)
+}
+
+//loadFilter 加载过滤器到节点，元素过多无法满足误报率时清除过滤器，回退到逐块扫描
+func (bs *HNSBlockScanner) loadFilter(socket *hsdSocket) error {
+
+	f := bs.addrFilter
+	f.mu.Lock()
+	disabled := f.disabled
+	raw := hex.EncodeToString(f.filter.Bytes())
+	f.mu.Unlock()
+
+	if disabled {
+		bs.wm.Log.Std.Warning("block scanner bloom filter can not satisfy false positive rate, fall back to full block scan")
+		f.setLoaded(false)
+		_, err := socket.Call(socketAckTimeout, "reset filter")
+		return err
+	}
+
+	if _, err := socket.Call(socketAckTimeout, "set filter", raw); err != nil {
+		f.setLoaded(false)
+		return err
+	}
+
+	f.setLoaded(true)
+	return nil
+}
+
+//trackFilterOutputsAsync 在websocket事件线程之外同步过滤器的输出，查询交易单和通知节点不阻塞其他事件
+func (bs *HNSBlockScanner) trackFilterOutputsAsync(txids []string) {
+
+	if len(txids) == 0 || !bs.beginTask() {
+		return
+	}
+
+	go func() {
+		defer bs.endTask()
+		for _, txid := range txids {
+			bs.trackFilterOutputs(txid)
+		}
+	}()
+}
+
+//trackFilterOutputs 节点匹配到关注的地址后会把输出加入过滤器，本地同步添加
+func (bs *HNSBlockScanner) trackFilterOutputs(txid string) {
+
+	trx, err := bs.wm.GetTransaction(txid)
+	if err != nil {
+		return
+	}
+
+	for _, out := range trx.Vouts {
+		if !bs.addrFilter.hasAddress(out.Addr) {
+			continue
+		}
+		if err := bs.AddFilterOutpoint(txid, uint32(out.N)); err != nil {
+			bs.wm.Log.Std.Info("block scanner add filter outpoint failed; unexpected error: %v", err)
+		}
+	}
+}
+
+//chainEntry 节点推送的区块索引
+type chainEntry struct {
+	Hash     string
+	Height   uint64
+	PrevHash string
+	Time     uint64
+}
+
+//parseChainEntry 解析区块索引：hash(32) + height(u32) + chainwork(32) + 区块头
+//区块头：nonce(u32) + time(u64) + prevBlock(32) + ...
+func parseChainEntry(rawHex string) (*chainEntry, error) {
+	raw, err := hex.DecodeString(rawHex)
+	if err != nil || len(raw) < 112 {
+		return nil, errors.New("invalid chain entry")
+	}
+	return &chainEntry{
+		Hash:     hex.EncodeToString(raw[:32]),
+		Height:   uint64(binary.LittleEndian.Uint32(raw[32:36])),
+		Time:     binary.LittleEndian.Uint64(raw[72:80]),
+		PrevHash: hex.EncodeToString(raw[80:112]),
+	}, nil
+}
+
+//extractFilteredBlock 提取节点推送的区块中匹配过滤器的交易单
+//args：区块索引，匹配的交易单数组
+func (bs *HNSBlockScanner) extractFilteredBlock(args []gjson.Result) {
+
+	if len(args) == 0 {
+		return
+	}
+
+	entry, err := parseChainEntry(args[0].String())
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not parse chain entry; unexpected error: %v", err)
+		bs.signalScan()
+		return
+	}
+
+	bs.scanMu.Lock()
+	defer bs.scanMu.Unlock()
+
+	bs.setTipHeight(entry.Height)
+
+	local, err := bs.GetScannedBlockHeader()
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not get local block; unexpected error: %v", err)
+		return
+	}
+
+	//已扫描的区块
+	if entry.Height <= local.Height && entry.Hash == local.Hash {
+		return
+	}
+
+	//不连续或发生分叉，由逐块扫描处理
+	if entry.Height != local.Height+1 || entry.PrevHash != local.Hash {
+		bs.addrFilter.setResync(true)
+		bs.signalScan()
+		return
+	}
+
+	bs.wm.Log.Std.Info("block scanner scanning filtered height: %d ...", entry.Height)
+
+	txids := make([]string, 0)
+	if len(args) > 1 {
+		for _, raw := range args[1].Array() {
+			txid, err := handshakeTransaction.GetTxID(raw.String())
+			if err != nil {
+				bs.wm.Log.Std.Info("block scanner can not parse filtered tx; unexpected error: %v", err)
+				continue
+			}
+			txids = append(txids, txid)
+		}
+	}
+	bs.trackFilterOutputsAsync(txids)
+
+	if len(txids) > 0 {
+		err = bs.BatchExtractTransaction(entry.Height, entry.Hash, txids)
+		if err != nil {
+			bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+			//扫描器已停止，不保存区块
+			if isExtractCanceled(err) {
+				return
+			}
+		}
+	}
+
+	block := &Block{
+		Hash:              entry.Hash,
+		Height:            entry.Height,
+		Previousblockhash: entry.PrevHash,
+		Time:              entry.Time,
+	}
+
+	//保存本地新高度
+	bs.SaveLocalNewBlock(block.Height, block.Hash)
+	bs.SaveLocalBlock(block)
+	bs.saveHeader(block)
+	bs.metrics.blockScanned()
+
+	//通知新区块给观测者，异步处理
+	bs.newBlockNotify(block, false)
+
+	//通知达到确认数的交易单
+	bs.notifyConfirmations()
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+	扫描器生命周期：
+	idle ──Run──> running ──Pause──> paused ──Restart──> running
+	running/paused ──Stop──> stopping ──> stopped ──Run──> running
+	Run、Stop、Pause、Restart可以重复调用，在当前状态下无需操作时直接返回。
+	定时任务、新区块通知、websocket推送和地址重扫都登记为进行中的任务，非running状态不开始新的扫描，
+	Stop取消进行中的提取后等待任务结束，超过stopTimeoutSeconds返回错误，
+	此时保持stopping状态，剩余任务结束后再关闭扫描器数据库并进入stopped状态。
+*/
+
+//扫描器状态
+const (
+	ScannerStateIdle     = "idle"
+	ScannerStateRunning  = "running"
+	ScannerStatePaused   = "paused"
+	ScannerStateStopping = "stopping"
+	ScannerStateStopped  = "stopped"
+)
+
+const (
+	defaultStopTimeout = 30 * time.Second //停止时等待任务结束的最长时间
+)
+
+//scannerStates 全部扫描器状态，用于输出指标
+var scannerStates = []string{
+	ScannerStateIdle,
+	ScannerStateRunning,
+	ScannerStatePaused,
+	ScannerStateStopping,
+	ScannerStateStopped,
+}
+
+//State 扫描器当前的状态
+func (bs *HNSBlockScanner) State() string {
+	bs.lifecycleMu.Lock()
+	defer bs.lifecycleMu.Unlock()
+	return bs.state
+}
+
+//isRunning 扫描器是否运行中
+func (bs *HNSBlockScanner) isRunning() bool {
+	return bs.State() == ScannerStateRunning
+}
+
+//beginTask 登记进行中的扫描任务，扫描器不在运行中时返回false，不执行任务
+func (bs *HNSBlockScanner) beginTask() bool {
+	bs.lifecycleMu.Lock()
+	defer bs.lifecycleMu.Unlock()
+	if bs.state != ScannerStateRunning {
+		return false
+	}
+	bs.tasks.Add(1)
+	return true
+}
+
+//beginBackgroundTask 登记不依赖扫描器运行的后台任务，停止过程中返回false
+func (bs *HNSBlockScanner) beginBackgroundTask() bool {
+	bs.lifecycleMu.Lock()
+	defer bs.lifecycleMu.Unlock()
+	switch bs.state {
+	case ScannerStateStopping:
+		return false
+	case ScannerStateStopped:
+		//停止时取消的上下文不能用于新的任务
+		bs.resetExtractContext()
+	}
+	bs.tasks.Add(1)
+	return true
+}
+
+//endTask 结束进行中的任务
+func (bs *HNSBlockScanner) endTask() {
+	bs.tasks.Done()
+}
+
+//stopTimeout 停止时等待任务结束的最长时间
+func (bs *HNSBlockScanner) stopTimeout() time.Duration {
+	if bs.wm.Config.StopTimeout > 0 {
+		return bs.wm.Config.StopTimeout
+	}
+	return defaultStopTimeout
+}
+
+//tasksDone 进行中的任务全部结束后关闭返回的通道
+func (bs *HNSBlockScanner) tasksDone() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		bs.tasks.Wait()
+		close(done)
+	}()
+	return done
+}
+
+//finishStop 任务全部结束后关闭扫描器数据库，进入stopped状态
+func (bs *HNSBlockScanner) finishStop() {
+	bs.closeScannerDB()
+
+	bs.lifecycleMu.Lock()
+	bs.state = ScannerStateStopped
+	bs.lifecycleMu.Unlock()
+}
+
+//Run 运行
+func (bs *HNSBlockScanner) Run() error {
+
+	bs.lifecycleMu.Lock()
+
+	switch bs.state {
+	case ScannerStateRunning:
+		bs.lifecycleMu.Unlock()
+		return nil
+	case ScannerStatePaused:
+		bs.lifecycleMu.Unlock()
+		return bs.Restart()
+	case ScannerStateStopping:
+		bs.lifecycleMu.Unlock()
+		return fmt.Errorf("block scanner is stopping")
+	}
+
+	//定时器停止后不能再次启动，每次运行创建新的定时任务
+	bs.SetTask(bs.ScanBlockTask)
+	bs.resetExtractContext()
+
+	if err := bs.BlockScannerBase.Run(); err != nil {
+		bs.lifecycleMu.Unlock()
+		return err
+	}
+
+	bs.state = ScannerStateRunning
+	bs.stop = make(chan struct{})
+
+	//开启hsd websocket监听新区块和内存池交易，定时扫描作为后备
+	if bs.wm.Config.EnableSocket {
+		bs.tasks.Add(1)
+		go func(stop <-chan struct{}) {
+			defer bs.endTask()
+			bs.setupSocketIO(stop)
+		}(bs.stop)
+	}
+
+	bs.lifecycleMu.Unlock()
+
+	if err := bs.startMetricsServer(); err != nil {
+		bs.wm.Log.Std.Error("metrics server can not start; unexpected error: %v", err)
+	}
+
+	return nil
+}
+
+//Stop 停止扫描，等待进行中的任务结束
+func (bs *HNSBlockScanner) Stop() error {
+
+	bs.lifecycleMu.Lock()
+
+	switch bs.state {
+	case ScannerStateIdle, ScannerStateStopping, ScannerStateStopped:
+		bs.lifecycleMu.Unlock()
+		return nil
+	}
+
+	bs.state = ScannerStateStopping
+
+	//通知停止线程
+	close(bs.stop)
+
+	bs.BlockScannerBase.Stop()
+
+	bs.lifecycleMu.Unlock()
+
+	//取消进行中的提取
+	bs.cancelExtract()
+
+	done := bs.tasksDone()
+	timeout := bs.stopTimeout()
+
+	select {
+	case <-done:
+		bs.stopMetricsServer()
+		bs.finishStop()
+		return nil
+	case <-time.After(timeout):
+	}
+
+	bs.stopMetricsServer()
+
+	//仍有任务在使用扫描器数据库，保持stopping状态，任务结束后再关闭
+	err := fmt.Errorf("block scanner tasks did not finish within %v", timeout)
+	bs.wm.Log.Std.Error("block scanner stop: %v", err)
+	go func() {
+		<-done
+		bs.finishStop()
+	}()
+
+	return err
+}
+
+//Pause 暂停扫描，websocket保持连接，推送的数据不处理
+func (bs *HNSBlockScanner) Pause() error {
+
+	bs.lifecycleMu.Lock()
+	defer bs.lifecycleMu.Unlock()
+
+	switch bs.state {
+	case ScannerStatePaused:
+		return nil
+	case ScannerStateRunning:
+	default:
+		return fmt.Errorf("block scanner is %s", bs.state)
+	}
+
+	bs.BlockScannerBase.Pause()
+	bs.state = ScannerStatePaused
+
+	return nil
+}
+
+//Restart 继续扫描
+func (bs *HNSBlockScanner) Restart() error {
+
+	bs.lifecycleMu.Lock()
+
+	switch bs.state {
+	case ScannerStateRunning:
+		bs.lifecycleMu.Unlock()
+		return nil
+	case ScannerStatePaused:
+	default:
+		bs.lifecycleMu.Unlock()
+		return fmt.Errorf("block scanner is %s", bs.state)
+	}
+
+	bs.BlockScannerBase.Restart()
+	bs.state = ScannerStateRunning
+
+	bs.lifecycleMu.Unlock()
+
+	//补扫暂停期间的区块
+	bs.signalScan()
+
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLifecycleScanner(t *testing.T) (*HNSBlockScanner, func()) {
+
+	server := newTestChainServer()
+	bs := newTestWorkerScanner(t, server.URL)
+	cleanup := useTestScannerDB(t, bs)
+	//定时任务不在测试期间触发
+	bs.PeriodOfTask = time.Hour
+
+	return bs, func() {
+		bs.Stop()
+		cleanup()
+		server.Close()
+	}
+}
+
+func TestScannerLifecycle_StopBeforeRun(t *testing.T) {
+
+	bs, cleanup := newTestLifecycleScanner(t)
+	defer cleanup()
+
+	if err := bs.Stop(); err != nil {
+		t.Fatalf("Stop before Run: %v", err)
+	}
+	if state := bs.State(); state != ScannerStateIdle {
+		t.Fatalf("state = %s, want %s", state, ScannerStateIdle)
+	}
+	if err := bs.Pause(); err == nil {
+		t.Fatalf("Pause before Run should fail")
+	}
+
+	if err := bs.Run(); err != nil {
+		t.Fatalf("Run after Stop: %v", err)
+	}
+	if state := bs.State(); state != ScannerStateRunning {
+		t.Fatalf("state = %s, want %s", state, ScannerStateRunning)
+	}
+}
+
+func TestScannerLifecycle_RepeatedStop(t *testing.T) {
+
+	bs, cleanup := newTestLifecycleScanner(t)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		if err := bs.Run(); err != nil {
+			t.Fatalf("Run #%d: %v", i, err)
+		}
+		if err := bs.Run(); err != nil {
+			t.Fatalf("repeated Run #%d: %v", i, err)
+		}
+		for j := 0; j < 3; j++ {
+			if err := bs.Stop(); err != nil {
+				t.Fatalf("Stop #%d.%d: %v", i, j, err)
+			}
+		}
+		if state := bs.State(); state != ScannerStateStopped {
+			t.Fatalf("state = %s, want %s", state, ScannerStateStopped)
+		}
+		if bs.beginTask() {
+			t.Fatalf("task started while stopped")
+		}
+	}
+}
+
+func TestScannerLifecycle_PauseRestart(t *testing.T) {
+
+	bs, cleanup := newTestLifecycleScanner(t)
+	defer cleanup()
+
+	if err := bs.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := bs.Pause(); err != nil {
+			t.Fatalf("Pause #%d: %v", i, err)
+		}
+	}
+	if state := bs.State(); state != ScannerStatePaused {
+		t.Fatalf("state = %s, want %s", state, ScannerStatePaused)
+	}
+	if bs.beginTask() {
+		t.Fatalf("task started while paused")
+	}
+
+	rec := httptest.NewRecorder()
+	bs.serveHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != 503 {
+		t.Fatalf("health while paused = %d, want 503", rec.Code)
+	}
+
+	//暂停时Run继续扫描
+	if err := bs.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if state := bs.State(); state != ScannerStateRunning {
+		t.Fatalf("state = %s, want %s", state, ScannerStateRunning)
+	}
+
+	rec = httptest.NewRecorder()
+	bs.serveHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != 200 || rec.Body.String() != "running\n" {
+		t.Fatalf("health while running = %d %q", rec.Code, rec.Body.String())
+	}
+
+	bs.Pause()
+	if err := bs.Stop(); err != nil {
+		t.Fatalf("Stop while paused: %v", err)
+	}
+	if err := bs.Restart(); err == nil {
+		t.Fatalf("Restart after Stop should fail")
+	}
+}
+
+func TestScannerLifecycle_StopDrain(t *testing.T) {
+
+	bs, cleanup := newTestLifecycleScanner(t)
+	defer cleanup()
+
+	bs.wm.Config.StopTimeout = time.Second
+
+	//进行中的任务结束后停止
+	if err := bs.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !bs.beginTask() {
+		t.Fatal("task not started while running")
+	}
+	finished := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+		bs.endTask()
+	}()
+	if err := bs.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatalf("Stop returned before the task finished")
+	}
+
+	//任务超时未结束
+	bs.wm.Config.StopTimeout = 50 * time.Millisecond
+	if err := bs.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !bs.beginTask() {
+		t.Fatal("task not started while running")
+	}
+	if err := bs.Stop(); err == nil {
+		t.Fatalf("Stop should time out")
+	}
+	if state := bs.State(); state != ScannerStateStopping {
+		t.Fatalf("state = %s, want %s", state, ScannerStateStopping)
+	}
+	if err := bs.Run(); err == nil {
+		t.Fatalf("Run while the old task is running should fail")
+	}
+
+	//剩余任务结束后进入stopped状态
+	bs.endTask()
+	deadline := time.Now().Add(time.Second)
+	for bs.State() != ScannerStateStopped {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %s after the task finished, want %s", bs.State(), ScannerStateStopped)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := bs.Run(); err != nil {
+		t.Fatalf("Run after the task finished: %v", err)
+	}
+}
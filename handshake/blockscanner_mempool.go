@@ -0,0 +1,342 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+/*
+	内存池视图：
+	存在HNSMempoolObservers时，扫描器把内存池中关注地址的交易单保存到扫描器数据库，并按花费的输出建立索引，
+	交易单状态变化时通知HNSMempoolObservers：
+	FirstSeen   第一次在内存池中发现
+	Confirmed   被区块确认
+	Conflicted  花费的输出被另一笔交易单花费，ConflictTxID为冲突的交易单
+	Evicted     离开内存池且节点找不到
+	Expired     离开内存池且在内存池停留超过mempoolExpirySeconds，节点因超时丢弃
+	冲突只能在扫描器提取到冲突交易单时发现，过滤器模式下只提取匹配的交易单，
+	未发现的冲突在交易单离开内存池时以Evicted通知。
+*/
+
+//内存池事件
+const (
+	MempoolEventFirstSeen  = "FirstSeen"
+	MempoolEventConfirmed  = "Confirmed"
+	MempoolEventConflicted = "Conflicted"
+	MempoolEventEvicted    = "Evicted"
+	MempoolEventExpired    = "Expired"
+)
+
+const (
+	defaultMempoolExpiry = 72 * time.Hour //节点内存池交易单的过期时间
+)
+
+//HNSMempoolNotificationObject 内存池事件的被通知对象
+type HNSMempoolNotificationObject interface {
+
+	//HNSMempoolNotify 关注的交易单在内存池的状态变化
+	HNSMempoolNotify(event *MempoolEvent) error
+}
+
+//MempoolTx 内存池中关注的交易单
+type MempoolTx struct {
+	TxID       string   `storm:"id"`
+	SourceKeys []string //关注地址的sourceKey
+	Outpoints  []string //花费的输出，txid:vout
+	FirstSeen  int64
+}
+
+//MempoolSpend 关注的交易单花费的输出，用于发现冲突
+type MempoolSpend struct {
+	Outpoint string `storm:"id"`
+	TxID     string
+}
+
+//MempoolEvent 内存池事件
+type MempoolEvent struct {
+	Type         string
+	TxID         string
+	SourceKeys   []string
+	ConflictTxID string //冲突的交易单
+	BlockHeight  uint64 //确认或冲突交易单所在的区块，在内存池时为0
+	BlockHash    string
+	FirstSeen    int64
+	Time         int64
+}
+
+//newMempoolEvent 创建交易单的事件
+func newMempoolEvent(eventType string, tx *MempoolTx) *MempoolEvent {
+	return &MempoolEvent{
+		Type:       eventType,
+		TxID:       tx.TxID,
+		SourceKeys: tx.SourceKeys,
+		FirstSeen:  tx.FirstSeen,
+		Time:       time.Now().Unix(),
+	}
+}
+
+//txOutpoint 输出的索引键
+func txOutpoint(txid string, vout uint64) string {
+	return fmt.Sprintf("%s:%d", txid, vout)
+}
+
+//txOutpoints 交易单花费的输出
+func txOutpoints(trx *Transaction) []string {
+	outpoints := make([]string, 0, len(trx.Vins))
+	for _, input := range trx.Vins {
+		if input.IsCoinbase() {
+			continue
+		}
+		outpoints = append(outpoints, txOutpoint(input.TxID, input.Vout))
+	}
+	return outpoints
+}
+
+//AddHNSMempoolObserver 添加内存池事件的观测者
+func (bs *HNSBlockScanner) AddHNSMempoolObserver(obj HNSMempoolNotificationObject) error {
+	bs.Mu.Lock()
+	defer bs.Mu.Unlock()
+
+	if obj == nil {
+		return nil
+	}
+
+	bs.HNSMempoolObservers[obj] = true
+
+	return nil
+}
+
+//RemoveHNSMempoolObserver 移除内存池事件的观测者
+func (bs *HNSBlockScanner) RemoveHNSMempoolObserver(obj HNSMempoolNotificationObject) error {
+	bs.Mu.Lock()
+	defer bs.Mu.Unlock()
+
+	delete(bs.HNSMempoolObservers, obj)
+
+	return nil
+}
+
+//hasHNSMempoolObservers 是否存在内存池事件的观测者
+func (bs *HNSBlockScanner) hasHNSMempoolObservers() bool {
+	bs.Mu.RLock()
+	defer bs.Mu.RUnlock()
+	return len(bs.HNSMempoolObservers) > 0
+}
+
+//newMempoolNotify 通知内存池事件
+func (bs *HNSBlockScanner) newMempoolNotify(events []*MempoolEvent) {
+
+	if len(events) == 0 {
+		return
+	}
+
+	bs.Mu.RLock()
+	observers := make([]HNSMempoolNotificationObject, 0, len(bs.HNSMempoolObservers))
+	for o := range bs.HNSMempoolObservers {
+		observers = append(observers, o)
+	}
+	bs.Mu.RUnlock()
+
+	for _, event := range events {
+		bs.wm.Log.Std.Info("block scanner mempool tx: %s %s %s", event.TxID, event.Type, event.ConflictTxID)
+		for _, o := range observers {
+			if err := o.HNSMempoolNotify(event); err != nil {
+				bs.wm.Log.Std.Error("HNSMempoolNotify unexpected error: %v", err)
+			}
+		}
+	}
+}
+
+//mempoolExpiry 内存池交易单的过期时间
+func (bs *HNSBlockScanner) mempoolExpiry() time.Duration {
+	if bs.wm.Config.MempoolExpiry > 0 {
+		return bs.wm.Config.MempoolExpiry
+	}
+	return defaultMempoolExpiry
+}
+
+//GetMempoolView 查询内存池中关注的交易单
+func (bs *HNSBlockScanner) GetMempoolView() ([]*MempoolTx, error) {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*MempoolTx, 0)
+	err = db.All(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//getMempoolTx 查询内存池视图中的交易单，不存在时返回nil
+func getMempoolTx(db storm.Node, txid string) *MempoolTx {
+	tx := &MempoolTx{}
+	if err := db.One("TxID", txid, tx); err != nil {
+		return nil
+	}
+	return tx
+}
+
+//removeMempoolTx 从内存池视图删除交易单和花费索引
+func removeMempoolTx(db storm.Node, tx *MempoolTx) {
+	for _, outpoint := range tx.Outpoints {
+		spend := &MempoolSpend{}
+		if err := db.One("Outpoint", outpoint, spend); err == nil && spend.TxID == tx.TxID {
+			db.DeleteStruct(spend)
+		}
+	}
+	db.DeleteStruct(tx)
+}
+
+//txDropped 交易单已离开内存池且节点上查不到，查询失败时返回false
+func (bs *HNSBlockScanner) txDropped(txid string) bool {
+	_, err := bs.wm.GetTransaction(txid)
+	rpcErr, ok := AsRPCError(err)
+	return ok && rpcErr.IsTxNotFound()
+}
+
+//updateMempoolView 根据提取的交易单更新内存池视图，blockHeight为0时交易单在内存池
+func (bs *HNSBlockScanner) updateMempoolView(blockHeight uint64, blockHash string, result *ExtractResult) {
+
+	if !bs.hasHNSMempoolObservers() {
+		return
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not update mempool view; unexpected error: %v", err)
+		return
+	}
+
+	events := make([]*MempoolEvent, 0)
+
+	bs.mempoolMu.Lock()
+
+	//被区块确认
+	if blockHeight > 0 {
+		if tx := getMempoolTx(db, result.TxID); tx != nil {
+			removeMempoolTx(db, tx)
+			event := newMempoolEvent(MempoolEventConfirmed, tx)
+			event.BlockHeight = blockHeight
+			event.BlockHash = blockHash
+			events = append(events, event)
+		}
+	}
+
+	//花费了关注交易单的输出，任意交易单都可能冲突
+	for _, outpoint := range result.outpoints {
+		spend := &MempoolSpend{}
+		if err := db.One("Outpoint", outpoint, spend); err != nil || spend.TxID == result.TxID {
+			continue
+		}
+		tx := getMempoolTx(db, spend.TxID)
+		if tx == nil {
+			db.DeleteStruct(spend)
+			continue
+		}
+		removeMempoolTx(db, tx)
+		event := newMempoolEvent(MempoolEventConflicted, tx)
+		event.ConflictTxID = result.TxID
+		event.BlockHeight = blockHeight
+		event.BlockHash = blockHash
+		events = append(events, event)
+	}
+
+	//第一次发现关注的交易单
+	if blockHeight == 0 && len(result.extractData) > 0 && getMempoolTx(db, result.TxID) == nil {
+		tx := &MempoolTx{
+			TxID:      result.TxID,
+			Outpoints: result.outpoints,
+			FirstSeen: time.Now().Unix(),
+		}
+		for key := range result.extractData {
+			tx.SourceKeys = append(tx.SourceKeys, key)
+		}
+		if err := db.Save(tx); err != nil {
+			bs.wm.Log.Std.Info("block scanner can not save mempool tx; unexpected error: %v", err)
+		} else {
+			for _, outpoint := range tx.Outpoints {
+				db.Save(&MempoolSpend{Outpoint: outpoint, TxID: tx.TxID})
+			}
+			events = append(events, newMempoolEvent(MempoolEventFirstSeen, tx))
+		}
+	}
+
+	bs.mempoolMu.Unlock()
+
+	bs.newMempoolNotify(events)
+}
+
+//pruneMempoolView 删除已离开内存池的交易单，已被区块确认的等待扫描区块时通知
+func (bs *HNSBlockScanner) pruneMempoolView(txids []string) error {
+
+	if !bs.hasHNSMempoolObservers() {
+		return nil
+	}
+
+	view, err := bs.GetMempoolView()
+	if err != nil || len(view) == 0 {
+		return err
+	}
+
+	inMempool := make(map[string]bool)
+	for _, txid := range txids {
+		inMempool[txid] = true
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	events := make([]*MempoolEvent, 0)
+	expired := time.Now().Add(-bs.mempoolExpiry()).Unix()
+
+	for _, tx := range view {
+
+		if inMempool[tx.TxID] {
+			continue
+		}
+
+		if !bs.txDropped(tx.TxID) {
+			//已被区块确认，或无法确认状态，下次再检查
+			continue
+		}
+
+		eventType := MempoolEventEvicted
+		if tx.FirstSeen <= expired {
+			eventType = MempoolEventExpired
+		}
+
+		bs.mempoolMu.Lock()
+		if getMempoolTx(db, tx.TxID) != nil {
+			removeMempoolTx(db, tx)
+			events = append(events, newMempoolEvent(eventType, tx))
+		}
+		bs.mempoolMu.Unlock()
+	}
+
+	bs.newMempoolNotify(events)
+
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type testMempoolObserver struct {
+	events []*MempoolEvent
+}
+
+func (o *testMempoolObserver) HNSMempoolNotify(event *MempoolEvent) error {
+	o.events = append(o.events, event)
+	return nil
+}
+
+//take 取出已通知的事件
+func (o *testMempoolObserver) take() []*MempoolEvent {
+	events := o.events
+	o.events = nil
+	return events
+}
+
+//testMempoolResult 提取结果，watched为true时匹配关注地址
+func testMempoolResult(txid string, watched bool, outpoints ...string) *ExtractResult {
+	result := &ExtractResult{
+		TxID:        txid,
+		extractData: make(map[string]*openwallet.TxExtractData),
+		outpoints:   outpoints,
+	}
+	if watched {
+		result.extractData["account"] = &openwallet.TxExtractData{}
+	}
+	return result
+}
+
+func TestMempoolView(t *testing.T) {
+
+	server := newTestRPCServer()
+	defer server.Close()
+
+	wm, cleanup := newTestScannerWallet(t, server.URL)
+	defer cleanup()
+	bs := wm.Blockscanner
+
+	o := &testMempoolObserver{}
+	bs.AddHNSMempoolObserver(o)
+
+	//未关注的交易单不记录
+	bs.updateMempoolView(0, "", testMempoolResult("other", false, "p0:0"))
+	bs.updateMempoolView(0, "", testMempoolResult("m1", true, "p1:0"))
+	bs.updateMempoolView(0, "", testMempoolResult("m1", true, "p1:0"))
+	events := o.take()
+	if len(events) != 1 || events[0].Type != MempoolEventFirstSeen || events[0].TxID != "m1" || events[0].SourceKeys[0] != "account" {
+		t.Fatalf("unexpected first seen events: %+v", events)
+	}
+
+	//花费同一输出的交易单
+	bs.updateMempoolView(0, "", testMempoolResult("m2", false, "p1:0"))
+	events = o.take()
+	if len(events) != 1 || events[0].Type != MempoolEventConflicted || events[0].TxID != "m1" || events[0].ConflictTxID != "m2" {
+		t.Fatalf("unexpected conflict events: %+v", events)
+	}
+
+	bs.updateMempoolView(0, "", testMempoolResult("m3", true, "p3:0"))
+	bs.updateMempoolView(100, "h100", testMempoolResult("m3", true, "p3:0"))
+	events = o.take()
+	if len(events) != 2 || events[1].Type != MempoolEventConfirmed || events[1].BlockHeight != 100 {
+		t.Fatalf("unexpected confirmed events: %+v", events)
+	}
+
+	//离开内存池，节点找不到的交易单以bad开头
+	bs.updateMempoolView(0, "", testMempoolResult("bad4", true, "p4:0"))
+	bs.updateMempoolView(0, "", testMempoolResult("bad5", true, "p5:0"))
+	bs.updateMempoolView(0, "", testMempoolResult("tx6", true, "p6:0"))
+	o.take()
+
+	db, _ := bs.scannerDB()
+	tx := getMempoolTx(db, "bad5")
+	tx.FirstSeen -= int64(defaultMempoolExpiry.Seconds())
+	db.Save(tx)
+
+	if err := bs.pruneMempoolView([]string{"other"}); err != nil {
+		t.Fatalf("pruneMempoolView failed: %v", err)
+	}
+	types := make(map[string]string)
+	for _, event := range o.take() {
+		types[event.TxID] = event.Type
+	}
+	if len(types) != 2 || types["bad4"] != MempoolEventEvicted || types["bad5"] != MempoolEventExpired {
+		t.Fatalf("unexpected eviction events: %v", types)
+	}
+
+	view, _ := bs.GetMempoolView()
+	if len(view) != 1 || view[0].TxID != "tx6" {
+		t.Fatalf("unexpected mempool view: %+v", view)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+/*
+	名称事件：
+	提取交易单时解码输出的契约，关注地址的名称契约生成名称事件，
+	同一交易单同一名称的事件合并为一个SmartContractReceipt，
+	通过BlockExtractSmartContractDataNotify通知观测者，Coin.ContractID为名称哈希。
+	关注名称的契约不论地址都会通知，见blockscanner_watchname.go。
+*/
+
+const (
+	nameContractProtocol = "covenant" //名称合约的协议
+)
+
+//newNameContract 名称对应的合约信息，合约地址为名称哈希
+func (bs *HNSBlockScanner) newNameContract(nameHash, name string) openwallet.SmartContract {
+	return openwallet.SmartContract{
+		ContractID: openwallet.GenContractID(bs.wm.Symbol(), nameHash),
+		Symbol:     bs.wm.Symbol(),
+		Address:    nameHash,
+		Protocol:   nameContractProtocol,
+		Name:       name,
+		Decimals:   uint64(bs.wm.Decimal()),
+	}
+}
+
+//extractNameEvents 提取关注地址的名称事件
+func (bs *HNSBlockScanner) extractNameEvents(trx *Transaction, result *ExtractResult, scanAddressFunc openwallet.BlockScanTargetFuncV2) {
+
+	from := ""
+	for _, input := range trx.Vins {
+		if !input.IsCoinbase() && len(input.Addr) > 0 {
+			from = input.Addr
+			break
+		}
+	}
+
+	for _, output := range trx.Vouts {
+
+		event := newNameEvent(trx, output)
+		if event == nil {
+			continue
+		}
+
+		targetResult := scanAddressFunc(openwallet.ScanTargetParam{
+			ScanTarget:     output.Addr,
+			Symbol:         bs.wm.Symbol(),
+			ScanTargetType: openwallet.ScanTargetTypeAccountAddress,
+		})
+		addressSourceKey := ""
+		if targetResult.Exist {
+			addressSourceKey = targetResult.SourceKey
+			bs.addNameReceipt(result, addressSourceKey, trx, from, event)
+		}
+
+		//关注的名称，与地址无关
+		bs.extractWatchedNameEvent(trx, result, from, addressSourceKey, event)
+	}
+}
+
+//addNameReceipt 把名称事件加入交易回执，同一名称的事件合并
+func (bs *HNSBlockScanner) addNameReceipt(result *ExtractResult, sourceKey string, trx *Transaction, from string, event *NameEvent) {
+
+	if result.contractData == nil {
+		result.contractData = make(map[string][]*openwallet.SmartContractReceipt)
+	}
+
+	contract := bs.newNameContract(event.NameHash, event.Name)
+
+	var receipt *openwallet.SmartContractReceipt
+	for _, r := range result.contractData[sourceKey] {
+		if r.Coin.ContractID == contract.ContractID {
+			receipt = r
+			break
+		}
+	}
+
+	if receipt == nil {
+		receipt = &openwallet.SmartContractReceipt{
+			Coin: openwallet.Coin{
+				Symbol:     bs.wm.Symbol(),
+				IsContract: true,
+				ContractID: contract.ContractID,
+				Contract:   contract,
+			},
+			TxID:        trx.TxID,
+			From:        from,
+			To:          event.Address,
+			Value:       "0",
+			Fees:        trx.Fees,
+			BlockHash:   trx.BlockHash,
+			BlockHeight: trx.BlockHeight,
+			ConfirmTime: trx.Blocktime,
+			Status:      openwallet.TxStatusSuccess,
+		}
+		receipt.GenWxID()
+		result.contractData[sourceKey] = append(result.contractData[sourceKey], receipt)
+	}
+
+	//名称只在部分契约中出现，补充到合约信息
+	if len(event.Name) > 0 && len(receipt.Coin.Contract.Name) == 0 {
+		receipt.Coin.Contract.Name = event.Name
+	}
+
+	value, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	receipt.Events = append(receipt.Events, &openwallet.SmartContractEvent{
+		Contract: &receipt.Coin.Contract,
+		Event:    event.Event,
+		Value:    string(value),
+	})
+
+	raw, _ := json.Marshal(receipt.Events)
+	receipt.RawReceipt = string(raw)
+}
+
+//newExtractContractDataNotify 发送名称事件通知，通知失败时记录未扫的交易单并返回错误
+//txid为空时（例如到期提醒）不记录未扫记录，由调用者决定是否重试
+func (bs *HNSBlockScanner) newExtractContractDataNotify(height uint64, txid string, contractData map[string][]*openwallet.SmartContractReceipt) error {
+
+	var notifyErr error
+	for o := range bs.Observers {
+		for key, receipts := range contractData {
+			for _, receipt := range receipts {
+				err := o.BlockExtractSmartContractDataNotify(key, receipt)
+				if err != nil {
+					bs.wm.Log.Error("BlockExtractSmartContractDataNotify unexpected error:", err)
+					notifyErr = err
+				}
+			}
+		}
+	}
+
+	if notifyErr != nil && len(txid) > 0 {
+		//记录未扫的交易单
+		unscanRecord := openwallet.NewUnscanRecord(height, txid, "ExtractContractData Notify failed.", bs.wm.Symbol())
+		err := bs.SaveUnscanRecord(unscanRecord)
+		if err != nil {
+			bs.wm.Log.Std.Error("block height: %d, save unscan record failed. unexpected error: %v", height, err.Error())
+		}
+	}
+
+	return notifyErr
+}
+
+//ExtractTransactionAndReceiptData 提取交易单及名称事件的交易回执
+func (bs *HNSBlockScanner) ExtractTransactionAndReceiptData(txid string, scanTargetFunc openwallet.BlockScanTargetFuncV2) (map[string][]*openwallet.TxExtractData, map[string]*openwallet.SmartContractReceipt, error) {
+
+	trx, err := bs.wm.GetTransaction(txid)
+	if err != nil {
+		return nil, nil, err
+	}
+	trx.Decimals = bs.wm.Decimal()
+
+	result := ExtractResult{
+		BlockHeight: trx.BlockHeight,
+		TxID:        txid,
+		extractData: make(map[string]*openwallet.TxExtractData),
+	}
+
+	bs.extractTransaction(trx, &result, scanTargetFunc)
+	if !result.Success {
+		return nil, nil, fmt.Errorf("extract transaction failed")
+	}
+
+	extData := make(map[string][]*openwallet.TxExtractData)
+	for key, data := range result.extractData {
+		extData[key] = append(extData[key], data)
+	}
+
+	//一笔交易单可能涉及多个名称，按合约ID返回
+	receipts := make(map[string]*openwallet.SmartContractReceipt)
+	for _, list := range result.contractData {
+		for _, receipt := range list {
+			receipts[receipt.Coin.ContractID] = receipt
+		}
+	}
+
+	return extData, receipts, nil
+}
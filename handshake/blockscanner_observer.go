@@ -0,0 +1,149 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+)
+
+/*
+	区块观测者：
+	用于实现浏览器，扫描到新区块时把区块和全部交易单的详情通知HNSBlockObservers，
+	交易单的输入已补全地址和数量。
+	存在区块观测者时，扫描器先获取区块全部交易单，再提取关注地址的记录，
+	获取失败时不保存区块，下次重扫，IsSkipFailedBlock为true时跳过失败的交易单继续，
+	此时区块以Partial为true通知，MissingTxs为获取失败的交易单。
+	回滚的区块以Fork为true通知，不附带交易单。
+	区块观测者需要完整的区块，不使用过滤器模式。
+*/
+
+//AddHNSBlockObserver 添加区块观测者
+func (bs *HNSBlockScanner) AddHNSBlockObserver(obj HNSBlockScanNotificationObject) error {
+	bs.Mu.Lock()
+	defer bs.Mu.Unlock()
+
+	if obj == nil {
+		return nil
+	}
+	if _, exist := bs.HNSBlockObservers[obj]; exist {
+		//已存在，不重复订阅
+		return nil
+	}
+
+	bs.HNSBlockObservers[obj] = true
+
+	return nil
+}
+
+//RemoveHNSBlockObserver 移除区块观测者
+func (bs *HNSBlockScanner) RemoveHNSBlockObserver(obj HNSBlockScanNotificationObject) error {
+	bs.Mu.Lock()
+	defer bs.Mu.Unlock()
+
+	delete(bs.HNSBlockObservers, obj)
+
+	return nil
+}
+
+//hnsBlockObservers 当前的区块观测者
+func (bs *HNSBlockScanner) hnsBlockObservers() []HNSBlockScanNotificationObject {
+	bs.Mu.RLock()
+	defer bs.Mu.RUnlock()
+
+	observers := make([]HNSBlockScanNotificationObject, 0, len(bs.HNSBlockObservers))
+	for o := range bs.HNSBlockObservers {
+		observers = append(observers, o)
+	}
+	return observers
+}
+
+//hasHNSBlockObservers 是否存在区块观测者
+func (bs *HNSBlockScanner) hasHNSBlockObservers() bool {
+	bs.Mu.RLock()
+	defer bs.Mu.RUnlock()
+	return len(bs.HNSBlockObservers) > 0
+}
+
+//loadBlockTxs 获取区块全部交易单的详情并补全输入，成功后block.txDetails为全部交易单
+//失败的交易单留在block.tx中，提取时重新查询，区块标记为Partial
+func (bs *HNSBlockScanner) loadBlockTxs(block *Block) error {
+
+	txDetails := make([]*Transaction, 0, len(block.txDetails)+len(block.tx))
+	txDetails = append(txDetails, block.txDetails...)
+
+	missing := make([]string, 0)
+	var loadErr error
+
+	for _, txid := range block.tx {
+		trx, err := bs.wm.GetTransaction(txid)
+		if err != nil {
+			missing = append(missing, txid)
+			loadErr = err
+			continue
+		}
+		trx.BlockHeight = block.Height
+		trx.BlockHash = block.Hash
+		trx.Blocktime = int64(block.Time)
+		txDetails = append(txDetails, trx)
+	}
+
+	loaded := make([]*Transaction, 0, len(txDetails))
+	for _, trx := range txDetails {
+		if err := bs.fillTxInputs(trx); err != nil {
+			missing = append(missing, trx.TxID)
+			loadErr = err
+			continue
+		}
+		loaded = append(loaded, trx)
+	}
+
+	block.tx = missing
+	block.txDetails = loaded
+	block.Partial = len(missing) > 0
+	block.MissingTxs = missing
+
+	if loadErr != nil {
+		return fmt.Errorf("block %d load %d transactions failed: %v", block.Height, len(missing), loadErr)
+	}
+
+	return nil
+}
+
+//newHNSBlockNotify 通知区块和交易单详情给区块观测者
+func (bs *HNSBlockScanner) newHNSBlockNotify(block *Block, isFork bool) {
+
+	observers := bs.hnsBlockObservers()
+	if len(observers) == 0 {
+		return
+	}
+
+	block.Fork = isFork
+
+	var txs []*Transaction
+	if !isFork {
+		txs = block.txDetails
+	}
+
+	if !isFork && block.Partial {
+		bs.wm.Log.Std.Warning("block height: %d notify partial block, missing txs: %v", block.Height, block.MissingTxs)
+	}
+
+	for _, o := range observers {
+		if err := o.HNSBlockScanNotify(block, txs); err != nil {
+			bs.wm.Log.Std.Error("HNSBlockScanNotify unexpected error: %v", err)
+		}
+	}
+}
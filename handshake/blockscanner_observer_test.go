@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"testing"
+)
+
+type testHNSBlockObserver struct {
+	blocks []*Block
+	txs    [][]*Transaction
+}
+
+func (o *testHNSBlockObserver) HNSBlockScanNotify(block *Block, txs []*Transaction) error {
+	o.blocks = append(o.blocks, block)
+	o.txs = append(o.txs, txs)
+	return nil
+}
+
+func TestHNSBlockObserver(t *testing.T) {
+
+	wm := NewWalletManager()
+	bs := wm.Blockscanner
+
+	o := &testHNSBlockObserver{}
+	bs.AddHNSBlockObserver(o)
+	bs.AddHNSBlockObserver(o)
+	if !bs.hasHNSBlockObservers() || len(bs.hnsBlockObservers()) != 1 {
+		t.Fatal("observer not registered once")
+	}
+
+	//输入已补全的交易单不需要查询节点
+	block := &Block{
+		Hash:   "b1",
+		Height: 10,
+		txDetails: []*Transaction{
+			{TxID: "t1", Vins: []*Vin{{Coinbase: "true"}}},
+			{TxID: "t2", Vins: []*Vin{{TxID: "t0", Addr: "hs1qtsevyrskarucasazwgs7rk8stc36lky7wqrh5k", Value: "1"}}},
+		},
+	}
+	if err := bs.loadBlockTxs(block); err != nil {
+		t.Fatalf("loadBlockTxs failed: %v", err)
+	}
+
+	bs.newHNSBlockNotify(block, false)
+	bs.newHNSBlockNotify(&Block{Hash: "b1", Height: 10}, true)
+
+	if len(o.blocks) != 2 || len(o.txs[0]) != 2 {
+		t.Fatalf("unexpected notifications: %d blocks", len(o.blocks))
+	}
+	if !o.blocks[1].Fork || o.txs[1] != nil {
+		t.Error("fork block should be notified without transactions")
+	}
+
+	bs.RemoveHNSBlockObserver(o)
+	bs.newHNSBlockNotify(block, false)
+	if len(o.blocks) != 2 {
+		t.Error("removed observer still notified")
+	}
+}
+
+func TestHNSBlockObserver_PartialBlock(t *testing.T) {
+
+	server := newTestRPCServer()
+	defer server.Close()
+
+	bs := newTestWorkerScanner(t, server.URL)
+	o := &testHNSBlockObserver{}
+	bs.AddHNSBlockObserver(o)
+
+	block := &Block{Hash: "b1", Height: 10, tx: []string{"t1", "bad2", "t3"}}
+	if err := bs.loadBlockTxs(block); err == nil {
+		t.Fatal("loadBlockTxs should fail with missing transaction")
+	}
+	if !block.Partial || len(block.MissingTxs) != 1 || block.MissingTxs[0] != "bad2" {
+		t.Fatalf("partial block = %v, missing: %v", block.Partial, block.MissingTxs)
+	}
+	//失败的交易单留给提取时重新查询
+	if len(block.tx) != 1 || len(block.txDetails) != 2 {
+		t.Fatalf("unexpected block txs: %v, details: %d", block.tx, len(block.txDetails))
+	}
+
+	bs.newHNSBlockNotify(block, false)
+	if len(o.blocks) != 1 || !o.blocks[0].Partial || len(o.txs[0]) != 2 {
+		t.Fatalf("unexpected notifications: %d blocks", len(o.blocks))
+	}
+}
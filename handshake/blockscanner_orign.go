@@ -284,44 +284,6 @@ type HNSBlockScanNotificationObject interface {
 //	return nil
 //}
 //
-////AddObserver 添加观测者
-//func (bs *HNSBlockScanner) AddHNSBlockObserver(obj HNSBlockScanNotificationObject) error {
-//	bs.Mu.Lock()
-//
-//	defer bs.Mu.Unlock()
-//
-//	if obj == nil {
-//		return nil
-//	}
-//	if _, exist := bs.HNSBlockObservers[obj]; exist {
-//		//已存在，不重复订阅
-//		return nil
-//	}
-//
-//	bs.HNSBlockObservers[obj] = true
-//
-//	return nil
-//}
-//
-////RemoveObserver 移除观测者
-//func (bs *HNSBlockScanner) RemoveHNSBlockObserver(obj HNSBlockScanNotificationObject) error {
-//	bs.Mu.Lock()
-//	defer bs.Mu.Unlock()
-//
-//	delete(bs.HNSBlockObservers, obj)
-//
-//	return nil
-//}
-//
-////newBlockNotify 获得新区块后，通知给观测者
-//func (bs *HNSBlockScanner) NewHNSBlockNotify(block *Block, isFork bool) {
-//	block.Fork = isFork
-//	for o, _ := range bs.HNSBlockObservers {
-//		o.HNSBlockScanNotify(block, block.txDetails)
-//	}
-//}
-//
-//
 ////GetScannedBlockHeader 获取当前扫描的区块头
 //func (bs *HNSBlockScanner) GetScannedBlockHeaderOrigin() (*openwallet.BlockHeader, error) {
 //
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+	追赶模式：
+	本地高度落后节点catchUpThreshold个区块以上时，扫描器启动预取，
+	prefetchWorkers个线程并行获取后面的区块并补全交易单输入，最多领先prefetchWindow个区块。
+	扫描循环仍按高度逐个取出预取的区块提取和保存，通知顺序与逐块扫描一致。
+	预取失败的高度由扫描循环重新获取，发生分叉时丢弃预取的区块，
+	扫描到预取的最后高度后交回逐块扫描。
+*/
+
+const (
+	defaultCatchUpThreshold = 100 //落后多少个区块进入追赶模式
+	defaultPrefetchWorkers  = 4   //预取区块的线程数
+	defaultPrefetchWindow   = 32  //最多预取的区块数
+)
+
+//prefetchedBlock 预取的区块
+type prefetchedBlock struct {
+	hash  string
+	block *Block
+	err   error
+}
+
+//blockPrefetcher 并行预取[start, end]的区块
+type blockPrefetcher struct {
+	start  uint64
+	end    uint64
+	ctx    context.Context
+	cancel context.CancelFunc
+	window chan struct{} //已预取未取出的区块数
+	mu     sync.Mutex
+	slots  map[uint64]chan *prefetchedBlock
+}
+
+//catchUpThreshold 进入追赶模式落后的区块数，0为不启用
+func (bs *HNSBlockScanner) catchUpThreshold() uint64 {
+	return bs.wm.Config.CatchUpThreshold
+}
+
+//shouldCatchUp 是否进入追赶模式
+func (bs *HNSBlockScanner) shouldCatchUp(height, maxHeight uint64) bool {
+	threshold := bs.catchUpThreshold()
+	return threshold > 0 && maxHeight >= height && maxHeight-height >= threshold
+}
+
+//newBlockPrefetcher 启动预取，扫描器停止时一起取消
+func (bs *HNSBlockScanner) newBlockPrefetcher(start, end uint64) *blockPrefetcher {
+
+	workers := bs.wm.Config.PrefetchWorkers
+	if workers <= 0 {
+		workers = defaultPrefetchWorkers
+	}
+	window := bs.wm.Config.PrefetchWindow
+	if window < workers {
+		window = workers
+	}
+
+	ctx, cancel := context.WithCancel(bs.extractContext())
+	p := &blockPrefetcher{
+		start:  start,
+		end:    end,
+		ctx:    ctx,
+		cancel: cancel,
+		window: make(chan struct{}, window),
+		slots:  make(map[uint64]chan *prefetchedBlock),
+	}
+
+	bs.wm.Log.Std.Info("block scanner catching up from height: %d to %d", start, end)
+
+	//按高度顺序分发，领先的区块数不超过window
+	heights := make(chan uint64)
+	go func() {
+		defer close(heights)
+		for h := start; h <= end; h++ {
+			select {
+			case p.window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case heights <- h:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for h := range heights {
+				p.slot(h) <- bs.prefetchBlock(h)
+			}
+		}()
+	}
+
+	return p
+}
+
+//slot 高度对应的结果通道，容量为1，预取线程和扫描循环谁先到谁创建
+func (p *blockPrefetcher) slot(height uint64) chan *prefetchedBlock {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch, ok := p.slots[height]
+	if !ok {
+		ch = make(chan *prefetchedBlock, 1)
+		p.slots[height] = ch
+	}
+	return ch
+}
+
+//take 取出预取的区块，不在预取范围、预取失败或已停止时block为nil
+func (p *blockPrefetcher) take(height uint64) (string, *Block) {
+
+	if p == nil || height < p.start || height > p.end {
+		return "", nil
+	}
+
+	select {
+	case fetched := <-p.slot(height):
+		p.mu.Lock()
+		delete(p.slots, height)
+		p.mu.Unlock()
+		//释放预取窗口
+		<-p.window
+		if fetched.err != nil {
+			return "", nil
+		}
+		return fetched.hash, fetched.block
+	case <-p.ctx.Done():
+		return "", nil
+	}
+}
+
+//stop 停止预取
+func (p *blockPrefetcher) stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+}
+
+//prefetchBlock 获取区块并补全交易单输入，提取时不再重复查询
+func (bs *HNSBlockScanner) prefetchBlock(height uint64) *prefetchedBlock {
+
+	hash, err := bs.wm.GetBlockHash(height)
+	if err != nil {
+		return &prefetchedBlock{err: err}
+	}
+
+	block, err := bs.wm.GetBlock(hash)
+	if err != nil {
+		return &prefetchedBlock{err: err}
+	}
+
+	if bs.hasHNSBlockObservers() {
+		//区块观测者需要全部交易单，失败时由扫描循环重试
+		bs.loadBlockTxs(block)
+	} else {
+		//补全失败的输入在提取时重新查询
+		for _, trx := range block.txDetails {
+			bs.fillTxInputs(trx)
+		}
+	}
+
+	return &prefetchedBlock{hash: hash, block: block}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+//newTestChainServer 模拟节点的getblockhash和getblock，区块hash为h+高度
+func newTestChainServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		params := gjson.GetBytes(body, "params")
+		switch gjson.GetBytes(body, "method").String() {
+		case "getblockhash":
+			fmt.Fprintf(w, `{"result":"h%d","error":null,"id":"1"}`, params.Get("0").Uint())
+		case "getblock":
+			var height uint64
+			fmt.Sscanf(params.Get("0").String(), "h%d", &height)
+			fmt.Fprintf(w, `{"result":{"hash":"h%d","height":%d,"previousblockhash":"h%d","tx":[]},"error":null,"id":"1"}`, height, height, height-1)
+		default:
+			fmt.Fprint(w, `{"result":null,"error":{"code":-32601,"message":"Method not found"},"id":"1"}`)
+		}
+	}))
+}
+
+func TestBlockPrefetcher(t *testing.T) {
+
+	server := newTestChainServer()
+	defer server.Close()
+
+	wm := NewWalletManager()
+	wm.NodeClient = NewClient(server.URL, "", false)
+	wm.Config.PrefetchWorkers = 3
+	wm.Config.PrefetchWindow = 5
+	bs := wm.Blockscanner
+
+	if !bs.shouldCatchUp(10, 10+defaultCatchUpThreshold) || bs.shouldCatchUp(10, 20) {
+		t.Error("unexpected catch up threshold")
+	}
+
+	p := bs.newBlockPrefetcher(101, 140)
+	defer p.stop()
+
+	//按高度顺序取出
+	for h := uint64(101); h <= 140; h++ {
+		hash, block := p.take(h)
+		if block == nil || block.Height != h || hash != fmt.Sprintf("h%d", h) {
+			t.Fatalf("unexpected block at height %d: %s", h, hash)
+		}
+	}
+
+	if _, block := p.take(141); block != nil {
+		t.Error("height out of prefetch range")
+	}
+
+	//停止后不再返回区块
+	p2 := bs.newBlockPrefetcher(1, 1000)
+	p2.stop()
+	for h := uint64(1); h <= 20; h++ {
+		if _, block := p2.take(h); block == nil {
+			return
+		}
+	}
+	t.Error("stopped prefetcher still returns blocks")
+}
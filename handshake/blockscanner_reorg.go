@@ -0,0 +1,282 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+/*
+	分叉处理：
+	扫描器保存最近N个区块头，发现新区块的prevhash与本地不一致时，
+	从本地最新区块往回逐个对比节点的区块hash，直到找到共同祖先区块，
+	被回滚的区块中已通知的提取数据，通知观测者撤销，然后从共同祖先区块继续扫描。
+*/
+
+const (
+	defaultHeaderWindowSize = 1000 //默认保存的区块头数量，即可处理的最大分叉深度
+)
+
+//HNSBlockRevertNotificationObject 区块回滚通知，观测者实现该接口可接收撤销的提取数据
+type HNSBlockRevertNotificationObject interface {
+
+	//BlockExtractDataRevertNotify 区块被回滚，之前通知的提取数据已失效
+	BlockExtractDataRevertNotify(sourceKey string, data *openwallet.TxExtractData) error
+}
+
+//LocalBlockHeader 本地保存的区块头
+type LocalBlockHeader struct {
+	Height   uint64 `storm:"id"`
+	Hash     string
+	PrevHash string
+	Time     uint64
+}
+
+//ExtractJournal 已通知的提取数据，用于区块回滚时撤销
+type ExtractJournal struct {
+	ID        string `storm:"id"` //height_hash_sourceKey_txid
+	Height    uint64 `storm:"index"`
+	BlockHash string
+	SourceKey string
+	Data      *openwallet.TxExtractData
+}
+
+//saveHeader 保存区块头到窗口，并删除窗口外的区块头
+func (bs *HNSBlockScanner) saveHeader(block *Block) error {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	header := &LocalBlockHeader{
+		Height:   block.Height,
+		Hash:     block.Hash,
+		PrevHash: block.Previousblockhash,
+		Time:     block.Time,
+	}
+	err = db.Save(header)
+	if err != nil {
+		return err
+	}
+
+	window := bs.wm.Config.HeaderWindowSize
+	if window == 0 {
+		window = defaultHeaderWindowSize
+	}
+	if block.Height > window {
+		query := db.Select(q.Lt("Height", block.Height-window))
+		query.Delete(&LocalBlockHeader{})
+		query = db.Select(q.Lt("Height", block.Height-window))
+		query.Delete(&ExtractJournal{})
+		//花费已不会被回滚的未花记录
+		query = db.Select(q.Gt("SpentHeight", uint64(0)), q.Lt("SpentHeight", block.Height-window))
+		query.Delete(&LocalUnspent{})
+	}
+
+	return nil
+}
+
+//getHeader 获取本地区块头，窗口内没有时从BlockchainDAI获取
+func (bs *HNSBlockScanner) getHeader(height uint64) (*LocalBlockHeader, error) {
+
+	db, err := bs.scannerDB()
+	if err == nil {
+		var header LocalBlockHeader
+		err = db.One("Height", height, &header)
+		if err == nil {
+			return &header, nil
+		}
+	}
+
+	block, err := bs.GetLocalBlock(height)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalBlockHeader{Height: block.Height, Hash: block.Hash}, nil
+}
+
+//deleteHeader 删除本地区块头
+func (bs *HNSBlockScanner) deleteHeader(height uint64) error {
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+	err = db.DeleteStruct(&LocalBlockHeader{Height: height})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+//saveExtractJournal 记录已通知的区块提取数据，未确认的交易单不记录
+func (bs *HNSBlockScanner) saveExtractJournal(height uint64, blockHash string, sourceKey string, data *openwallet.TxExtractData) error {
+
+	if height == 0 || len(blockHash) == 0 || data == nil || data.Transaction == nil {
+		return nil
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	journal := &ExtractJournal{
+		ID:        fmt.Sprintf("%d_%s_%s_%s", height, blockHash, sourceKey, data.Transaction.TxID),
+		Height:    height,
+		BlockHash: blockHash,
+		SourceKey: sourceKey,
+		Data:      data,
+	}
+	return db.Save(journal)
+}
+
+//getExtractJournals 获取区块已通知的提取数据
+func (bs *HNSBlockScanner) getExtractJournals(height uint64, blockHash string) ([]*ExtractJournal, error) {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var journals []*ExtractJournal
+	err = db.Select(q.Eq("Height", height), q.Eq("BlockHash", blockHash)).Find(&journals)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return journals, nil
+}
+
+//deleteExtractJournals 删除区块已通知的提取数据
+func (bs *HNSBlockScanner) deleteExtractJournals(height uint64) error {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	err = db.Select(q.Eq("Height", height)).Delete(&ExtractJournal{})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+//findCommonAncestor 从本地最新区块往回查找与节点一致的共同祖先区块
+//返回共同祖先区块和被回滚的区块(从高到低)
+func (bs *HNSBlockScanner) findCommonAncestor(localHeight uint64) (*LocalBlockHeader, []*LocalBlockHeader, error) {
+
+	orphaned := make([]*LocalBlockHeader, 0)
+
+	for height := localHeight; ; height-- {
+
+		local, err := bs.getHeader(height)
+		if err != nil {
+			//超出本地窗口，无法继续对比，以节点的区块作为祖先
+			bs.wm.Log.Std.Warning("block scanner can not find local block on height: %d, fork may be deeper than header window", height)
+			hash, err := bs.wm.GetBlockHash(height)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &LocalBlockHeader{Height: height, Hash: hash}, orphaned, nil
+		}
+
+		hash, err := bs.wm.GetBlockHash(height)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if hash == local.Hash {
+			return local, orphaned, nil
+		}
+
+		orphaned = append(orphaned, local)
+
+		if height == 0 {
+			return nil, nil, fmt.Errorf("block scanner can not find common ancestor")
+		}
+	}
+}
+
+//revertBlock 回滚区块：通知观测者撤销已提取的数据，删除本地记录
+func (bs *HNSBlockScanner) revertBlock(header *LocalBlockHeader) {
+
+	bs.wm.Log.Std.Info("block scanner revert block height: %d, hash: %s", header.Height, header.Hash)
+
+	journals, err := bs.getExtractJournals(header.Height, header.Hash)
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not get extract journals; unexpected error: %v", err)
+	}
+
+	for _, journal := range journals {
+		for o := range bs.Observers {
+			revertObserver, ok := o.(HNSBlockRevertNotificationObject)
+			if !ok {
+				continue
+			}
+			err := revertObserver.BlockExtractDataRevertNotify(journal.SourceKey, journal.Data)
+			if err != nil {
+				bs.wm.Log.Error("BlockExtractDataRevertNotify unexpected error:", err)
+			}
+		}
+	}
+
+	bs.deleteExtractJournals(header.Height)
+	bs.deleteConfirmRecords(header.Height)
+	bs.deleteAddressHistory(header.Height)
+	bs.revertUnspent(header.Height)
+	bs.deleteHeader(header.Height)
+
+	//删除区块的未扫记录
+	bs.DeleteUnscanRecord(header.Height)
+
+	//清除分叉区块的缓存
+	bs.wm.NodeClient.InvalidateBlockCache(header.Hash)
+
+	//通知分叉区块给观测者，异步处理
+	block := &Block{
+		Hash:              header.Hash,
+		Height:            header.Height,
+		Previousblockhash: header.PrevHash,
+		Time:              header.Time,
+	}
+	bs.newBlockNotify(block, true)
+	bs.newHNSBlockNotify(block, true)
+}
+
+//handleFork 处理分叉，回滚到共同祖先区块，返回新的扫描起点
+func (bs *HNSBlockScanner) handleFork(localHeight uint64) (*LocalBlockHeader, error) {
+
+	ancestor, orphaned, err := bs.findCommonAncestor(localHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	bs.wm.Log.Std.Info("block scanner find common ancestor height: %d, hash: %s, revert %d blocks", ancestor.Height, ancestor.Hash, len(orphaned))
+
+	for _, header := range orphaned {
+		bs.revertBlock(header)
+	}
+
+	//重新记录一个新扫描起点
+	bs.SaveLocalNewBlock(ancestor.Height, ancestor.Hash)
+
+	return ancestor, nil
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+/*
+	地址重扫：
+	导入旧地址后只需要补扫这些地址的历史记录，不需要回退扫描器的高度。
+	RescanAddresses在后台按高度扫描指定范围，与实时扫描同时进行，
+	只把指定地址的交易记录和名称事件通知观测者，sourceKey仍由ScanTargetFuncV2确定。
+	通过GetAddressRescan查询进度，失败或取消后可以从CurrentHeight+1继续。
+	重扫到已扫描的高度时才更新本地未花，部分范围的重扫无法知道范围后面的花费，不更新本地未花。
+	扫描器停止时重扫一起取消，并等待当前高度完成。
+*/
+
+//地址重扫的状态
+const (
+	AddressRescanRunning  = "running"
+	AddressRescanDone     = "done"
+	AddressRescanCanceled = "canceled"
+	AddressRescanFailed   = "failed"
+)
+
+//AddressRescanProgress 地址重扫的进度
+type AddressRescanProgress struct {
+	ID            string
+	Addresses     []string
+	StartHeight   uint64
+	EndHeight     uint64
+	CurrentHeight uint64 //已完成的高度，未开始时为StartHeight-1
+	Notified      int    //已通知的记录数
+	Status        string
+	Err           string //失败的原因
+	StartedAt     int64
+	FinishedAt    int64
+}
+
+//Percent 完成的百分比
+func (p *AddressRescanProgress) Percent() float64 {
+	total := p.EndHeight - p.StartHeight + 1
+	done := p.CurrentHeight + 1 - p.StartHeight
+	return float64(done) * 100 / float64(total)
+}
+
+//addressRescan 后台执行的地址重扫
+type addressRescan struct {
+	mu       sync.Mutex
+	progress AddressRescanProgress
+	watched  map[string]bool
+	cancel   context.CancelFunc
+	unspent  bool //是否更新本地未花
+}
+
+//snapshot 复制当前进度
+func (r *addressRescan) snapshot() *AddressRescanProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.progress
+	p.Addresses = append([]string(nil), r.progress.Addresses...)
+	return &p
+}
+
+//advance 完成一个高度
+func (r *addressRescan) advance(height uint64, notified int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress.CurrentHeight = height
+	r.progress.Notified += notified
+}
+
+//finish 结束重扫
+func (r *addressRescan) finish(status string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress.Status = status
+	if err != nil {
+		r.progress.Err = err.Error()
+	}
+	r.progress.FinishedAt = time.Now().Unix()
+}
+
+//RescanAddresses 后台重扫区块范围内指定地址的交易记录，返回重扫的ID
+//endHeight为0时扫描到当前已扫描的高度
+func (bs *HNSBlockScanner) RescanAddresses(startHeight, endHeight uint64, address ...string) (string, error) {
+
+	if len(address) == 0 {
+		return "", fmt.Errorf("no address to rescan")
+	}
+
+	if bs.ScanTargetFuncV2 == nil {
+		return "", fmt.Errorf("scan target func is not set")
+	}
+
+	if startHeight == 0 {
+		startHeight = 1
+	}
+
+	scannedHeight := bs.GetScannedBlockHeight()
+	if endHeight == 0 {
+		endHeight = scannedHeight
+	}
+
+	if endHeight < startHeight {
+		return "", fmt.Errorf("invalid rescan range: %d - %d", startHeight, endHeight)
+	}
+
+	watched := make(map[string]bool)
+	addresses := make([]string, 0, len(address))
+	for _, a := range address {
+		if !watched[a] {
+			watched[a] = true
+			addresses = append(addresses, a)
+		}
+	}
+
+	//停止过程中不开始新的重扫
+	if !bs.beginBackgroundTask() {
+		return "", fmt.Errorf("block scanner is stopping")
+	}
+
+	ctx, cancel := context.WithCancel(bs.extractContext())
+
+	bs.addressRescansMu.Lock()
+	bs.addressRescanSeq++
+	id := fmt.Sprintf("rescan-%d", bs.addressRescanSeq)
+	r := &addressRescan{
+		progress: AddressRescanProgress{
+			ID:            id,
+			Addresses:     addresses,
+			StartHeight:   startHeight,
+			EndHeight:     endHeight,
+			CurrentHeight: startHeight - 1,
+			Status:        AddressRescanRunning,
+			StartedAt:     time.Now().Unix(),
+		},
+		watched: watched,
+		cancel:  cancel,
+		//之后的区块由实时扫描记录花费
+		unspent: endHeight >= scannedHeight,
+	}
+	bs.addressRescans[id] = r
+	bs.addressRescansMu.Unlock()
+
+	bs.wm.Log.Std.Info("block scanner address rescan %s started, height: %d - %d, addresses: %d", id, startHeight, endHeight, len(addresses))
+	if !r.unspent && bs.localUnspentEnabled() {
+		bs.wm.Log.Std.Info("block scanner address rescan %s ends below scanned height %d, local unspents are not updated", id, scannedHeight)
+	}
+
+	go func() {
+		defer bs.endTask()
+		bs.runAddressRescan(ctx, r)
+	}()
+
+	return id, nil
+}
+
+//GetAddressRescan 查询地址重扫的进度
+func (bs *HNSBlockScanner) GetAddressRescan(id string) (*AddressRescanProgress, error) {
+	bs.addressRescansMu.Lock()
+	r, ok := bs.addressRescans[id]
+	bs.addressRescansMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("address rescan %s not found", id)
+	}
+	return r.snapshot(), nil
+}
+
+//GetAddressRescans 查询全部地址重扫的进度
+func (bs *HNSBlockScanner) GetAddressRescans() []*AddressRescanProgress {
+	bs.addressRescansMu.Lock()
+	defer bs.addressRescansMu.Unlock()
+	list := make([]*AddressRescanProgress, 0, len(bs.addressRescans))
+	for _, r := range bs.addressRescans {
+		list = append(list, r.snapshot())
+	}
+	return list
+}
+
+//CancelAddressRescan 取消地址重扫
+func (bs *HNSBlockScanner) CancelAddressRescan(id string) error {
+	bs.addressRescansMu.Lock()
+	r, ok := bs.addressRescans[id]
+	bs.addressRescansMu.Unlock()
+	if !ok {
+		return fmt.Errorf("address rescan %s not found", id)
+	}
+	r.cancel()
+	return nil
+}
+
+//runAddressRescan 按高度扫描，直到完成、失败或取消
+func (bs *HNSBlockScanner) runAddressRescan(ctx context.Context, r *addressRescan) {
+
+	defer r.cancel()
+
+	progress := r.snapshot()
+
+	//只匹配需要重扫的地址
+	scanTargetFunc := func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		if target.ScanTargetType != openwallet.ScanTargetTypeAccountAddress || !r.watched[target.ScanTarget] {
+			return openwallet.ScanTargetResult{}
+		}
+		return bs.ScanTargetFuncV2(target)
+	}
+
+	for height := progress.StartHeight; height <= progress.EndHeight; height++ {
+
+		if ctx.Err() != nil {
+			r.finish(AddressRescanCanceled, nil)
+			bs.wm.Log.Std.Info("block scanner address rescan %s canceled at height: %d", progress.ID, height-1)
+			return
+		}
+
+		notified, err := bs.rescanAddressBlock(height, r.watched, r.unspent, scanTargetFunc)
+		if err != nil {
+			r.finish(AddressRescanFailed, fmt.Errorf("height %d: %v", height, err))
+			bs.wm.Log.Std.Error("block scanner address rescan %s failed at height: %d, unexpected error: %v", progress.ID, height, err)
+			return
+		}
+		r.advance(height, notified)
+
+		if height%100 == 0 {
+			p := r.snapshot()
+			bs.wm.Log.Std.Info("block scanner address rescan %s height: %d, %.2f%%, notified: %d", p.ID, height, p.Percent(), p.Notified)
+		}
+	}
+
+	r.finish(AddressRescanDone, nil)
+	p := r.snapshot()
+	bs.wm.Log.Std.Info("block scanner address rescan %s completed, notified: %d", p.ID, p.Notified)
+}
+
+//walkAddressBlock 获取区块的全部交易单，按指定的扫描目标逐笔提取，提取结果交给handle处理
+//地址重扫和地址交易记录补扫共用
+func (bs *HNSBlockScanner) walkAddressBlock(height uint64, scanTargetFunc openwallet.BlockScanTargetFuncV2, handle func(block *Block, result *ExtractResult) error) error {
+
+	hash, err := bs.wm.GetBlockHash(height)
+	if err != nil {
+		return err
+	}
+
+	block, err := bs.wm.GetBlock(hash)
+	if err != nil {
+		return err
+	}
+
+	if err := bs.loadBlockTxs(block); err != nil {
+		return err
+	}
+
+	for _, trx := range block.txDetails {
+
+		if trx.BlockHeight == 0 {
+			trx.BlockHeight = block.Height
+			trx.BlockHash = block.Hash
+		}
+		trx.Decimals = bs.wm.Decimal()
+
+		result := ExtractResult{
+			BlockHeight: block.Height,
+			TxID:        trx.TxID,
+			extractData: make(map[string]*openwallet.TxExtractData),
+		}
+
+		bs.extractTransaction(trx, &result, scanTargetFunc)
+		if !result.Success {
+			return fmt.Errorf("extract transaction %s failed: %v", trx.TxID, result.err)
+		}
+
+		if err := handle(block, &result); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//rescanAddressBlock 提取区块内指定地址的记录并通知观测者，返回通知的记录数
+//updateUnspent为false时不更新本地未花
+func (bs *HNSBlockScanner) rescanAddressBlock(height uint64, watched map[string]bool, updateUnspent bool, scanTargetFunc openwallet.BlockScanTargetFuncV2) (int, error) {
+
+	observers := bs.observers()
+	notified := 0
+
+	err := bs.walkAddressBlock(height, scanTargetFunc, func(block *Block, result *ExtractResult) error {
+
+		if updateUnspent {
+			if err := bs.saveUnspentChanges(block.Height, block.Hash, result); err != nil {
+				bs.wm.Log.Std.Info("saveUnspentChanges unexpected error: %v", err)
+			}
+		}
+
+		for key, data := range result.extractData {
+			if _, err := bs.saveAddressHistory(block.Height, data); err != nil {
+				bs.wm.Log.Std.Error("block height: %d, save address history failed. unexpected error: %v", block.Height, err)
+			}
+			for _, o := range observers {
+				if err := o.BlockExtractDataNotify(key, data); err != nil {
+					return err
+				}
+			}
+			notified++
+		}
+
+		//关注名称的事件不属于重扫的地址，只通知地址相关的名称事件
+		for key, receipts := range result.contractData {
+			for _, receipt := range receipts {
+				if !watched[receipt.To] {
+					continue
+				}
+				for _, o := range observers {
+					if err := o.BlockExtractSmartContractDataNotify(key, receipt); err != nil {
+						return err
+					}
+				}
+				notified++
+			}
+		}
+
+		return nil
+	})
+
+	return notified, err
+}
+
+//observers 当前的观测者
+func (bs *HNSBlockScanner) observers() []openwallet.BlockScanNotificationObject {
+	bs.Mu.RLock()
+	defer bs.Mu.RUnlock()
+	observers := make([]openwallet.BlockScanNotificationObject, 0, len(bs.Observers))
+	for o := range bs.Observers {
+		observers = append(observers, o)
+	}
+	return observers
+}
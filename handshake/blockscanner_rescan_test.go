@@ -0,0 +1,221 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+type testExtractObserver struct {
+	mu   sync.Mutex
+	data map[string][]*openwallet.TxExtractData
+}
+
+func (o *testExtractObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	return nil
+}
+
+func (o *testExtractObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.data[sourceKey] = append(o.data[sourceKey], data)
+	return nil
+}
+
+func (o *testExtractObserver) BlockExtractSmartContractDataNotify(sourceKey string, data *openwallet.SmartContractReceipt) error {
+	return nil
+}
+
+//newTestAddressChainServer 模拟节点，每个区块只有一笔coinbase交易单c+高度，支付到同一个地址
+func newTestAddressChainServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		params := gjson.GetBytes(body, "params")
+		switch gjson.GetBytes(body, "method").String() {
+		case "getblockhash":
+			fmt.Fprintf(w, `{"result":"h%d","error":null,"id":"1"}`, params.Get("0").Uint())
+		case "getblock":
+			var height uint64
+			fmt.Sscanf(params.Get("0").String(), "h%d", &height)
+			fmt.Fprintf(w, `{"result":{"hash":"h%d","height":%d,"previousblockhash":"h%d","tx":["c%d"]},"error":null,"id":"1"}`, height, height, height-1, height)
+		default:
+			fmt.Fprintf(w, `{"result":{"txid":"%s","vin":[{"coinbase":true}],"vout":[{"value":2000,"n":0,"address":{"version":0,"hash":"b302960fb163255e3abf855babd47da1d819bb85"},"covenant":{"type":0,"action":"NONE"}}]},"error":null,"id":"1"}`, params.Get("0").String())
+		}
+	}))
+}
+
+//waitAddressRescan 等待地址重扫结束
+func waitAddressRescan(t *testing.T, bs *HNSBlockScanner, id string) *AddressRescanProgress {
+	for i := 0; i < 500; i++ {
+		p, err := bs.GetAddressRescan(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Status != AddressRescanRunning {
+			return p
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("address rescan not finished")
+	return nil
+}
+
+func TestRescanAddresses(t *testing.T) {
+
+	server := newTestAddressChainServer()
+	defer server.Close()
+
+	wm, cleanup := newTestScannerWallet(t, server.URL)
+	defer cleanup()
+	bs := wm.Blockscanner
+
+	//实时扫描关注全部地址，重扫只通知指定的地址
+	bs.SetBlockScanTargetFuncV2(func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		return openwallet.ScanTargetResult{SourceKey: "account", Exist: true}
+	})
+	o := &testExtractObserver{data: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(o)
+
+	trx, err := wm.GetTransaction("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := trx.Vouts[0].Addr
+
+	if _, err := bs.RescanAddresses(10, 5, address); err == nil {
+		t.Error("invalid range accepted")
+	}
+
+	id, err := bs.RescanAddresses(1, 20, address)
+	if err != nil {
+		t.Fatalf("RescanAddresses failed: %v", err)
+	}
+	p := waitAddressRescan(t, bs, id)
+	if p.Status != AddressRescanDone || p.CurrentHeight != 20 || p.Notified != 20 || p.Percent() != 100 {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+	if len(o.data["account"]) != 20 {
+		t.Fatalf("notified %d records, want 20", len(o.data["account"]))
+	}
+
+	//其他地址不通知
+	id, _ = bs.RescanAddresses(1, 5, "hs1qother")
+	p = waitAddressRescan(t, bs, id)
+	if p.Status != AddressRescanDone || p.Notified != 0 || len(o.data["account"]) != 20 {
+		t.Fatalf("unrelated address notified: %+v", p)
+	}
+
+	//取消
+	id, _ = bs.RescanAddresses(1, 100000, address)
+	bs.CancelAddressRescan(id)
+	p = waitAddressRescan(t, bs, id)
+	if p.Status != AddressRescanCanceled || p.CurrentHeight >= p.EndHeight {
+		t.Fatalf("unexpected canceled progress: %+v", p)
+	}
+
+	if len(bs.GetAddressRescans()) != 3 {
+		t.Error("address rescans not listed")
+	}
+}
+
+func TestRescanAddresses_LocalUnspent(t *testing.T) {
+
+	server := newTestAddressChainServer()
+	defer server.Close()
+
+	wm, cleanup := newTestScannerWallet(t, server.URL)
+	defer cleanup()
+	wm.Config.EnableLocalUnspent = true
+	bs := wm.Blockscanner
+
+	bs.SetBlockScanTargetFuncV2(func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		return openwallet.ScanTargetResult{SourceKey: "account", Exist: true}
+	})
+	bs.SetBlockchainDAI(newTestBlockchainDAI())
+	bs.SaveLocalNewBlock(20, "h20")
+
+	trx, err := wm.GetTransaction("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := trx.Vouts[0].Addr
+
+	//范围后面的花费未知，不更新本地未花
+	id, _ := bs.RescanAddresses(1, 10, address)
+	if p := waitAddressRescan(t, bs, id); p.Status != AddressRescanDone {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+	if list, _ := bs.ListLocalUnspent(false, address); len(list) != 0 {
+		t.Fatalf("partial rescan saved %d unspents", len(list))
+	}
+
+	//重扫到已扫描的高度
+	id, _ = bs.RescanAddresses(1, 0, address)
+	if p := waitAddressRescan(t, bs, id); p.Status != AddressRescanDone || p.EndHeight != 20 {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+	if list, _ := bs.ListLocalUnspent(false, address); len(list) != 20 {
+		t.Fatalf("rescan saved %d unspents, want 20", len(list))
+	}
+}
+
+func TestRescanAddresses_AfterStop(t *testing.T) {
+
+	server := newTestAddressChainServer()
+	defer server.Close()
+
+	wm, cleanup := newTestScannerWallet(t, server.URL)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.PeriodOfTask = time.Hour
+
+	bs.SetBlockScanTargetFuncV2(func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		return openwallet.ScanTargetResult{SourceKey: "account", Exist: true}
+	})
+	o := &testExtractObserver{data: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(o)
+
+	trx, err := wm.GetTransaction("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := trx.Vouts[0].Addr
+
+	if err := bs.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	//停止后重扫不使用已取消的上下文
+	id, err := bs.RescanAddresses(1, 5, address)
+	if err != nil {
+		t.Fatalf("RescanAddresses after Stop: %v", err)
+	}
+	if p := waitAddressRescan(t, bs, id); p.Status != AddressRescanDone || p.Notified != 5 {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+}
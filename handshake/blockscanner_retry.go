@@ -0,0 +1,421 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+/*
+	重扫队列：
+	提取失败的区块或交易单保存到扫描器数据库的重扫队列，记录重试次数、下次重试时间和错误分类。
+	每次重试失败后按指数退避推迟下次重试，超过retryMaxAttempts次或错误不可恢复（交易单不存在）时移入死信队列，
+	死信队列不再自动重试，运维人员可以查看，处理后重放或删除。
+	交易单为空的记录重扫整个区块。
+*/
+
+const (
+	defaultRetryBaseInterval = 30 * time.Second //第一次重试的间隔
+	defaultRetryMaxInterval  = time.Hour        //重试间隔的上限
+	defaultRetryMaxAttempts  = 10               //超过后移入死信队列
+)
+
+//重扫失败的错误分类
+const (
+	RetryErrorNetwork  = "network"  //网络请求失败，可以重试
+	RetryErrorNode     = "node"     //节点返回的错误，可以重试
+	RetryErrorNotify   = "notify"   //通知观测者失败，可以重试
+	RetryErrorNotFound = "notfound" //交易单不存在，不可恢复
+)
+
+//RetryItem 重扫队列的记录
+type RetryItem struct {
+	ID          string `storm:"id"` //高度_交易单
+	Height      uint64 `storm:"index"`
+	TxID        string //为空时重扫整个区块
+	Reason      string //最后一次失败的原因
+	ErrorClass  string //最后一次失败的错误分类
+	Attempts    int    //已失败的次数
+	NextAttempt int64  `storm:"index"` //下次重试的时间，unix秒
+	CreatedAt   int64
+	UpdatedAt   int64
+	Dead        bool `storm:"index"` //已移入死信队列
+}
+
+//retryItemID 重扫记录的主键
+func retryItemID(height uint64, txid string) string {
+	return fmt.Sprintf("%d_%s", height, txid)
+}
+
+//classifyRetryReason 按失败原因分类，permanent为true时不再重试
+func classifyRetryReason(reason string) (class string, permanent bool) {
+	if rpcErr, ok := ParseRPCError(reason); ok {
+		if rpcErr.IsTxNotFound() {
+			return RetryErrorNotFound, true
+		}
+		return RetryErrorNode, false
+	}
+	if strings.Contains(reason, "Notify failed") {
+		return RetryErrorNotify, false
+	}
+	return RetryErrorNetwork, false
+}
+
+//retryBackoff 第attempts次失败后的重试间隔，按指数增长，不超过max
+func retryBackoff(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+//retryPolicy 重试间隔和次数
+func (bs *HNSBlockScanner) retryPolicy() (base, max time.Duration, maxAttempts int) {
+	base, max, maxAttempts = bs.wm.Config.RetryBaseInterval, bs.wm.Config.RetryMaxInterval, bs.wm.Config.RetryMaxAttempts
+	if base <= 0 {
+		base = defaultRetryBaseInterval
+	}
+	if max < base {
+		max = base
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	return
+}
+
+//fail 记录一次失败，计算下次重试时间或移入死信队列
+func (item *RetryItem) fail(reason string, now time.Time, base, max time.Duration, maxAttempts int) {
+	class, permanent := classifyRetryReason(reason)
+	item.Reason = reason
+	item.ErrorClass = class
+	item.Attempts++
+	item.UpdatedAt = now.Unix()
+	if item.CreatedAt == 0 {
+		item.CreatedAt = item.UpdatedAt
+	}
+	if permanent || item.Attempts >= maxAttempts {
+		item.Dead = true
+		item.NextAttempt = 0
+		return
+	}
+	item.NextAttempt = now.Add(retryBackoff(item.Attempts, base, max)).Unix()
+}
+
+//recordRetryFailure 记录区块或交易单的提取失败，已在队列中时累计失败次数
+func (bs *HNSBlockScanner) recordRetryFailure(height uint64, txid, reason string) error {
+
+	//未确认的交易单在确认后随区块扫描，不需要重扫
+	if height == 0 {
+		return nil
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	id := retryItemID(height, txid)
+	item := &RetryItem{}
+	err = db.One("ID", id, item)
+	if err != nil {
+		if err != storm.ErrNotFound {
+			return err
+		}
+		item = &RetryItem{ID: id, Height: height, TxID: txid}
+	}
+
+	base, max, maxAttempts := bs.retryPolicy()
+	item.fail(reason, time.Now(), base, max, maxAttempts)
+	if item.Dead {
+		bs.wm.Log.Std.Warning("block height: %d tx: %s moved to dead letter after %d attempts: %s", height, txid, item.Attempts, reason)
+	}
+
+	return db.Save(item)
+}
+
+//dueRetryItems 到期需要重试的记录
+func (bs *HNSBlockScanner) dueRetryItems(now time.Time) ([]*RetryItem, error) {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*RetryItem
+	err = db.Select(q.Eq("Dead", false), q.Lte("NextAttempt", now.Unix())).OrderBy("Height").Find(&items)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return items, nil
+}
+
+//deleteRetryItems 删除重扫记录
+func (bs *HNSBlockScanner) deleteRetryItems(items ...*RetryItem) error {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		err = db.DeleteStruct(item)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+//deleteRetryItemsByHeight 删除指定高度的重扫记录，包括死信，用于区块回滚
+func (bs *HNSBlockScanner) deleteRetryItemsByHeight(height uint64) error {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	err = db.Select(q.Eq("Height", height)).Delete(&RetryItem{})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//listRetryItems 查询重扫队列或死信队列
+func (bs *HNSBlockScanner) listRetryItems(dead bool) ([]*RetryItem, error) {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*RetryItem, 0)
+	err = db.Select(q.Eq("Dead", dead)).OrderBy("Height").Find(&items)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return items, nil
+}
+
+//GetRetryQueue 查询等待重试的记录
+func (bs *HNSBlockScanner) GetRetryQueue() ([]*RetryItem, error) {
+	return bs.listRetryItems(false)
+}
+
+//GetDeadLetters 查询死信队列
+func (bs *HNSBlockScanner) GetDeadLetters() ([]*RetryItem, error) {
+	return bs.listRetryItems(true)
+}
+
+//ReplayDeadLetters 把死信放回重扫队列，重置失败次数并立即重试，ids为空时重放全部
+func (bs *HNSBlockScanner) ReplayDeadLetters(ids ...string) error {
+
+	items, err := bs.deadLettersByID(ids...)
+	if err != nil {
+		return err
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, item := range items {
+		item.Dead = false
+		item.Attempts = 0
+		item.NextAttempt = now
+		item.UpdatedAt = now
+		if err := db.Save(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//DeleteDeadLetters 删除死信，ids为空时删除全部
+func (bs *HNSBlockScanner) DeleteDeadLetters(ids ...string) error {
+
+	items, err := bs.deadLettersByID(ids...)
+	if err != nil {
+		return err
+	}
+	return bs.deleteRetryItems(items...)
+}
+
+//deadLettersByID 按主键查询死信，ids为空时返回全部
+func (bs *HNSBlockScanner) deadLettersByID(ids ...string) ([]*RetryItem, error) {
+
+	if len(ids) == 0 {
+		return bs.GetDeadLetters()
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*RetryItem, 0)
+	err = db.Select(q.Eq("Dead", true), q.In("ID", ids)).Find(&items)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return items, nil
+}
+
+//migrateUnscanRecords 把旧版本保存在BlockchainDAI的未扫记录转入重扫队列
+func (bs *HNSBlockScanner) migrateUnscanRecords() {
+
+	if bs.BlockchainDAI == nil {
+		return
+	}
+
+	list, err := bs.GetUnscanRecords()
+	if err != nil || len(list) == 0 {
+		return
+	}
+
+	for _, r := range list {
+		if err := bs.recordRetryFailure(r.BlockHeight, r.TxID, r.Reason); err != nil {
+			bs.wm.Log.Std.Info("block scanner can not migrate unscan record; unexpected error: %v", err)
+			continue
+		}
+		bs.BlockchainDAI.DeleteUnscanRecordByID(r.ID, bs.wm.Symbol())
+	}
+}
+
+//RescanFailedRecord 重试到期的失败记录
+func (bs *HNSBlockScanner) RescanFailedRecord() {
+
+	bs.migrateUnscanRecords()
+
+	items, err := bs.dueRetryItems(time.Now())
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not get rescan data; unexpected error: %v", err)
+		return
+	}
+
+	//按高度组合成批处理
+	heights := make([]uint64, 0)
+	groups := make(map[uint64][]*RetryItem)
+	for _, item := range items {
+		if _, exist := groups[item.Height]; !exist {
+			heights = append(heights, item.Height)
+		}
+		groups[item.Height] = append(groups[item.Height], item)
+	}
+
+	for _, height := range heights {
+		if !bs.rescanHeight(height, groups[height]) {
+			//扫描器已停止
+			return
+		}
+	}
+}
+
+//rescanHeight 重扫一个高度的失败记录，扫描器停止时返回false
+func (bs *HNSBlockScanner) rescanHeight(height uint64, items []*RetryItem) bool {
+
+	bs.wm.Log.Std.Info("block scanner rescanning height: %d ...", height)
+
+	var blockItem *RetryItem
+	txids := make([]string, 0, len(items))
+	for _, item := range items {
+		if len(item.TxID) == 0 {
+			blockItem = item
+		} else {
+			txids = append(txids, item.TxID)
+		}
+	}
+
+	hash, err := bs.wm.GetBlockHash(height)
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not get new block hash; unexpected error: %v", err)
+		for _, item := range items {
+			bs.recordRetryFailure(height, item.TxID, err.Error())
+		}
+		return true
+	}
+
+	//重扫整个区块，同一高度的交易单记录一并完成
+	if blockItem != nil {
+
+		block, err := bs.wm.GetBlock(hash)
+		if err == nil {
+			err = bs.extractBlock(block)
+		}
+		if isExtractCanceled(err) {
+			return false
+		}
+		if err != nil {
+			bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+			bs.recordRetryFailure(height, "", err.Error())
+			return true
+		}
+
+		bs.deleteRetryItems(items...)
+		return true
+	}
+
+	//失败的交易单已在提取时重新记录，删除成功的记录
+	err = bs.BatchExtractTransaction(height, hash, txids)
+	if isExtractCanceled(err) {
+		return false
+	}
+
+	failed := make(map[string]bool)
+	if extractErr, ok := err.(*ExtractErrors); ok {
+		for _, txErr := range extractErr.Errors {
+			failed[txErr.TxID] = true
+		}
+	}
+
+	done := make([]*RetryItem, 0, len(items))
+	for _, item := range items {
+		if !failed[item.TxID] {
+			done = append(done, item)
+		}
+	}
+	bs.deleteRetryItems(done...)
+
+	return true
+}
+
+//SaveUnscanRecord 记录提取失败的区块或交易单到重扫队列
+func (bs *HNSBlockScanner) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
+	return bs.recordRetryFailure(record.BlockHeight, record.TxID, record.Reason)
+}
+
+//DeleteUnscanRecord 删除指定高度的重扫记录
+func (bs *HNSBlockScanner) DeleteUnscanRecord(height uint64) error {
+
+	if bs.BlockchainDAI != nil {
+		bs.BlockchainDAI.DeleteUnscanRecordByHeight(height, bs.wm.Symbol())
+	}
+
+	return bs.deleteRetryItemsByHeight(height)
+}
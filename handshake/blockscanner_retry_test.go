@@ -0,0 +1,185 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, 60 * time.Second},
+		{4, 240 * time.Second},
+		{20, time.Hour},
+	}
+	for _, test := range tests {
+		if got := retryBackoff(test.attempts, 30*time.Second, time.Hour); got != test.want {
+			t.Errorf("attempts %d: backoff = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestClassifyRetryReason(t *testing.T) {
+	tests := []struct {
+		reason    string
+		class     string
+		permanent bool
+	}{
+		{"[-5]No information available about transaction", RetryErrorNotFound, true},
+		{"[-8]Block height out of range", RetryErrorNode, false},
+		{"ExtractData Notify failed.", RetryErrorNotify, false},
+		{"connection refused", RetryErrorNetwork, false},
+	}
+	for _, test := range tests {
+		class, permanent := classifyRetryReason(test.reason)
+		if class != test.class || permanent != test.permanent {
+			t.Errorf("%s: class = %s, permanent = %v", test.reason, class, permanent)
+		}
+	}
+}
+
+func TestRetryQueueDeadLetter(t *testing.T) {
+
+	wm, cleanup := newTestScannerWallet(t, "")
+	defer cleanup()
+	wm.Config.RetryMaxAttempts = 2
+	bs := wm.Blockscanner
+
+	//未确认的交易单不记录
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(0, "mempool", "connection refused", wm.Symbol()))
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(10, "t1", "connection refused", wm.Symbol()))
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(10, "t2", "[-5]No information available about transaction", wm.Symbol()))
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(11, "", "ExtractData Notify failed.", wm.Symbol()))
+
+	queue, _ := bs.GetRetryQueue()
+	if len(queue) != 2 {
+		t.Fatalf("retry queue size = %d, want 2", len(queue))
+	}
+	dead, _ := bs.GetDeadLetters()
+	if len(dead) != 1 || dead[0].TxID != "t2" || dead[0].ErrorClass != RetryErrorNotFound {
+		t.Fatalf("unexpected dead letters: %+v", dead)
+	}
+
+	//退避期间不重试
+	due, _ := bs.dueRetryItems(time.Now())
+	if len(due) != 0 {
+		t.Fatalf("items retried before backoff: %d", len(due))
+	}
+	due, _ = bs.dueRetryItems(time.Now().Add(time.Minute))
+	if len(due) != 2 {
+		t.Fatalf("due items = %d, want 2", len(due))
+	}
+
+	//超过重试次数移入死信队列
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(10, "t1", "connection refused", wm.Symbol()))
+	dead, _ = bs.GetDeadLetters()
+	if len(dead) != 2 {
+		t.Fatalf("dead letters = %d, want 2", len(dead))
+	}
+
+	//重放后立即重试
+	if err := bs.ReplayDeadLetters(retryItemID(10, "t1")); err != nil {
+		t.Fatalf("ReplayDeadLetters failed: %v", err)
+	}
+	due, _ = bs.dueRetryItems(time.Now())
+	if len(due) != 1 || due[0].TxID != "t1" || due[0].Attempts != 0 {
+		t.Fatalf("unexpected replayed items: %+v", due)
+	}
+
+	if err := bs.DeleteDeadLetters(); err != nil {
+		t.Fatalf("DeleteDeadLetters failed: %v", err)
+	}
+	dead, _ = bs.GetDeadLetters()
+	if len(dead) != 0 {
+		t.Fatalf("dead letters not deleted: %d", len(dead))
+	}
+
+	//区块回滚删除该高度的记录
+	bs.DeleteUnscanRecord(10)
+	queue, _ = bs.GetRetryQueue()
+	if len(queue) != 1 || queue[0].Height != 11 {
+		t.Fatalf("unexpected retry queue after rollback: %+v", queue)
+	}
+}
+
+func TestRescanFailedRecord_Block(t *testing.T) {
+
+	//高度12的区块无法获取
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		params := gjson.GetBytes(body, "params")
+		switch gjson.GetBytes(body, "method").String() {
+		case "getblockhash":
+			fmt.Fprintf(w, `{"result":"h%d","error":null,"id":"1"}`, params.Get("0").Uint())
+		case "getblock":
+			var height uint64
+			fmt.Sscanf(params.Get("0").String(), "h%d", &height)
+			if height == 12 {
+				fmt.Fprint(w, `{"result":null,"error":{"code":-1,"message":"Block not available"},"id":"1"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"result":{"hash":"h%d","height":%d,"previousblockhash":"h%d","tx":["c%d"]},"error":null,"id":"1"}`, height, height, height-1, height)
+		default:
+			fmt.Fprintf(w, `{"result":{"txid":"%s","vin":[{"coinbase":true}],"vout":[{"value":2000,"n":0,"address":{"version":0,"hash":"b302960fb163255e3abf855babd47da1d819bb85"},"covenant":{"type":0,"action":"NONE"}}]},"error":null,"id":"1"}`, params.Get("0").String())
+		}
+	}))
+	defer server.Close()
+
+	bs := newTestWorkerScanner(t, server.URL)
+	cleanup := useTestScannerDB(t, bs)
+	defer cleanup()
+
+	//整块重试的记录txid为空，同一高度的交易单记录一并完成
+	bs.recordRetryFailure(11, "", "ExtractData Notify failed.")
+	bs.recordRetryFailure(11, "c11", "connection refused")
+	bs.recordRetryFailure(12, "", "connection refused")
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, _ := bs.GetRetryQueue()
+	for _, item := range queue {
+		item.NextAttempt = 0
+		db.Save(item)
+	}
+
+	bs.RescanFailedRecord()
+
+	queue, err = bs.GetRetryQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 {
+		t.Fatalf("retry queue = %+v, want only height 12", queue)
+	}
+	item := queue[0]
+	if item.Height != 12 || len(item.TxID) != 0 || item.Attempts != 2 || item.NextAttempt <= time.Now().Unix() {
+		t.Fatalf("failed block item not rescheduled: %+v", item)
+	}
+}
@@ -0,0 +1,379 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/handshake-adapter/handshakeTransaction"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/shopspring/decimal"
+	"github.com/tidwall/gjson"
+)
+
+/*
+	本地未花集合：
+	扫描器提取到关注地址的输出时加入未花集合，关注地址的输入标记为已花费，
+	未确认的交易单高度为0，已确认的记录不会被内存池的提取改回未确认。
+	内存池扫描时清除已离开内存池且节点上查不到的记录，已上链的等待扫描区块时更新，区块回滚时撤销。
+	已花费的记录在花费高度超出区块头窗口后删除。
+	开启enableLocalUnspent后，ListUnspent直接读取本地未花，不再逐个地址查询节点。
+	已有余额的地址可以用RebuildLocalUnspent从节点重建未花。
+*/
+
+//LocalUnspent 本地未花记录
+type LocalUnspent struct {
+	Key         string `storm:"id"` //txid_vout
+	TxID        string
+	Vout        uint64
+	Address     string `storm:"index"`
+	Amount      string
+	Height      uint64 `storm:"index"` //所在区块高度，0为未确认
+	BlockHash   string
+	Coinbase    bool
+	Type        uint64 //契约类型
+	Action      string //契约动作
+	SpentTxID   string `storm:"index"` //花费的交易单，空为未花费
+	SpentHeight uint64 `storm:"index"` //花费的区块高度，0为未确认
+}
+
+//unspentKey 未花记录的主键
+func unspentKey(txid string, vout uint64) string {
+	return fmt.Sprintf("%s_%d", txid, vout)
+}
+
+//IsSpent 是否已花费
+func (u *LocalUnspent) IsSpent() bool {
+	return len(u.SpentTxID) > 0
+}
+
+//Unspent 转换为未花记录
+func (u *LocalUnspent) Unspent() *Unspent {
+	hash, _ := handshakeTransaction.AddressDecode(u.Address)
+	return &Unspent{
+		Key:          u.Key,
+		TxID:         u.TxID,
+		Vout:         u.Vout,
+		Address:      u.Address,
+		AccountID:    u.Address,
+		ScriptPubKey: hex.EncodeToString(hash),
+		Amount:       u.Amount,
+		Height:       u.Height,
+		Coinbase:     u.Coinbase,
+		Type:         u.Type,
+		Action:       u.Action,
+		Spendable:    true,
+	}
+}
+
+//newLocalUnspentByCoin 解析节点/coin/address返回的未花，decimals为币种精度
+func newLocalUnspentByCoin(json *gjson.Result, decimals int32) *LocalUnspent {
+
+	u := &LocalUnspent{}
+	u.TxID = json.Get("hash").String()
+	u.Vout = json.Get("index").Uint()
+	u.Key = unspentKey(u.TxID, u.Vout)
+	u.Address = json.Get("address").String()
+
+	amount, _ := decimal.NewFromString(json.Get("value").String())
+	u.Amount = amount.Shift(-decimals).String()
+
+	//内存池的未花高度为-1
+	if height := json.Get("height").Int(); height > 0 {
+		u.Height = uint64(height)
+	}
+	u.Coinbase = json.Get("coinbase").Bool()
+	u.Type = json.Get("covenant.type").Uint()
+	u.Action = json.Get("covenant.action").String()
+	return u
+}
+
+//localUnspentEnabled 是否维护本地未花集合
+func (bs *HNSBlockScanner) localUnspentEnabled() bool {
+	return bs.wm.Config.EnableLocalUnspent
+}
+
+//extractUnspent 提取交易单中关注地址的新增未花和花费
+func (bs *HNSBlockScanner) extractUnspent(trx *Transaction, result *ExtractResult, scanAddressFunc openwallet.BlockScanTargetFuncV2) {
+
+	if !bs.localUnspentEnabled() {
+		return
+	}
+
+	isWatched := func(addr string) bool {
+		if len(addr) == 0 {
+			return false
+		}
+		return scanAddressFunc(openwallet.ScanTargetParam{
+			ScanTarget:     addr,
+			Symbol:         bs.wm.Symbol(),
+			ScanTargetType: openwallet.ScanTargetTypeAccountAddress,
+		}).Exist
+	}
+
+	for _, input := range trx.Vins {
+		if input.IsCoinbase() || !isWatched(input.Addr) {
+			continue
+		}
+		result.spends = append(result.spends, &LocalUnspent{
+			Key:     unspentKey(input.TxID, input.Vout),
+			TxID:    input.TxID,
+			Vout:    input.Vout,
+			Address: input.Addr,
+			Amount:  input.Value,
+		})
+	}
+
+	for _, output := range trx.Vouts {
+		if !isWatched(output.Addr) {
+			continue
+		}
+		covenantType := output.CovenantType()
+		result.unspents = append(result.unspents, &LocalUnspent{
+			Key:      unspentKey(trx.TxID, output.N),
+			TxID:     trx.TxID,
+			Vout:     output.N,
+			Address:  output.Addr,
+			Amount:   output.Value,
+			Coinbase: trx.IsCoinBase,
+			Type:     covenantType,
+			Action:   output.Action,
+		})
+	}
+}
+
+//saveUnspentChanges 保存交易单的新增未花和花费
+//同一区块的交易单并发提取，花费可能先于输出保存，所以两边都保留对方的字段
+func (bs *HNSBlockScanner) saveUnspentChanges(height uint64, blockHash string, result *ExtractResult) error {
+
+	if !bs.localUnspentEnabled() || (len(result.unspents) == 0 && len(result.spends) == 0) {
+		return nil
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	//websocket推送的交易单与区块扫描并发保存，读写在同一个事务中
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range result.unspents {
+		var exist LocalUnspent
+		if tx.One("Key", u.Key, &exist) == nil {
+			u.SpentTxID = exist.SpentTxID
+			u.SpentHeight = exist.SpentHeight
+			//已确认的输出不改回未确认
+			if height == 0 && exist.Height > 0 {
+				continue
+			}
+		}
+		u.Height = height
+		u.BlockHash = blockHash
+		if err := tx.Save(u); err != nil {
+			return err
+		}
+	}
+
+	for _, spend := range result.spends {
+		u := spend
+		var exist LocalUnspent
+		if tx.One("Key", spend.Key, &exist) == nil {
+			//已确认的花费不改回未确认
+			if height == 0 && exist.SpentHeight > 0 {
+				continue
+			}
+			u = &exist
+		}
+		u.SpentTxID = result.TxID
+		u.SpentHeight = height
+		if err := tx.Save(u); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//revertUnspent 撤销回滚区块的新增未花和花费
+func (bs *HNSBlockScanner) revertUnspent(height uint64) error {
+
+	if !bs.localUnspentEnabled() || height == 0 {
+		return nil
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	err = db.Select(q.Eq("Height", height)).Delete(&LocalUnspent{})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	var spent []*LocalUnspent
+	err = db.Select(q.Eq("SpentHeight", height)).Find(&spent)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, u := range spent {
+		u.SpentTxID = ""
+		u.SpentHeight = 0
+		if err := db.Save(u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//syncMempoolUnspent 清除已不在内存池的未确认未花和花费
+func (bs *HNSBlockScanner) syncMempoolUnspent(txids []string) error {
+
+	if !bs.localUnspentEnabled() {
+		return nil
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	inMempool := make(map[string]bool)
+	for _, txid := range txids {
+		inMempool[txid] = true
+	}
+
+	//离开内存池的交易单可能已上链，节点上查不到才删除
+	dropped := make(map[string]bool)
+	isDropped := func(txid string) bool {
+		if inMempool[txid] {
+			return false
+		}
+		gone, checked := dropped[txid]
+		if !checked {
+			gone = bs.txDropped(txid)
+			dropped[txid] = gone
+		}
+		return gone
+	}
+
+	var unconfirmed []*LocalUnspent
+	err = db.Select(q.Eq("Height", uint64(0))).Find(&unconfirmed)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, u := range unconfirmed {
+		if isDropped(u.TxID) {
+			db.DeleteStruct(u)
+		}
+	}
+
+	var pendingSpent []*LocalUnspent
+	err = db.Select(q.Eq("SpentHeight", uint64(0)), q.Not(q.Eq("SpentTxID", ""))).Find(&pendingSpent)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, u := range pendingSpent {
+		if isDropped(u.SpentTxID) {
+			u.SpentTxID = ""
+			db.Save(u)
+		}
+	}
+
+	return nil
+}
+
+//ListLocalUnspent 查询地址的本地未花记录，includeSpent为true时包含已花费的记录
+func (bs *HNSBlockScanner) ListLocalUnspent(includeSpent bool, addresses ...string) ([]*LocalUnspent, error) {
+
+	list := make([]*LocalUnspent, 0)
+	if len(addresses) == 0 {
+		return list, nil
+	}
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return nil, err
+	}
+
+	matchers := []q.Matcher{q.In("Address", addresses)}
+	if !includeSpent {
+		matchers = append(matchers, q.Eq("SpentTxID", ""))
+	}
+
+	err = db.Select(matchers...).Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//listUnspentFromLocal 从本地未花集合获取可用的未花，与节点查询一样只返回没有契约的输出
+func (bs *HNSBlockScanner) listUnspentFromLocal(addresses ...string) ([]*Unspent, error) {
+
+	list, err := bs.ListLocalUnspent(false, addresses...)
+	if err != nil {
+		return nil, err
+	}
+
+	utxos := make([]*Unspent, 0, len(list))
+	for _, u := range list {
+		if u.Type == 0 && u.Action == "NONE" {
+			utxos = append(utxos, u.Unspent())
+		}
+	}
+	return utxos, nil
+}
+
+//RebuildLocalUnspent 从节点重建地址的本地未花，用于开启本地未花之前已有余额的地址
+func (bs *HNSBlockScanner) RebuildLocalUnspent(addresses ...string) error {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+
+		coins, err := bs.wm.NodeClient.getAddressCoins(address)
+		if err != nil {
+			return err
+		}
+
+		err = db.Select(q.Eq("Address", address), q.Eq("SpentTxID", "")).Delete(&LocalUnspent{})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		for _, coin := range coins {
+			u := newLocalUnspentByCoin(&coin, bs.wm.Decimal())
+			if err := db.Save(u); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
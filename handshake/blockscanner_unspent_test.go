@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"testing"
+)
+
+func TestLocalUnspent(t *testing.T) {
+
+	//txid以bad开头的交易单节点上查不到
+	server := newTestRPCServer()
+	defer server.Close()
+
+	wm, cleanup := newTestScannerWallet(t, server.URL)
+	defer cleanup()
+	wm.Config.EnableLocalUnspent = true
+	bs := wm.Blockscanner
+
+	const addr = "hs1qtsevyrskarucasazwgs7rk8stc36lky7wqrh5k"
+
+	count := func() int {
+		utxos, err := bs.listUnspentFromLocal(addr)
+		if err != nil {
+			t.Fatalf("listUnspentFromLocal failed: %v", err)
+		}
+		return len(utxos)
+	}
+
+	//同一区块中花费先于输出保存
+	spend := &ExtractResult{TxID: "bb", spends: []*LocalUnspent{{Key: unspentKey("aa", 0), TxID: "aa", Address: addr}}}
+	receive := &ExtractResult{TxID: "aa", unspents: []*LocalUnspent{
+		{Key: unspentKey("aa", 0), TxID: "aa", Address: addr, Amount: "1", Action: "NONE"},
+		{Key: unspentKey("aa", 1), TxID: "aa", Vout: 1, Address: addr, Amount: "2", Action: "NONE"},
+	}}
+	bs.saveUnspentChanges(10, "h10", spend)
+	bs.saveUnspentChanges(10, "h10", receive)
+	if n := count(); n != 1 {
+		t.Fatalf("unspent after block = %d, want 1", n)
+	}
+
+	//内存池花费，被丢弃后恢复
+	mempoolSpend := &ExtractResult{TxID: "badcc", spends: []*LocalUnspent{{Key: unspentKey("aa", 1), TxID: "aa", Vout: 1, Address: addr}}}
+	bs.saveUnspentChanges(0, "", mempoolSpend)
+	if n := count(); n != 0 {
+		t.Fatalf("unspent after mempool spend = %d, want 0", n)
+	}
+	bs.syncMempoolUnspent(nil)
+	if n := count(); n != 1 {
+		t.Fatalf("unspent after mempool eviction = %d, want 1", n)
+	}
+
+	//离开内存池但已上链的花费，等待扫描区块
+	minedSpend := &ExtractResult{TxID: "dd", spends: []*LocalUnspent{{Key: unspentKey("aa", 1), TxID: "aa", Vout: 1, Address: addr}}}
+	bs.saveUnspentChanges(0, "", minedSpend)
+	bs.syncMempoolUnspent(nil)
+	if n := count(); n != 0 {
+		t.Fatalf("unspent after mined spend left mempool = %d, want 0", n)
+	}
+
+	//区块回滚
+	bs.revertUnspent(10)
+	if n := count(); n != 0 {
+		t.Fatalf("unspent after revert = %d, want 0", n)
+	}
+}
+
+func TestLocalUnspent_ConfirmedNotLowered(t *testing.T) {
+
+	server := newTestRPCServer()
+	defer server.Close()
+
+	wm, cleanup := newTestScannerWallet(t, server.URL)
+	defer cleanup()
+	wm.Config.EnableLocalUnspent = true
+	bs := wm.Blockscanner
+
+	const addr = "hs1qtsevyrskarucasazwgs7rk8stc36lky7wqrh5k"
+
+	newReceive := func() *ExtractResult {
+		return &ExtractResult{TxID: "badee", unspents: []*LocalUnspent{
+			{Key: unspentKey("badee", 0), TxID: "badee", Address: addr, Amount: "1", Action: "NONE"},
+		}}
+	}
+	newSpend := func() *ExtractResult {
+		return &ExtractResult{TxID: "badff", spends: []*LocalUnspent{{Key: unspentKey("badee", 0), TxID: "badee", Address: addr}}}
+	}
+
+	//区块扫描之后才处理websocket推送的同一交易单
+	bs.saveUnspentChanges(10, "h10", newReceive())
+	bs.saveUnspentChanges(0, "", newReceive())
+	bs.syncMempoolUnspent(nil)
+
+	list, err := bs.ListLocalUnspent(true, addr)
+	if err != nil || len(list) != 1 || list[0].Height != 10 || list[0].BlockHash != "h10" {
+		t.Fatalf("confirmed unspent = %+v, %v", list, err)
+	}
+
+	bs.saveUnspentChanges(11, "h11", newSpend())
+	bs.saveUnspentChanges(0, "", newSpend())
+	bs.syncMempoolUnspent(nil)
+
+	list, _ = bs.ListLocalUnspent(true, addr)
+	if len(list) != 1 || list[0].SpentTxID != "badff" || list[0].SpentHeight != 11 {
+		t.Fatalf("confirmed spend = %+v", list)
+	}
+
+	//花费超出区块头窗口后删除
+	wm.Config.HeaderWindowSize = 5
+	bs.saveHeader(&Block{Height: 16, Hash: "h16"})
+	if list, _ = bs.ListLocalUnspent(true, addr); len(list) != 1 {
+		t.Fatalf("spent record inside the window deleted")
+	}
+	bs.saveHeader(&Block{Height: 17, Hash: "h17"})
+	if list, _ = bs.ListLocalUnspent(true, addr); len(list) != 0 {
+		t.Fatalf("spent record outside the window kept: %+v", list)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/asdine/storm"
+)
+
+/*
+	关注名称：
+	与ScanTargetFuncV2的关注地址独立，扫描器保存关注的名称哈希，
+	任何交易单的契约涉及关注的名称时，都通过BlockExtractSmartContractDataNotify通知，
+	sourceKey为注册名称时指定的值。
+	每扫描到新区块，检查关注名称的过期高度，距离过期不超过nameExpiryWarningBlocks时发出一次Expiring预警，
+	续期后过期高度变化，再次临近过期时重新预警。
+	节点的布隆过滤器只匹配地址和输出，存在关注名称时不使用过滤器模式，逐块扫描。
+*/
+
+const (
+	defaultNameExpiryWarningBlocks = 4320 //过期预警提前的区块数，约30天
+)
+
+//WatchedName 关注的名称
+type WatchedName struct {
+	NameHash     string `storm:"id"` //名称哈希
+	Name         string //名称，注册名称哈希时从节点查询，未开启竞拍的名称可能为空
+	SourceKey    string //通知的sourceKey，默认为名称哈希
+	WarnedExpiry uint64 //已发出预警的过期高度
+}
+
+//loadWatchedNames 从数据库加载关注的名称
+func (bs *HNSBlockScanner) loadWatchedNames() {
+	bs.watchedNamesOnce.Do(func() {
+		names := make(map[string]*WatchedName)
+
+		db, err := bs.scannerDB()
+		if err != nil {
+			bs.wm.Log.Std.Error("block scanner load watched names failed; unexpected error: %v", err)
+		} else {
+			var list []*WatchedName
+			err = db.All(&list)
+			if err != nil && err != storm.ErrNotFound {
+				bs.wm.Log.Std.Error("block scanner load watched names failed; unexpected error: %v", err)
+			}
+			for _, w := range list {
+				names[w.NameHash] = w
+			}
+		}
+
+		bs.watchedNamesMu.Lock()
+		bs.watchedNames = names
+		bs.watchedNamesMu.Unlock()
+	})
+}
+
+//saveWatchedName 保存关注的名称
+func (bs *HNSBlockScanner) saveWatchedName(w *WatchedName) error {
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+	if err := db.Save(w); err != nil {
+		return err
+	}
+
+	bs.watchedNamesMu.Lock()
+	bs.watchedNames[w.NameHash] = w
+	bs.watchedNamesMu.Unlock()
+	return nil
+}
+
+//AddWatchedName 添加关注的名称哈希，sourceKey为空时使用名称哈希
+func (bs *HNSBlockScanner) AddWatchedName(sourceKey string, nameHashes ...string) error {
+
+	bs.loadWatchedNames()
+
+	for _, nameHash := range nameHashes {
+
+		nameHash = strings.ToLower(nameHash)
+		raw, err := hex.DecodeString(nameHash)
+		if err != nil || len(raw) != 32 {
+			return fmt.Errorf("invalid name hash: %s", nameHash)
+		}
+
+		//名称只用于过期预警，查询失败时在发现契约或检查过期时补充
+		name, _ := bs.wm.GetNameByHash(nameHash)
+
+		if err := bs.addWatchedName(sourceKey, nameHash, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//AddWatchedNameByName 通过名称添加关注，sourceKey为空时使用名称哈希
+func (bs *HNSBlockScanner) AddWatchedNameByName(sourceKey string, names ...string) error {
+
+	bs.loadWatchedNames()
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if len(name) == 0 {
+			return fmt.Errorf("name is empty")
+		}
+		if err := bs.addWatchedName(sourceKey, NameHash(name), name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//addWatchedName 保存关注的名称，已关注时更新sourceKey，保留预警记录
+func (bs *HNSBlockScanner) addWatchedName(sourceKey, nameHash, name string) error {
+
+	if len(sourceKey) == 0 {
+		sourceKey = nameHash
+	}
+
+	w := &WatchedName{NameHash: nameHash, Name: name, SourceKey: sourceKey}
+	if exist, ok := bs.getWatchedName(nameHash); ok {
+		w.WarnedExpiry = exist.WarnedExpiry
+		if len(w.Name) == 0 {
+			w.Name = exist.Name
+		}
+	}
+
+	return bs.saveWatchedName(w)
+}
+
+//RemoveWatchedName 取消关注的名称哈希
+func (bs *HNSBlockScanner) RemoveWatchedName(nameHashes ...string) error {
+
+	bs.loadWatchedNames()
+
+	db, err := bs.scannerDB()
+	if err != nil {
+		return err
+	}
+
+	for _, nameHash := range nameHashes {
+		nameHash = strings.ToLower(nameHash)
+		err = db.DeleteStruct(&WatchedName{NameHash: nameHash})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		bs.watchedNamesMu.Lock()
+		delete(bs.watchedNames, nameHash)
+		bs.watchedNamesMu.Unlock()
+	}
+
+	return nil
+}
+
+//GetWatchedNames 获取关注的名称
+func (bs *HNSBlockScanner) GetWatchedNames() []*WatchedName {
+
+	bs.loadWatchedNames()
+
+	bs.watchedNamesMu.RLock()
+	defer bs.watchedNamesMu.RUnlock()
+
+	list := make([]*WatchedName, 0, len(bs.watchedNames))
+	for _, w := range bs.watchedNames {
+		copied := *w
+		list = append(list, &copied)
+	}
+	return list
+}
+
+//getWatchedName 查找关注的名称
+func (bs *HNSBlockScanner) getWatchedName(nameHash string) (*WatchedName, bool) {
+
+	bs.loadWatchedNames()
+
+	bs.watchedNamesMu.RLock()
+	defer bs.watchedNamesMu.RUnlock()
+
+	w, ok := bs.watchedNames[nameHash]
+	if !ok {
+		return nil, false
+	}
+	copied := *w
+	return &copied, true
+}
+
+//hasWatchedNames 是否存在关注的名称
+func (bs *HNSBlockScanner) hasWatchedNames() bool {
+
+	bs.loadWatchedNames()
+
+	bs.watchedNamesMu.RLock()
+	defer bs.watchedNamesMu.RUnlock()
+	return len(bs.watchedNames) > 0
+}
+
+//extractWatchedNameEvent 契约涉及关注的名称时加入通知，地址通知已使用相同sourceKey时不重复
+func (bs *HNSBlockScanner) extractWatchedNameEvent(trx *Transaction, result *ExtractResult, from, addressSourceKey string, event *NameEvent) {
+
+	w, ok := bs.getWatchedName(event.NameHash)
+	if !ok {
+		return
+	}
+
+	//补充未知的名称
+	if len(w.Name) == 0 && len(event.Name) > 0 {
+		w.Name = event.Name
+		if err := bs.saveWatchedName(w); err != nil {
+			bs.wm.Log.Std.Error("block scanner save watched name failed; unexpected error: %v", err)
+		}
+	}
+
+	if w.SourceKey == addressSourceKey {
+		return
+	}
+
+	bs.addNameReceipt(result, w.SourceKey, trx, from, event)
+}
+
+//nameExpiryWarningBlocks 过期预警提前的区块数
+func (bs *HNSBlockScanner) nameExpiryWarningBlocks() uint64 {
+	return bs.wm.Config.NameExpiryWarningBlocks
+}
+
+//isNameExpiryDue 名称是否需要发出过期预警，同一过期高度只预警一次
+func isNameExpiryDue(info *NameInfo, warningBlocks, warnedExpiry uint64) bool {
+	if warningBlocks == 0 || len(info.State) == 0 || info.Expired {
+		return false
+	}
+	if info.BlocksUntilExpire <= 0 || uint64(info.BlocksUntilExpire) > warningBlocks {
+		return false
+	}
+	return info.ExpiryHeight != warnedExpiry
+}
+
+//checkNameExpiry 检查关注名称的过期高度，临近过期时通知
+func (bs *HNSBlockScanner) checkNameExpiry() {
+
+	warningBlocks := bs.nameExpiryWarningBlocks()
+	if warningBlocks == 0 || !bs.hasWatchedNames() {
+		return
+	}
+
+	header, err := bs.GetScannedBlockHeader()
+	if err != nil {
+		return
+	}
+
+	//每个新区块检查一次
+	if header.Height <= bs.expiryCheckedHeight {
+		return
+	}
+	bs.expiryCheckedHeight = header.Height
+
+	for _, w := range bs.GetWatchedNames() {
+
+		if len(w.Name) == 0 {
+			name, err := bs.wm.GetNameByHash(w.NameHash)
+			if err != nil || len(name) == 0 {
+				continue
+			}
+			w.Name = name
+		}
+
+		info, err := bs.wm.GetNameInfo(w.Name)
+		if err != nil {
+			bs.wm.Log.Std.Info("block scanner can not get name info of %s; unexpected error: %v", w.Name, err)
+			continue
+		}
+
+		if !isNameExpiryDue(info, warningBlocks, w.WarnedExpiry) {
+			continue
+		}
+
+		event := &NameEvent{
+			Event:             NameEventExpiring,
+			NameHash:          w.NameHash,
+			Name:              w.Name,
+			NameHeight:        info.Height,
+			BlockHash:         header.Hash,
+			BlockHeight:       header.Height,
+			ExpiryHeight:      info.ExpiryHeight,
+			BlocksUntilExpire: info.BlocksUntilExpire,
+		}
+
+		trx := &Transaction{
+			BlockHash:   header.Hash,
+			BlockHeight: header.Height,
+			Blocktime:   int64(header.Time),
+			Fees:        "0",
+		}
+		result := &ExtractResult{BlockHeight: header.Height}
+		bs.addNameReceipt(result, w.SourceKey, trx, "", event)
+		if err := bs.newExtractContractDataNotify(header.Height, "", result.contractData); err != nil {
+			//不标记已提醒，下一个区块重试
+			continue
+		}
+
+		w.WarnedExpiry = info.ExpiryHeight
+		if err := bs.saveWatchedName(w); err != nil {
+			bs.wm.Log.Std.Error("block scanner save watched name failed; unexpected error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestWatchedNameEvents(t *testing.T) {
+
+	wm, cleanup := newTestScannerWallet(t, "")
+	defer cleanup()
+	bs := wm.Blockscanner
+
+	if err := bs.AddWatchedNameByName("names", "example"); err != nil {
+		t.Fatalf("AddWatchedNameByName failed: %v", err)
+	}
+	if !bs.hasWatchedNames() {
+		t.Fatal("watched name not saved")
+	}
+
+	trx := &Transaction{
+		TxID: "t1",
+		Vouts: []*Vout{{
+			N:      0,
+			Addr:   "hs1qtsevyrskarucasazwgs7rk8stc36lky7wqrh5k",
+			Value:  "1",
+			Type:   "2",
+			Action: "OPEN",
+			Items:  []string{NameHash("example"), "00000000", hex.EncodeToString([]byte("example"))},
+		}},
+	}
+
+	//地址不关注，名称关注
+	noAddress := func(openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		return openwallet.ScanTargetResult{}
+	}
+	result := &ExtractResult{}
+	bs.extractNameEvents(trx, result, noAddress)
+	receipts := result.contractData["names"]
+	if len(receipts) != 1 || len(receipts[0].Events) != 1 || receipts[0].Events[0].Event != NameEventOpened {
+		t.Fatalf("unexpected receipts: %+v", result.contractData)
+	}
+
+	if err := bs.RemoveWatchedName(NameHash("example")); err != nil {
+		t.Fatalf("RemoveWatchedName failed: %v", err)
+	}
+	result = &ExtractResult{}
+	bs.extractNameEvents(trx, result, noAddress)
+	if len(result.contractData) != 0 {
+		t.Fatalf("removed name still notified: %+v", result.contractData)
+	}
+}
+
+func TestIsNameExpiryDue(t *testing.T) {
+
+	info := &NameInfo{State: "CLOSED", ExpiryHeight: 5000, BlocksUntilExpire: 100}
+
+	if !isNameExpiryDue(info, 200, 0) {
+		t.Error("name should be due for warning")
+	}
+	if isNameExpiryDue(info, 200, 5000) {
+		t.Error("name already warned for this expiry")
+	}
+	if isNameExpiryDue(info, 50, 0) {
+		t.Error("name is not within warning blocks")
+	}
+	if isNameExpiryDue(info, 0, 0) {
+		t.Error("warning disabled")
+	}
+}
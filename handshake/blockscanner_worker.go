@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+//extractJob 提取任务，trx不为空时直接提取，否则按txid向节点查询
+type extractJob struct {
+	txid string
+	trx  *Transaction
+}
+
+//ExtractTxError 交易单提取失败的原因
+type ExtractTxError struct {
+	TxID string
+	Err  error
+}
+
+//ExtractErrors 批量提取的错误，按交易单汇总
+type ExtractErrors struct {
+	BlockHeight uint64
+	Errors      []*ExtractTxError
+	Canceled    bool //扫描器已停止，部分交易单未提取
+}
+
+//add 记录交易单的错误
+func (e *ExtractErrors) add(txid string, err error) {
+	e.Errors = append(e.Errors, &ExtractTxError{TxID: txid, Err: err})
+}
+
+//Failed 是否存在错误
+func (e *ExtractErrors) Failed() bool {
+	return e.Canceled || len(e.Errors) > 0
+}
+
+//Error 实现error接口
+func (e *ExtractErrors) Error() string {
+	msgs := make([]string, 0, len(e.Errors)+1)
+	if e.Canceled {
+		msgs = append(msgs, "extraction canceled")
+	}
+	for _, txErr := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("tx %s: %v", txErr.TxID, txErr.Err))
+	}
+	return fmt.Sprintf("block %d extract failed: %s", e.BlockHeight, strings.Join(msgs, "; "))
+}
+
+//isExtractCanceled 提取是否因扫描器停止而取消
+func isExtractCanceled(err error) bool {
+	e, ok := err.(*ExtractErrors)
+	return ok && e.Canceled
+}
+
+//extractWorkers 并发的提取线程数
+func (bs *HNSBlockScanner) extractWorkers() int {
+	if bs.wm.Config.ExtractWorkers > 0 {
+		return bs.wm.Config.ExtractWorkers
+	}
+	return defaultExtractWorkers
+}
+
+//extractContext 当前提取任务的上下文
+func (bs *HNSBlockScanner) extractContext() context.Context {
+	bs.extractCtxMu.Lock()
+	defer bs.extractCtxMu.Unlock()
+	return bs.extractCtx
+}
+
+//cancelExtract 取消进行中的提取
+func (bs *HNSBlockScanner) cancelExtract() {
+	bs.extractCtxMu.Lock()
+	defer bs.extractCtxMu.Unlock()
+	bs.extractCancel()
+}
+
+//resetExtractContext 停止后再次运行，重新创建上下文
+func (bs *HNSBlockScanner) resetExtractContext() {
+	bs.extractCtxMu.Lock()
+	defer bs.extractCtxMu.Unlock()
+	if bs.extractCtx.Err() != nil {
+		bs.extractCtx, bs.extractCancel = context.WithCancel(context.Background())
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+//newTestRPCServer 模拟节点的getrawtransaction，txid以bad开头时返回错误
+func newTestRPCServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		txid := gjson.GetBytes(body, "params.0").String()
+		if strings.HasPrefix(txid, "bad") {
+			fmt.Fprint(w, `{"result":null,"error":{"code":-5,"message":"No information available about transaction"},"id":"1"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"result":{"txid":"%s","vin":[{"coinbase":true}],"vout":[{"value":2000,"n":0,"address":{"version":0,"hash":"b302960fb163255e3abf855babd47da1d819bb85"},"covenant":{"type":0,"action":"NONE"}}]},"error":null,"id":"1"}`, txid)
+	}))
+}
+
+func newTestWorkerScanner(t *testing.T, url string) *HNSBlockScanner {
+	wm := NewWalletManager()
+	wm.Config.ExtractWorkers = 4
+	wm.NodeClient = NewClient(url, "", false)
+	bs := wm.Blockscanner
+	bs.SetBlockScanTargetFuncV2(func(openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		return openwallet.ScanTargetResult{}
+	})
+	return bs
+}
+
+func TestBatchExtractTransaction_Errors(t *testing.T) {
+
+	server := newTestRPCServer()
+	defer server.Close()
+
+	bs := newTestWorkerScanner(t, server.URL)
+
+	txids := make([]string, 0)
+	for i := 0; i < 40; i++ {
+		if i%10 == 0 {
+			txids = append(txids, fmt.Sprintf("bad%02d", i))
+		} else {
+			txids = append(txids, fmt.Sprintf("tx%02d", i))
+		}
+	}
+
+	err := bs.BatchExtractTransaction(0, "", txids)
+	extractErr, ok := err.(*ExtractErrors)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if extractErr.Canceled || len(extractErr.Errors) != 4 {
+		t.Fatalf("unexpected extract errors: %v", extractErr)
+	}
+	for _, txErr := range extractErr.Errors {
+		if !strings.HasPrefix(txErr.TxID, "bad") {
+			t.Errorf("unexpected failed tx: %s", txErr.TxID)
+		}
+	}
+
+	if err := bs.BatchExtractTransaction(0, "", txids[1:10]); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBatchExtractTransaction_Cancel(t *testing.T) {
+
+	server := newTestRPCServer()
+	defer server.Close()
+
+	bs := newTestWorkerScanner(t, server.URL)
+	bs.cancelExtract()
+
+	txids := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		txids = append(txids, fmt.Sprintf("tx%02d", i))
+	}
+
+	err := bs.BatchExtractTransaction(0, "", txids)
+	if !isExtractCanceled(err) {
+		t.Fatalf("extraction should be canceled, got: %v", err)
+	}
+
+	//再次运行时重新创建上下文
+	bs.resetExtractContext()
+	if err := bs.BatchExtractTransaction(0, "", txids); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractTransaction_Coinbase(t *testing.T) {
+
+	server := newTestRPCServer()
+	defer server.Close()
+
+	bs := newTestWorkerScanner(t, server.URL)
+
+	trx, err := bs.wm.GetTransaction("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := trx.Vouts[0].Addr
+	bs.SetBlockScanTargetFuncV2(func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		return openwallet.ScanTargetResult{SourceKey: "account", Exist: target.ScanTarget == address}
+	})
+
+	result := bs.ExtractTransaction(100, "h100", "c1", nil)
+	if !result.Success {
+		t.Fatalf("extract coinbase tx failed: %v", result.err)
+	}
+
+	data := result.extractData["account"]
+	if data == nil {
+		t.Fatal("coinbase output is not extracted as a deposit")
+	}
+	if len(data.TxInputs) != 0 || len(data.TxOutputs) != 1 {
+		t.Fatalf("inputs = %d, outputs = %d, want 0, 1", len(data.TxInputs), len(data.TxOutputs))
+	}
+	output := data.TxOutputs[0]
+	if output.Address != address || output.Amount != "2000" || output.BlockHeight != 100 {
+		t.Errorf("unexpected output: %+v", output)
+	}
+	if !output.GetExtParam().Get("coinbase").Bool() {
+		t.Errorf("output is not marked coinbase: %v", output.GetExtParam())
+	}
+	if data.Transaction.Fees != "0.000000" || data.Transaction.GetExtParam().Get("maturity").Uint() != bs.wm.coinbaseMaturity() {
+		t.Errorf("unexpected transaction: fees = %s, ext = %v", data.Transaction.Fees, data.Transaction.GetExtParam())
+	}
+}
+
+//testFailedContractObserver 名称事件通知总是失败
+type testFailedContractObserver struct {
+	testExtractObserver
+}
+
+func (o *testFailedContractObserver) BlockExtractSmartContractDataNotify(sourceKey string, data *openwallet.SmartContractReceipt) error {
+	return fmt.Errorf("notify failed")
+}
+
+func TestExtractContractDataNotify_Failed(t *testing.T) {
+
+	wm, cleanup := newTestScannerWallet(t, "")
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.AddObserver(&testFailedContractObserver{testExtractObserver{data: make(map[string][]*openwallet.TxExtractData)}})
+
+	contractData := map[string][]*openwallet.SmartContractReceipt{
+		"account": {{TxID: "t1"}},
+	}
+
+	//通知失败返回错误，只重试该交易单
+	if err := bs.newExtractContractDataNotify(10, "t1", contractData); err == nil {
+		t.Fatal("notify failure should return error")
+	}
+	queue, _ := bs.GetRetryQueue()
+	if len(queue) != 1 || queue[0].Height != 10 || queue[0].TxID != "t1" {
+		t.Fatalf("unexpected retry queue: %+v", queue)
+	}
+
+	//没有交易单的事件不记录重扫
+	if err := bs.newExtractContractDataNotify(11, "", contractData); err == nil {
+		t.Fatal("notify failure should return error")
+	}
+	queue, _ = bs.GetRetryQueue()
+	if len(queue) != 1 {
+		t.Fatalf("unexpected retry queue: %+v", queue)
+	}
+}
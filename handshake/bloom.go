@@ -0,0 +1,189 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+//布隆过滤器更新方式，与hsd一致
+const (
+	BloomUpdateNone         = uint8(0) //不自动添加匹配的输出
+	BloomUpdateAll          = uint8(1) //自动添加所有匹配的输出
+	BloomUpdateP2PubKeyOnly = uint8(2)
+)
+
+const (
+	maxBloomFilterSize = 36000 //过滤器最大字节数
+	maxBloomHashFuncs  = 50    //最大哈希函数数量
+	bloomSeedFactor    = 0xfba4c795
+)
+
+//BloomFilter BIP37格式的布隆过滤器，用于hsd websocket的set filter
+type BloomFilter struct {
+	filter []byte
+	n      uint32 //哈希函数数量
+	tweak  uint32
+	update uint8
+	items  uint32 //已添加的元素数量
+}
+
+//NewBloomFilter 根据元素数量和误报率创建过滤器
+func NewBloomFilter(items uint32, rate float64, tweak uint32, update uint8) *BloomFilter {
+
+	if items == 0 {
+		items = 1
+	}
+
+	size := int(-1 / (math.Ln2 * math.Ln2) * float64(items) * math.Log(rate) / 8)
+	if size > maxBloomFilterSize {
+		size = maxBloomFilterSize
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	n := uint32(float64(size*8) / float64(items) * math.Ln2)
+	if n > maxBloomHashFuncs {
+		n = maxBloomHashFuncs
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	return &BloomFilter{
+		filter: make([]byte, size),
+		n:      n,
+		tweak:  tweak,
+		update: update,
+	}
+}
+
+func (f *BloomFilter) hash(data []byte, i uint32) uint32 {
+	return murmur3(data, i*bloomSeedFactor+f.tweak) % uint32(len(f.filter)*8)
+}
+
+//Add 添加元素
+func (f *BloomFilter) Add(data []byte) {
+	for i := uint32(0); i < f.n; i++ {
+		bit := f.hash(data, i)
+		f.filter[bit>>3] |= 1 << (bit & 7)
+	}
+	f.items++
+}
+
+//Test 元素是否可能存在
+func (f *BloomFilter) Test(data []byte) bool {
+	for i := uint32(0); i < f.n; i++ {
+		bit := f.hash(data, i)
+		if f.filter[bit>>3]&(1<<(bit&7)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//Items 已添加的元素数量
+func (f *BloomFilter) Items() uint32 {
+	return f.items
+}
+
+//FalsePositiveRate 按已添加的元素数量估算当前的误报率
+func (f *BloomFilter) FalsePositiveRate() float64 {
+	m := float64(len(f.filter) * 8)
+	k := float64(f.n)
+	return math.Pow(1-math.Exp(-k*float64(f.items)/m), k)
+}
+
+//Bytes 序列化：varbytes过滤器 + u32哈希函数数量 + u32 tweak + u8更新方式
+func (f *BloomFilter) Bytes() []byte {
+	buf := make([]byte, 0, len(f.filter)+18)
+	buf = appendVarInt(buf, uint64(len(f.filter)))
+	buf = append(buf, f.filter...)
+	buf = append(buf, uint32ToBytes(f.n)...)
+	buf = append(buf, uint32ToBytes(f.tweak)...)
+	buf = append(buf, f.update)
+	return buf
+}
+
+func uint32ToBytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func appendVarInt(buf []byte, v uint64) []byte {
+	switch {
+	case v < 0xfd:
+		return append(buf, byte(v))
+	case v <= 0xffff:
+		return append(buf, 0xfd, byte(v), byte(v>>8))
+	case v <= 0xffffffff:
+		return append(append(buf, 0xfe), uint32ToBytes(uint32(v))...)
+	default:
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, v)
+		return append(append(buf, 0xff), b...)
+	}
+}
+
+//murmur3 32位murmur3哈希
+func murmur3(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	h := seed
+	blocks := len(data) / 4
+	for i := 0; i < blocks; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = (k << 15) | (k >> 17)
+		k *= c2
+
+		h ^= k
+		h = (h << 13) | (h >> 19)
+		h = h*5 + 0xe6546b64
+	}
+
+	tail := data[blocks*4:]
+	k := uint32(0)
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = (k << 15) | (k >> 17)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
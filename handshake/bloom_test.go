@@ -0,0 +1,157 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMurmur3(t *testing.T) {
+	tests := []struct {
+		expected uint32
+		seed     uint32
+		data     string
+	}{
+		{0x00000000, 0x00000000, ""},
+		{0x6a396f08, 0xfba4c795, ""},
+		{0x81f16f39, 0xffffffff, ""},
+		{0x514e28b7, 0x00000000, "00"},
+		{0xea3f0b17, 0xfba4c795, "00"},
+		{0xfd6cf10d, 0x00000000, "ff"},
+		{0x16c6b7ab, 0x00000000, "0011"},
+		{0x8eb51c3d, 0x00000000, "001122"},
+		{0xb4471bf8, 0x00000000, "00112233"},
+		{0xe2301fa8, 0x00000000, "0011223344"},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+		if h := murmur3(data, test.seed); h != test.expected {
+			t.Errorf("murmur3(%s, %x) = %x, expected %x", test.data, test.seed, h, test.expected)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	f := NewBloomFilter(3, 0.01, 0, BloomUpdateAll)
+	item, _ := hex.DecodeString("99108ad8ed9bb6274d3980bab5a85c048f0950c8")
+	f.Add(item)
+	if !f.Test(item) {
+		t.Errorf("added item should match")
+	}
+	other, _ := hex.DecodeString("19108ad8ed9bb6274d3980bab5a85c048f0950c8")
+	if f.Test(other) {
+		t.Errorf("other item should not match")
+	}
+
+	for _, s := range []string{"b5a2c786d9ef4658287ced5914b37a1b4aa32eee", "b9300670b4c5366e95b2699e8b18bc75e5f729c5"} {
+		data, _ := hex.DecodeString(s)
+		f.Add(data)
+	}
+
+	//BIP37测试数据
+	if raw := hex.EncodeToString(f.Bytes()); raw != "03614e9b050000000000000001" {
+		t.Errorf("unexpected serialization: %s", raw)
+	}
+}
+
+func TestAddressFilter_Active(t *testing.T) {
+	f := newAddressFilter(defaultBloomFilterRate, defaultBloomFilterMaxRate)
+
+	//没有关注的地址时不使用过滤器模式
+	f.setLoaded(true)
+	if f.active() {
+		t.Fatalf("empty filter should not be active")
+	}
+
+	f.mu.Lock()
+	f.add(f.addresses, map[string][]byte{"a1": {0x01}})
+	f.mu.Unlock()
+	if !f.active() {
+		t.Fatalf("loaded filter with addresses should be active")
+	}
+
+	//误报率过高时重建，追上节点前逐块扫描
+	items := make(map[string][]byte)
+	for i := 0; i < 5*minBloomFilterItems; i++ {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, uint32(i))
+		items[string(data)] = data
+	}
+	f.mu.Lock()
+	_, rebuilt := f.add(f.outpoints, items)
+	f.mu.Unlock()
+	if !rebuilt {
+		t.Fatalf("filter should be rebuilt")
+	}
+	f.setLoaded(true)
+	if f.active() {
+		t.Fatalf("rebuilt filter should wait for resync")
+	}
+	f.setResync(false)
+	if !f.active() {
+		t.Fatalf("resynced filter should be active")
+	}
+}
+
+func TestSetFilterAddresses_SeedOutpoints(t *testing.T) {
+
+	const addr = "hs1qtsevyrskarucasazwgs7rk8stc36lky7wqrh5k"
+	prevNode := strings.Repeat("ab", 32)
+	prevLocal := strings.Repeat("cd", 32)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"hash":"%s","index":1,"address":"%s","value":1000000,"height":10}]`, prevNode, addr)
+	}))
+	defer server.Close()
+
+	wm, cleanup := newTestScannerWallet(t, server.URL)
+	defer cleanup()
+	bs := wm.Blockscanner
+
+	//花费已有输出的交易单，节点按输入的prevout匹配过滤器
+	spends := func(txid string, index uint32) bool {
+		prevout, _ := outpointBytes(txid, index)
+		f := bs.addrFilter
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.filter.Test(prevout)
+	}
+
+	if err := bs.SetFilterAddresses([]string{addr}); err != nil {
+		t.Fatalf("SetFilterAddresses failed: %v", err)
+	}
+	if !spends(prevNode, 1) {
+		t.Fatalf("spend of an existing coin on the node is not matched")
+	}
+
+	//开启本地未花时读取本地集合
+	wm.Config.EnableLocalUnspent = true
+	bs.saveUnspentChanges(10, "h10", &ExtractResult{TxID: prevLocal, unspents: []*LocalUnspent{
+		{Key: unspentKey(prevLocal, 0), TxID: prevLocal, Address: addr, Amount: "1", Action: "NONE"},
+	}})
+	if err := bs.SetFilterAddresses([]string{addr}); err != nil {
+		t.Fatalf("SetFilterAddresses failed: %v", err)
+	}
+	if !spends(prevLocal, 0) {
+		t.Fatalf("spend of an existing local unspent is not matched")
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"strings"
+
+	"github.com/blocktree/handshake-adapter/handshakeTransaction"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//BroadcastAction 广播失败后建议调用方采取的处理
+type BroadcastAction int
+
+const (
+	BroadcastActionNone    BroadcastAction = iota //广播成功，无需处理
+	BroadcastActionRetry                          //节点不可用或网络异常，稍后重新广播
+	BroadcastActionBumpFee                        //手续费不足，提高手续费后重新创建交易单
+	BroadcastActionGiveUp                         //交易单被拒绝，重新广播也不会成功
+)
+
+//BroadcastResult 广播交易单的结果
+type BroadcastResult struct {
+	TxID         string          //交易单ID
+	AlreadyKnown bool            //节点已存在该交易单
+	RejectCode   int64           //节点返回的错误码
+	RejectReason string          //节点返回的拒绝原因
+	Action       BroadcastAction //建议的处理方式
+}
+
+//rejectRule 拒绝原因匹配规则
+type rejectRule struct {
+	keyword string
+	action  BroadcastAction
+	known   bool
+}
+
+//broadcastRejectRules hsd拒绝原因与处理方式的对应关系，按顺序匹配
+var broadcastRejectRules = []rejectRule{
+	{keyword: "already-known", known: true},
+	{keyword: "already-in-mempool", known: true},
+	{keyword: "already in mempool", known: true},
+	{keyword: "already have transaction", known: true},
+	{keyword: "already in block chain", known: true},
+	{keyword: "insufficient fee", action: BroadcastActionBumpFee},
+	{keyword: "insufficient priority", action: BroadcastActionBumpFee},
+	{keyword: "min relay fee not met", action: BroadcastActionBumpFee},
+	{keyword: "mempool min fee not met", action: BroadcastActionBumpFee},
+	{keyword: "mempool full", action: BroadcastActionBumpFee},
+	{keyword: "dust", action: BroadcastActionGiveUp},
+	{keyword: "nonstandard", action: BroadcastActionGiveUp},
+	{keyword: "non-standard", action: BroadcastActionGiveUp},
+	{keyword: "inputs-missingorspent", action: BroadcastActionGiveUp},
+	{keyword: "mempool-conflict", action: BroadcastActionGiveUp},
+	{keyword: "double spend", action: BroadcastActionGiveUp},
+}
+
+//newBroadcastResult 根据节点的广播错误生成广播结果
+func newBroadcastResult(err error) *BroadcastResult {
+
+	rpcErr, ok := AsRPCError(err)
+
+	//节点没有返回错误码，视为网络异常
+	if !ok {
+		return &BroadcastResult{
+			RejectReason: err.Error(),
+			Action:       BroadcastActionRetry,
+		}
+	}
+
+	result := &BroadcastResult{
+		RejectCode:   rpcErr.Code,
+		RejectReason: rpcErr.Message,
+	}
+
+	switch rpcErr.Code {
+	case rpcErrVerifyAlreadyIn:
+		result.AlreadyKnown = true
+		result.Action = BroadcastActionNone
+		return result
+	case rpcErrClientNotConnect, rpcErrClientInWarmup, rpcErrClientNodeAddress:
+		result.Action = BroadcastActionRetry
+		return result
+	case rpcErrDeserialization, rpcErrInvalidParameter:
+		result.Action = BroadcastActionGiveUp
+		return result
+	}
+
+	lower := strings.ToLower(rpcErr.Message)
+	for _, rule := range broadcastRejectRules {
+		if strings.Contains(lower, rule.keyword) {
+			result.AlreadyKnown = rule.known
+			result.Action = rule.action
+			return result
+		}
+	}
+
+	//节点明确拒绝了交易单
+	result.Action = BroadcastActionGiveUp
+	return result
+}
+
+//Err 广播结果转为openwallet错误，成功或已存在时返回nil
+func (r *BroadcastResult) Err() error {
+	switch r.Action {
+	case BroadcastActionRetry:
+		return openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, "broadcast transaction failed, node unavailable: %s", r.RejectReason)
+	case BroadcastActionBumpFee:
+		return openwallet.Errorf(openwallet.ErrInsufficientFees, "broadcast transaction rejected, fees too low: [%d]%s", r.RejectCode, r.RejectReason)
+	case BroadcastActionGiveUp:
+		if strings.Contains(strings.ToLower(r.RejectReason), "dust") {
+			return openwallet.Errorf(openwallet.ErrDustLimit, "broadcast transaction rejected, dust output: [%d]%s", r.RejectCode, r.RejectReason)
+		}
+		return openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "broadcast transaction rejected: [%d]%s", r.RejectCode, r.RejectReason)
+	}
+	return nil
+}
+
+//BroadcastTransaction 广播交易单，返回结构化的广播结果
+//交易单已在节点的内存池或链上时，视为广播成功，返回本地计算的txid
+func (wm *WalletManager) BroadcastTransaction(txHex string) *BroadcastResult {
+
+	txid, err := wm.NodeClient.sendTransaction(txHex)
+	if err == nil {
+		return &BroadcastResult{TxID: txid, Action: BroadcastActionNone}
+	}
+
+	result := newBroadcastResult(err)
+	if result.AlreadyKnown {
+		localTxID, parseErr := handshakeTransaction.GetTxID(txHex)
+		if parseErr != nil {
+			wm.Log.Std.Error("transaction already known, but can not parse txid: %v", parseErr)
+			result.AlreadyKnown = false
+			result.Action = BroadcastActionGiveUp
+			return result
+		}
+		result.TxID = localTxID
+	}
+
+	return result
+}
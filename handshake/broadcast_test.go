@@ -0,0 +1,59 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestNewBroadcastResult(t *testing.T) {
+	tests := []struct {
+		err    error
+		known  bool
+		action BroadcastAction
+		code   uint64
+	}{
+		{&RPCError{Code: -26, Message: "txn-already-in-mempool"}, true, BroadcastActionNone, 0},
+		{&RPCError{Code: -27, Message: "transaction already in block chain"}, true, BroadcastActionNone, 0},
+		{&RPCError{Code: -26, Message: "insufficient fee"}, false, BroadcastActionBumpFee, openwallet.ErrInsufficientFees},
+		{&RPCError{Code: -26, Message: "dust"}, false, BroadcastActionGiveUp, openwallet.ErrDustLimit},
+		{&RPCError{Code: -25, Message: "bad-txns-inputs-missingorspent"}, false, BroadcastActionGiveUp, openwallet.ErrSubmitRawTransactionFailed},
+		{&RPCError{Code: -28, Message: "Loading block index..."}, false, BroadcastActionRetry, openwallet.ErrCallFullNodeAPIFailed},
+		{errors.New("dial tcp 127.0.0.1:12037: connect: connection refused"), false, BroadcastActionRetry, openwallet.ErrCallFullNodeAPIFailed},
+	}
+
+	for _, test := range tests {
+		result := newBroadcastResult(test.err)
+		if result.AlreadyKnown != test.known || result.Action != test.action {
+			t.Errorf("%v: unexpected result: %+v", test.err, result)
+			continue
+		}
+		err := result.Err()
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", test.err, err)
+			}
+			continue
+		}
+		owErr := openwallet.ConvertError(err)
+		if owErr == nil || owErr.Code() != test.code {
+			t.Errorf("%v: unexpected error: %v", test.err, err)
+		}
+	}
+}
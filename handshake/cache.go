@@ -0,0 +1,271 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	defaultTxCacheSize    = 20000 //默认缓存的交易单数量
+	defaultBlockCacheSize = 2000  //默认缓存的区块数量
+)
+
+//lruCache 固定容量的LRU缓存，并发安全
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+//newLRUCache 创建LRU缓存，capacity <= 0 时不缓存
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+//Get 读取缓存，并记录命中率
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		atomic.AddUint64(&c.hits, 1)
+		return e.Value.(*lruEntry).value, true
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return nil, false
+}
+
+//Add 写入缓存，超过容量时淘汰最久未使用的记录
+func (c *lruCache) Add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.capacity <= 0 {
+		return
+	}
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*lruEntry).value = value
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value})
+	for c.ll.Len() > c.capacity {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*lruEntry).key)
+	}
+}
+
+//Remove 删除缓存
+func (c *lruCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+//Resize 修改容量并清空缓存
+func (c *lruCache) Resize(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+//Len 缓存记录数
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+//Stats 命中和未命中次数
+func (c *lruCache) Stats() (uint64, uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+//cachedTx 缓存的原始交易单
+type cachedTx struct {
+	raw       *gjson.Result
+	blockHash string //所在区块，未确认为空
+}
+
+//cachedBlock 缓存的区块头信息
+type cachedBlock struct {
+	height uint64
+	time   uint64
+}
+
+//NodeCacheStats 节点数据缓存统计
+type NodeCacheStats struct {
+	TxHits      uint64 //交易单缓存命中次数
+	TxMisses    uint64 //交易单缓存未命中次数
+	TxSize      int    //交易单缓存数量
+	BlockHits   uint64 //区块缓存命中次数
+	BlockMisses uint64 //区块缓存未命中次数
+	BlockSize   int    //区块缓存数量
+}
+
+//nodeCache 节点RPC结果缓存，交易单以txid为键，区块以hash为键
+type nodeCache struct {
+	txs    *lruCache
+	blocks *lruCache
+	tip    uint64 //最近一次查询到的节点高度，原子操作读写
+}
+
+//newNodeCache 创建节点缓存
+func newNodeCache(txSize, blockSize int) *nodeCache {
+	return &nodeCache{
+		txs:    newLRUCache(txSize),
+		blocks: newLRUCache(blockSize),
+	}
+}
+
+//resize 修改缓存容量，原有缓存会被清空
+func (nc *nodeCache) resize(txSize, blockSize int) {
+	if nc == nil {
+		return
+	}
+	nc.txs.Resize(txSize)
+	nc.blocks.Resize(blockSize)
+}
+
+//setTip 记录节点的最新高度
+func (nc *nodeCache) setTip(height uint64) {
+	if nc == nil {
+		return
+	}
+	atomic.StoreUint64(&nc.tip, height)
+}
+
+//confirmations 按记录的节点高度计算区块的确认数，高度未知或落后于区块时返回false
+func (nc *nodeCache) confirmations(blockHeight uint64) (uint64, bool) {
+	if nc == nil || blockHeight == 0 {
+		return 0, false
+	}
+	tip := atomic.LoadUint64(&nc.tip)
+	if tip < blockHeight {
+		return 0, false
+	}
+	return tip - blockHeight + 1, true
+}
+
+//getTx 读取交易单，confirmedOnly为true时只返回已上链的交易单
+//交易单的输出不会因为上链而改变，追溯输入源头时可以使用未确认的缓存
+//缓存中的confirmations是缓存时的值，使用时需要重新计算
+func (nc *nodeCache) getTx(txid string, confirmedOnly bool) (*gjson.Result, bool) {
+	if nc == nil {
+		return nil, false
+	}
+	v, ok := nc.txs.Get(txid)
+	if !ok {
+		return nil, false
+	}
+	tx := v.(*cachedTx)
+	if confirmedOnly && len(tx.blockHash) == 0 {
+		return nil, false
+	}
+	return tx.raw, true
+}
+
+//addTx 缓存交易单
+func (nc *nodeCache) addTx(txid string, raw *gjson.Result) {
+	if nc == nil || raw == nil || len(txid) == 0 {
+		return
+	}
+	nc.txs.Add(txid, &cachedTx{
+		raw:       raw,
+		blockHash: raw.Get("blockhash").String(),
+	})
+}
+
+//getBlock 读取区块头信息
+func (nc *nodeCache) getBlock(hash string) (*cachedBlock, bool) {
+	if nc == nil {
+		return nil, false
+	}
+	v, ok := nc.blocks.Get(hash)
+	if !ok {
+		return nil, false
+	}
+	return v.(*cachedBlock), true
+}
+
+//addBlock 缓存区块头信息
+func (nc *nodeCache) addBlock(hash string, block *cachedBlock) {
+	if nc == nil || len(hash) == 0 {
+		return
+	}
+	nc.blocks.Add(hash, block)
+}
+
+//invalidateBlock 区块被回滚后，删除该区块及其交易单的缓存
+func (nc *nodeCache) invalidateBlock(hash string) {
+	if nc == nil || len(hash) == 0 {
+		return
+	}
+	nc.blocks.Remove(hash)
+
+	nc.txs.mu.Lock()
+	stale := make([]string, 0)
+	for key, e := range nc.txs.items {
+		if e.Value.(*lruEntry).value.(*cachedTx).blockHash == hash {
+			stale = append(stale, key)
+		}
+	}
+	nc.txs.mu.Unlock()
+	for _, key := range stale {
+		nc.txs.Remove(key)
+	}
+}
+
+//stats 缓存统计
+func (nc *nodeCache) stats() NodeCacheStats {
+	if nc == nil {
+		return NodeCacheStats{}
+	}
+	s := NodeCacheStats{}
+	s.TxHits, s.TxMisses = nc.txs.Stats()
+	s.TxSize = nc.txs.Len()
+	s.BlockHits, s.BlockMisses = nc.blocks.Stats()
+	s.BlockSize = nc.blocks.Len()
+	return s
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestLRUCache_Evict(t *testing.T) {
+	c := newLRUCache(2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")
+	c.Add("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("b should be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("a should be cached")
+	}
+	hits, misses := c.Stats()
+	if hits != 2 || misses != 1 {
+		t.Errorf("unexpected stats: hits = %d, misses = %d", hits, misses)
+	}
+}
+
+func TestNodeCache_InvalidateBlock(t *testing.T) {
+	nc := newNodeCache(10, 10)
+
+	confirmed := gjson.Parse(`{"txid":"t1","blockhash":"b1"}`)
+	unconfirmed := gjson.Parse(`{"txid":"t2","blockhash":""}`)
+	nc.addTx("t1", &confirmed)
+	nc.addTx("t2", &unconfirmed)
+	nc.addBlock("b1", &cachedBlock{height: 100})
+
+	if _, ok := nc.getTx("t2", true); ok {
+		t.Errorf("unconfirmed tx should not be returned when confirmedOnly")
+	}
+	if _, ok := nc.getTx("t2", false); !ok {
+		t.Errorf("unconfirmed tx should be returned for previous output lookup")
+	}
+
+	nc.invalidateBlock("b1")
+
+	if _, ok := nc.getTx("t1", false); ok {
+		t.Errorf("tx of orphaned block should be invalidated")
+	}
+	if _, ok := nc.getBlock("b1"); ok {
+		t.Errorf("orphaned block should be invalidated")
+	}
+	if _, ok := nc.getTx("t2", false); !ok {
+		t.Errorf("tx not in orphaned block should be kept")
+	}
+}
+
+func TestClient_CachedTxConfirmations(t *testing.T) {
+
+	tip := 105
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"result":%d,"error":null,"id":"1"}`, tip)
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL, "", false)
+	raw := gjson.Parse(`{"txid":"t1","blockhash":"b1","confirmations":1}`)
+	c.cache.addTx("t1", &raw)
+	c.cache.addBlock("b1", &cachedBlock{height: 100})
+
+	//未记录节点高度时查询节点
+	trx, err := c.getTransaction("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trx.Confirmations != 6 {
+		t.Errorf("confirmations = %d, want 6", trx.Confirmations)
+	}
+
+	tip = 110
+	if _, err := c.getBlockHeight(); err != nil {
+		t.Fatal(err)
+	}
+	if trx, _ = c.getTransaction("t1"); trx.Confirmations != 11 {
+		t.Errorf("confirmations = %d, want 11", trx.Confirmations)
+	}
+
+	c.SetCacheSize(1, 1)
+	if _, ok := c.cache.getTx("t1", true); ok {
+		t.Errorf("cache should be cleared after resize")
+	}
+	c.cache.addBlock("b1", &cachedBlock{height: 100})
+	c.cache.addBlock("b2", &cachedBlock{height: 101})
+	if size := c.CacheStats().BlockSize; size != 1 {
+		t.Errorf("block cache size = %d, want 1", size)
+	}
+}
@@ -101,6 +101,56 @@ type WalletConfig struct {
 	MinFeeRate decimal.Decimal
 	//数据目录
 	DataDir string
+	//交易单缓存数量
+	TxCacheSize int
+	//区块缓存数量
+	BlockCacheSize int
+	//是否使用hsd websocket监听新区块和内存池交易
+	EnableSocket bool
+	//是否使用布隆过滤器，只接收关注地址的交易单，需要开启EnableSocket
+	EnableBloomFilter bool
+	//布隆过滤器的误报率
+	BloomFilterRate float64
+	//布隆过滤器误报率超过该值时重建
+	BloomFilterMaxRate float64
+	//保存的区块头数量，即可处理的最大分叉深度
+	HeaderWindowSize uint64
+	//交易单再次通知的确认数
+	ConfirmDepths []uint64
+	//最终确认数，达到后标记为最终状态，0为不启用确认数策略
+	FinalConfirmations uint64
+	//是否由扫描器维护关注地址的本地未花，ListUnspent直接读取本地未花
+	EnableLocalUnspent bool
+	//coinbase输出成熟需要的确认数
+	CoinbaseMaturity uint64
+	//关注名称过期预警提前的区块数，0为不预警
+	NameExpiryWarningBlocks uint64
+	//扫描器并发提取交易单的线程数
+	ExtractWorkers int
+	//落后节点多少个区块时进入追赶模式，并行预取区块，0为不启用
+	CatchUpThreshold uint64
+	//追赶模式预取区块的线程数
+	PrefetchWorkers int
+	//追赶模式最多预取的区块数
+	PrefetchWindow int
+	//重扫失败记录第一次重试的间隔，之后按指数增长
+	RetryBaseInterval time.Duration
+	//重扫失败记录重试间隔的上限
+	RetryMaxInterval time.Duration
+	//重扫失败记录最多重试次数，超过后移入死信队列
+	RetryMaxAttempts int
+	//关注的交易单在内存池停留超过该时间后离开，通知为过期
+	MempoolExpiry time.Duration
+	//扫描器指标服务的监听地址，为空不启用
+	MetricsListen string
+	//节点同步进度低于该值时视为未同步，0为不检查
+	SyncMinProgress float64
+	//节点区块头领先区块超过该数量时视为未同步，0为不检查
+	SyncMaxHeaderGap uint64
+	//节点最新区块距今超过该时间时视为未同步，0为不检查
+	SyncMaxTipAge time.Duration
+	//停止扫描器时等待进行中任务结束的最长时间
+	StopTimeout time.Duration
 }
 
 func NewConfig(symbol string, curveType uint32, decimals int32) *WalletConfig {
@@ -157,6 +207,34 @@ func NewConfig(symbol string, curveType uint32, decimals int32) *WalletConfig {
 	c.Decimals = decimals
 	//最低手续费
 	c.MinFeeRate = decimal.Zero
+	//交易单缓存数量
+	c.TxCacheSize = defaultTxCacheSize
+	//区块缓存数量
+	c.BlockCacheSize = defaultBlockCacheSize
+	//保存的区块头数量
+	c.HeaderWindowSize = defaultHeaderWindowSize
+	//coinbase输出成熟需要的确认数
+	c.CoinbaseMaturity = defaultCoinbaseMaturity
+	//关注名称过期预警提前的区块数
+	c.NameExpiryWarningBlocks = defaultNameExpiryWarningBlocks
+	//扫描器并发提取交易单的线程数
+	c.ExtractWorkers = defaultExtractWorkers
+	//追赶模式
+	c.CatchUpThreshold = defaultCatchUpThreshold
+	c.PrefetchWorkers = defaultPrefetchWorkers
+	c.PrefetchWindow = defaultPrefetchWindow
+	//重扫队列
+	c.RetryBaseInterval = defaultRetryBaseInterval
+	c.RetryMaxInterval = defaultRetryMaxInterval
+	c.RetryMaxAttempts = defaultRetryMaxAttempts
+	//内存池视图
+	c.MempoolExpiry = defaultMempoolExpiry
+	//节点同步检查
+	c.SyncMinProgress = defaultSyncMinProgress
+	c.SyncMaxHeaderGap = defaultSyncMaxHeaderGap
+	c.SyncMaxTipAge = defaultSyncMaxTipAge
+	//扫描器停止
+	c.StopTimeout = defaultStopTimeout
 
 	//创建目录
 	//file.MkdirAll(c.dbPath)
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/blocktree/go-owcrypt"
+	"github.com/blocktree/handshake-adapter/handshakeTransaction"
+)
+
+//契约类型，与hsd一致
+const (
+	CovenantNone     = uint64(0)
+	CovenantClaim    = uint64(1)
+	CovenantOpen     = uint64(2)
+	CovenantBid      = uint64(3)
+	CovenantReveal   = uint64(4)
+	CovenantRedeem   = uint64(5)
+	CovenantRegister = uint64(6)
+	CovenantUpdate   = uint64(7)
+	CovenantRenew    = uint64(8)
+	CovenantTransfer = uint64(9)
+	CovenantFinalize = uint64(10)
+	CovenantRevoke   = uint64(11)
+)
+
+//名称事件
+const (
+	NameEventClaimed         = "Claimed"         //认领保留名称
+	NameEventOpened          = "Opened"          //开启竞拍
+	NameEventBidPlaced       = "BidPlaced"       //出价
+	NameEventRevealed        = "Revealed"        //揭示出价
+	NameEventRedeemed        = "Redeemed"        //赎回未中标的出价
+	NameEventRegistered      = "Registered"      //中标后注册
+	NameEventUpdated         = "Updated"         //更新资源记录
+	NameEventRenewed         = "Renewed"         //续期
+	NameEventTransferStarted = "TransferStarted" //开始转移
+	NameEventFinalized       = "Finalized"       //完成转移
+	NameEventRevoked         = "Revoked"         //撤销
+	NameEventExpiring        = "Expiring"        //即将过期，关注名称的预警
+)
+
+var covenantEvents = map[uint64]string{
+	CovenantClaim:    NameEventClaimed,
+	CovenantOpen:     NameEventOpened,
+	CovenantBid:      NameEventBidPlaced,
+	CovenantReveal:   NameEventRevealed,
+	CovenantRedeem:   NameEventRedeemed,
+	CovenantRegister: NameEventRegistered,
+	CovenantUpdate:   NameEventUpdated,
+	CovenantRenew:    NameEventRenewed,
+	CovenantTransfer: NameEventTransferStarted,
+	CovenantFinalize: NameEventFinalized,
+	CovenantRevoke:   NameEventRevoked,
+}
+
+//NameEvent 输出契约解码后的名称事件
+type NameEvent struct {
+	Event             string `json:"event"`
+	Action            string `json:"action"`   //契约动作，例如BID
+	NameHash          string `json:"nameHash"` //名称哈希
+	Name              string `json:"name,omitempty"`
+	NameHeight        uint64 `json:"nameHeight"` //名称开启竞拍的高度
+	TxID              string `json:"txid"`
+	Index             uint64 `json:"index"`
+	Address           string `json:"address"` //输出地址
+	Value             string `json:"value"`   //输出数量，出价时为锁定数量
+	Blind             string `json:"blind,omitempty"`
+	Nonce             string `json:"nonce,omitempty"`
+	Data              string `json:"data,omitempty"`            //资源记录原始数据
+	TransferAddress   string `json:"transferAddress,omitempty"` //转移的目标地址
+	BlockHash         string `json:"blockHash"`
+	BlockHeight       uint64 `json:"blockHeight"`
+	ExpiryHeight      uint64 `json:"expiryHeight,omitempty"`      //过期的高度，过期预警时使用
+	BlocksUntilExpire int64  `json:"blocksUntilExpire,omitempty"` //距离过期的区块数，过期预警时使用
+}
+
+//NameHash 名称哈希，名称的sha3-256
+func NameHash(name string) string {
+	return hex.EncodeToString(owcrypt.Hash([]byte(name), 0, owcrypt.HASH_ALG_SHA3_256))
+}
+
+//covenantItem 契约参数，不存在时返回空
+func covenantItem(items []string, i int) string {
+	if i < len(items) {
+		return items[i]
+	}
+	return ""
+}
+
+//covenantName 契约参数中的原始名称
+func covenantName(item string) string {
+	raw, err := hex.DecodeString(item)
+	if err != nil {
+		return ""
+	}
+	return string(raw)
+}
+
+//covenantHeight 契约参数中的高度，u32小端序
+func covenantHeight(item string) uint64 {
+	raw, err := hex.DecodeString(item)
+	if err != nil || len(raw) != 4 {
+		return 0
+	}
+	return uint64(binary.LittleEndian.Uint32(raw))
+}
+
+//newNameEvent 解码输出的契约，不是名称契约时返回nil
+func newNameEvent(trx *Transaction, output *Vout) *NameEvent {
+
+	covenantType := output.CovenantType()
+	event, ok := covenantEvents[covenantType]
+	if !ok {
+		return nil
+	}
+
+	items := output.Items
+	e := &NameEvent{
+		Event:       event,
+		Action:      output.Action,
+		NameHash:    covenantItem(items, 0),
+		NameHeight:  covenantHeight(covenantItem(items, 1)),
+		TxID:        trx.TxID,
+		Index:       output.N,
+		Address:     output.Addr,
+		Value:       output.Value,
+		BlockHash:   trx.BlockHash,
+		BlockHeight: trx.BlockHeight,
+	}
+
+	switch covenantType {
+	case CovenantClaim, CovenantOpen, CovenantFinalize:
+		e.Name = covenantName(covenantItem(items, 2))
+	case CovenantBid:
+		e.Name = covenantName(covenantItem(items, 2))
+		e.Blind = covenantItem(items, 3)
+	case CovenantReveal:
+		e.Nonce = covenantItem(items, 2)
+	case CovenantRegister, CovenantUpdate:
+		e.Data = covenantItem(items, 2)
+	case CovenantTransfer:
+		hash, err := hex.DecodeString(covenantItem(items, 3))
+		if err == nil && covenantItem(items, 2) == "00" {
+			e.TransferAddress = handshakeTransaction.AddressEncode(hash)
+		}
+	}
+
+	return e
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/blocktree/handshake-adapter/handshakeTransaction"
+)
+
+func TestNewNameEvent(t *testing.T) {
+
+	const nameHash = "9fd7e0e8fd6e8d1e0e5bd4d7e2d2b0c5c0d3b5b3cf2b9d0c6b5a6e5f1c2d3e4f"
+	trx := &Transaction{TxID: "t1", BlockHash: "b1", BlockHeight: 2000}
+
+	bid := &Vout{
+		N:      1,
+		Addr:   "hs1qtsevyrskarucasazwgs7rk8stc36lky7wqrh5k",
+		Value:  "5",
+		Type:   "3",
+		Action: "BID",
+		Items:  []string{nameHash, "d2070000", hex.EncodeToString([]byte("example")), "aa"},
+	}
+	e := newNameEvent(trx, bid)
+	if e == nil {
+		t.Fatal("missing bid event")
+	}
+	if e.Event != NameEventBidPlaced || e.Name != "example" || e.NameHeight != 2002 || e.Blind != "aa" || e.NameHash != nameHash {
+		t.Errorf("unexpected bid event: %+v", e)
+	}
+
+	hash, _ := hex.DecodeString("b302960fb163255e3abf855babd47da1d819bb85")
+	transfer := &Vout{
+		N:      0,
+		Type:   "9",
+		Action: "TRANSFER",
+		Items:  []string{nameHash, "d2070000", "00", hex.EncodeToString(hash)},
+	}
+	e = newNameEvent(trx, transfer)
+	if e == nil || e.Event != NameEventTransferStarted {
+		t.Fatalf("unexpected transfer event: %+v", e)
+	}
+	if e.TransferAddress != handshakeTransaction.AddressEncode(hash) {
+		t.Errorf("transfer address = %s", e.TransferAddress)
+	}
+
+	if newNameEvent(trx, &Vout{Type: "0", Action: "NONE"}) != nil {
+		t.Error("plain output should not be a name event")
+	}
+}
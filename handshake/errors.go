@@ -0,0 +1,130 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//hsd RPC错误码
+const (
+	rpcErrParse             = -32700 //请求解析失败
+	rpcErrInvalidRequest    = -32600 //无效请求
+	rpcErrMethodNotFound    = -32601 //方法不存在
+	rpcErrInvalidParams     = -32602 //参数无效
+	rpcErrInternal          = -32603 //节点内部错误
+	rpcErrMisc              = -1     //其他错误，hsd的大部分校验错误
+	rpcErrType              = -3     //参数类型错误
+	rpcErrWallet            = -4     //钱包错误
+	rpcErrNotFound          = -5     //地址、交易单或区块不存在
+	rpcErrInsufficientFunds = -6     //钱包余额不足
+	rpcErrInvalidParameter  = -8     //参数错误
+	rpcErrClientNotConnect  = -9     //节点未连接网络
+	rpcErrDeserialization   = -22    //交易单无法解析
+	rpcErrVerify            = -25    //交易单校验失败
+	rpcErrVerifyRejected    = -26    //交易单被内存池拒绝
+	rpcErrVerifyAlreadyIn   = -27    //交易单已在链上
+	rpcErrClientInWarmup    = -28    //节点正在启动
+	rpcErrClientNodeAddress = -29    //节点无可用的连接
+)
+
+//rpcErrorCodeMap hsd错误码对应的openwallet错误码，未列出的错误码视为节点API调用失败
+var rpcErrorCodeMap = map[int64]uint64{
+	rpcErrMisc:              openwallet.ErrUnknownException,
+	rpcErrWallet:            openwallet.ErrUnknownException,
+	rpcErrInsufficientFunds: openwallet.ErrInsufficientBalanceOfAccount,
+	rpcErrDeserialization:   openwallet.ErrVerifyRawTransactionFailed,
+	rpcErrVerify:            openwallet.ErrSubmitRawTransactionFailed,
+	rpcErrVerifyRejected:    openwallet.ErrSubmitRawTransactionFailed,
+	rpcErrVerifyAlreadyIn:   openwallet.ErrSubmitRawTransactionFailed,
+}
+
+//RPCError 节点返回的错误
+type RPCError struct {
+	Method  string //调用的方法
+	Code    int64  //hsd错误码
+	Message string //错误信息
+}
+
+//Error 保持"[code]message"格式，与已保存的错误记录兼容
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("[%d]%s", e.Code, e.Message)
+}
+
+//OpenwalletCode 对应的openwallet错误码
+func (e *RPCError) OpenwalletCode() uint64 {
+	if code, ok := rpcErrorCodeMap[e.Code]; ok {
+		return code
+	}
+	return openwallet.ErrCallFullNodeAPIFailed
+}
+
+//IsNotFound 节点找不到请求的数据
+func (e *RPCError) IsNotFound() bool {
+	return e.Code == rpcErrNotFound
+}
+
+//IsTxNotFound 节点找不到请求的交易单
+func (e *RPCError) IsTxNotFound() bool {
+	return e.IsNotFound() && strings.Contains(strings.ToLower(e.Message), "transaction")
+}
+
+//AsRPCError 判断是否节点返回的错误
+func AsRPCError(err error) (*RPCError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	rpcErr, ok := err.(*RPCError)
+	return rpcErr, ok
+}
+
+var rpcErrorPattern = regexp.MustCompile(`^\[(-?\d+)\]([\s\S]*)$`)
+
+//ParseRPCError 解析已保存的"[code]message"格式错误信息，如重扫记录的原因
+func ParseRPCError(reason string) (*RPCError, bool) {
+	matches := rpcErrorPattern.FindStringSubmatch(reason)
+	if matches == nil {
+		return nil, false
+	}
+	code, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &RPCError{Code: code, Message: matches[2]}, true
+}
+
+//ConvertNodeError 节点调用的错误转为openwallet错误
+//节点返回的错误按错误码映射，其他错误视为网络请求失败
+func ConvertNodeError(err error) *openwallet.Error {
+	if err == nil {
+		return nil
+	}
+	if rpcErr, ok := AsRPCError(err); ok {
+		return openwallet.Errorf(rpcErr.OpenwalletCode(), "%s %s", rpcErr.Method, rpcErr.Error())
+	}
+	if owErr, ok := err.(*openwallet.Error); ok {
+		return owErr
+	}
+	if IsNodeNotSynced(err) {
+		return openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, "%v", err)
+	}
+	return openwallet.Errorf(openwallet.ErrNetworkRequestFailed, "%v", err)
+}
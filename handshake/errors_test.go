@@ -0,0 +1,49 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestParseRPCError(t *testing.T) {
+	rpcErr, ok := ParseRPCError("[-5]Transaction not found.")
+	if !ok || rpcErr.Code != -5 || !rpcErr.IsTxNotFound() {
+		t.Errorf("unexpected rpc error: %+v", rpcErr)
+	}
+	if _, ok := ParseRPCError("ExtractData Notify failed."); ok {
+		t.Errorf("reason without code should not be parsed")
+	}
+}
+
+func TestConvertNodeError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code uint64
+	}{
+		{&RPCError{Method: "sendtoaddress", Code: -6, Message: "Insufficient funds."}, openwallet.ErrInsufficientBalanceOfAccount},
+		{&RPCError{Method: "getblock", Code: -8, Message: "Block not found."}, openwallet.ErrCallFullNodeAPIFailed},
+		{errors.New("connection refused"), openwallet.ErrNetworkRequestFailed},
+	}
+	for _, test := range tests {
+		if code := ConvertNodeError(test.err).Code(); code != test.code {
+			t.Errorf("%v: unexpected code: %d", test.err, code)
+		}
+	}
+}
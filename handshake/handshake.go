@@ -27,6 +27,7 @@ import (
 	"github.com/shopspring/decimal"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 //初始化配置流程
@@ -623,6 +624,35 @@ func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	wm.Config.MinFeeRate, _ = decimal.NewFromString(c.String("minFeeRate"))
 	//wm.Config.MinFeeRate = wm.Config.MinFeeRate.Round(wm.Decimal())
 	wm.Config.DataDir = c.String("dataDir")
+	wm.Config.TxCacheSize = c.DefaultInt("txCacheSize", defaultTxCacheSize)
+	wm.Config.BlockCacheSize = c.DefaultInt("blockCacheSize", defaultBlockCacheSize)
+	wm.Config.EnableSocket = c.DefaultBool("enableSocket", false)
+	wm.Config.EnableBloomFilter = c.DefaultBool("enableBloomFilter", false)
+	wm.Config.BloomFilterRate = c.DefaultFloat("bloomFilterRate", defaultBloomFilterRate)
+	wm.Config.BloomFilterMaxRate = c.DefaultFloat("bloomFilterMaxRate", defaultBloomFilterMaxRate)
+	wm.Config.HeaderWindowSize = uint64(c.DefaultInt64("headerWindowSize", defaultHeaderWindowSize))
+	wm.Config.FinalConfirmations = uint64(c.DefaultInt64("finalConfirmations", 0))
+	confirmDepths, err := parseConfirmDepths(c.String("confirmDepths"))
+	if err != nil {
+		return err
+	}
+	wm.Config.ConfirmDepths = confirmDepths
+	wm.Config.EnableLocalUnspent = c.DefaultBool("enableLocalUnspent", false)
+	wm.Config.CoinbaseMaturity = uint64(c.DefaultInt64("coinbaseMaturity", defaultCoinbaseMaturity))
+	wm.Config.NameExpiryWarningBlocks = uint64(c.DefaultInt64("nameExpiryWarningBlocks", defaultNameExpiryWarningBlocks))
+	wm.Config.ExtractWorkers = c.DefaultInt("extractWorkers", defaultExtractWorkers)
+	wm.Config.CatchUpThreshold = uint64(c.DefaultInt64("catchUpThreshold", defaultCatchUpThreshold))
+	wm.Config.PrefetchWorkers = c.DefaultInt("prefetchWorkers", defaultPrefetchWorkers)
+	wm.Config.PrefetchWindow = c.DefaultInt("prefetchWindow", defaultPrefetchWindow)
+	wm.Config.RetryBaseInterval = time.Duration(c.DefaultInt64("retryBaseSeconds", int64(defaultRetryBaseInterval/time.Second))) * time.Second
+	wm.Config.RetryMaxInterval = time.Duration(c.DefaultInt64("retryMaxSeconds", int64(defaultRetryMaxInterval/time.Second))) * time.Second
+	wm.Config.RetryMaxAttempts = c.DefaultInt("retryMaxAttempts", defaultRetryMaxAttempts)
+	wm.Config.MempoolExpiry = time.Duration(c.DefaultInt64("mempoolExpirySeconds", int64(defaultMempoolExpiry/time.Second))) * time.Second
+	wm.Config.MetricsListen = c.String("metricsListen")
+	wm.Config.SyncMinProgress = c.DefaultFloat("syncMinProgress", defaultSyncMinProgress)
+	wm.Config.SyncMaxHeaderGap = uint64(c.DefaultInt64("syncMaxHeaderGap", defaultSyncMaxHeaderGap))
+	wm.Config.SyncMaxTipAge = time.Duration(c.DefaultInt64("syncMaxTipAgeSeconds", int64(defaultSyncMaxTipAge/time.Second))) * time.Second
+	wm.Config.StopTimeout = time.Duration(c.DefaultInt64("stopTimeoutSeconds", int64(defaultStopTimeout/time.Second))) * time.Second
 
 	//数据文件夹
 	wm.Config.makeDataDir()
@@ -630,6 +660,11 @@ func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	token := BasicAuth(wm.Config.RpcUser, wm.Config.RpcPassword)
 
 	wm.NodeClient = NewClient(wm.Config.NodeAPI, token, false)
+	wm.NodeClient.SetCacheSize(wm.Config.TxCacheSize, wm.Config.BlockCacheSize)
+
+	if wm.Blockscanner != nil {
+		wm.Blockscanner.addrFilter.setRate(wm.Config.BloomFilterRate, wm.Config.BloomFilterMaxRate)
+	}
 
 	return nil
 }
@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/asdine/storm/q"
@@ -53,10 +54,12 @@ type WalletManager struct {
 	Config          *WalletConfig                 //钱包管理配置
 	WalletsInSum    map[string]*openwallet.Wallet //参与汇总的钱包
 	Blockscanner    *HNSBlockScanner              //区块扫描器
-	Decoder         *AddressDecoderV2                //地址编码器
+	Decoder         *AddressDecoderV2             //地址编码器
 	TxDecoder       openwallet.TransactionDecoder //交易单编码器
 	Log             *log.OWLogger                 //日志工具
 	ContractDecoder *ContractDecoder              //智能合约解析器
+	syncState       *NodeSyncState                //最近一次检查的节点同步状态
+	syncMu          sync.Mutex
 }
 
 func NewWalletManager() *WalletManager {
@@ -972,7 +975,8 @@ func (wm *WalletManager) ImportWallet(filename string) error {
 //GetBlockChainInfo 获取钱包区块链信息
 func (wm *WalletManager) GetBlockChainInfo() (*BlockchainInfo, error) {
 
-	result, err := wm.NodeClient.Call("getblockchaininfo", nil)
+	//参数为nil时会以GET请求
+	result, err := wm.NodeClient.Call("getblockchaininfo", []interface{}{})
 	if err != nil {
 		return nil, err
 	}
@@ -984,8 +988,47 @@ func (wm *WalletManager) GetBlockChainInfo() (*BlockchainInfo, error) {
 }
 
 //ListUnspent 获取未花记录
+//min为最少确认数，未成熟的coinbase输出不返回
 func (wm *WalletManager) ListUnspent(min uint64, addresses ...string) ([]*Unspent, error) {
 
+	var (
+		utxos []*Unspent
+		err   error
+	)
+
+	//开启本地未花时，直接读取扫描器维护的未花集合
+	if wm.Config.EnableLocalUnspent && wm.Blockscanner != nil {
+		utxos, err = wm.Blockscanner.listUnspentFromLocal(addresses...)
+	} else {
+		utxos, err = wm.listUnspentFromNode(addresses...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(utxos) == 0 {
+		return utxos, nil
+	}
+
+	tip, err := wm.chainTipHeight()
+	if err != nil {
+		return nil, err
+	}
+	setUnspentConfirmations(utxos, tip)
+
+	spendable := make([]*Unspent, 0, len(utxos))
+	for _, utxo := range utxos {
+		if utxo.Confirmations < min || wm.isImmature(utxo) {
+			continue
+		}
+		spendable = append(spendable, utxo)
+	}
+	return spendable, nil
+}
+
+//listUnspentFromNode 分批向节点查询地址的未花
+func (wm *WalletManager) listUnspentFromNode(addresses ...string) ([]*Unspent, error) {
+
 	//:分页限制
 
 	var (
@@ -1242,7 +1285,14 @@ func (wm *WalletManager) SignRawTransactionInCoreWallet(txHex, walletID string,
 //SendRawTransaction 广播交易
 func (wm *WalletManager) SendRawTransaction(txHex string) (string, error) {
 
-	return wm.NodeClient.sendTransaction(txHex)
+	result := wm.BroadcastTransaction(txHex)
+	if err := result.Err(); err != nil {
+		return "", err
+	}
+	if result.AlreadyKnown {
+		wm.Log.Std.Info("transaction: %s already known by node", result.TxID)
+	}
+	return result.TxID, nil
 }
 
 //SendTransaction 发送交易
@@ -0,0 +1,345 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	扫描器指标：
+	配置metricsListen后，扫描器运行时在该地址的/metrics以Prometheus文本格式输出指标，
+	包括本地和节点高度、节点同步状态、扫描速度、交易单提取耗时、节点RPC按方法的请求和错误数、
+	重扫队列和死信数量、内存池大小和扫描器状态。
+	/health输出扫描器状态，运行中返回200，否则返回503，用于健康检查。
+*/
+
+const (
+	metricsRateWindow = time.Minute //计算扫描速度的时间窗口
+)
+
+//extractDurationBuckets 交易单提取耗时的直方图区间，秒
+var extractDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//RPCMethodStats 节点RPC方法的调用统计
+type RPCMethodStats struct {
+	Requests uint64
+	Errors   uint64
+}
+
+//rpcStats 节点RPC按方法的调用统计
+type rpcStats struct {
+	mu      sync.Mutex
+	methods map[string]*RPCMethodStats
+}
+
+//newRPCStats 创建RPC统计
+func newRPCStats() *rpcStats {
+	return &rpcStats{methods: make(map[string]*RPCMethodStats)}
+}
+
+//record 记录一次调用
+func (s *rpcStats) record(method string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.methods[method]
+	if !ok {
+		m = &RPCMethodStats{}
+		s.methods[method] = m
+	}
+	m.Requests++
+	if err != nil {
+		m.Errors++
+	}
+}
+
+//snapshot 复制当前统计
+func (s *rpcStats) snapshot() map[string]RPCMethodStats {
+	stats := make(map[string]RPCMethodStats)
+	if s == nil {
+		return stats
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for method, m := range s.methods {
+		stats[method] = *m
+	}
+	return stats
+}
+
+//scannerMetrics 扫描器运行指标
+type scannerMetrics struct {
+	mu             sync.Mutex
+	blocksScanned  uint64
+	blockTimes     []time.Time //时间窗口内扫描完成的区块
+	extractBuckets []uint64    //各区间的提取次数，不累计
+	extractCount   uint64
+	extractSum     float64
+	mempoolSize    int64
+}
+
+//newScannerMetrics 创建扫描器指标
+func newScannerMetrics() *scannerMetrics {
+	return &scannerMetrics{extractBuckets: make([]uint64, len(extractDurationBuckets))}
+}
+
+//blockScanned 完成一个区块
+func (m *scannerMetrics) blockScanned() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.blocksScanned++
+	m.blockTimes = append(m.pruneBlockTimes(now), now)
+}
+
+//pruneBlockTimes 删除时间窗口外的区块
+func (m *scannerMetrics) pruneBlockTimes(now time.Time) []time.Time {
+	start := now.Add(-metricsRateWindow)
+	i := 0
+	for i < len(m.blockTimes) && m.blockTimes[i].Before(start) {
+		i++
+	}
+	return m.blockTimes[i:]
+}
+
+//blocksPerSecond 时间窗口内的扫描速度
+func (m *scannerMetrics) blocksPerSecond() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blockTimes = m.pruneBlockTimes(time.Now())
+	return float64(len(m.blockTimes)) / metricsRateWindow.Seconds()
+}
+
+//observeExtract 记录一次交易单提取的耗时
+func (m *scannerMetrics) observeExtract(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := d.Seconds()
+	m.extractCount++
+	m.extractSum += seconds
+	for i, le := range extractDurationBuckets {
+		if seconds <= le {
+			m.extractBuckets[i]++
+			break
+		}
+	}
+}
+
+//setMempoolSize 最近一次扫描的内存池交易单数
+func (m *scannerMetrics) setMempoolSize(size int) {
+	atomic.StoreInt64(&m.mempoolSize, int64(size))
+}
+
+//metricsWriter 输出Prometheus文本格式
+type metricsWriter struct {
+	w io.Writer
+}
+
+//header 指标的说明和类型
+func (mw *metricsWriter) header(name, help, metricType string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+//value 输出一个值，labels为name=value成对的标签
+func (mw *metricsWriter) value(name string, v float64, labels ...string) {
+	fmt.Fprint(mw.w, name)
+	if len(labels) > 0 {
+		fmt.Fprint(mw.w, "{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				fmt.Fprint(mw.w, ",")
+			}
+			fmt.Fprintf(mw.w, "%s=%s", labels[i], strconv.Quote(labels[i+1]))
+		}
+		fmt.Fprint(mw.w, "}")
+	}
+	fmt.Fprintf(mw.w, " %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+//gauge 输出单个值的指标
+func (mw *metricsWriter) gauge(name, help string, v float64) {
+	mw.header(name, help, "gauge")
+	mw.value(name, v)
+}
+
+//WriteMetrics 以Prometheus文本格式输出扫描器指标
+func (bs *HNSBlockScanner) WriteMetrics(w io.Writer) {
+
+	mw := &metricsWriter{w: w}
+	m := bs.metrics
+
+	localHeight := bs.GetScannedBlockHeight()
+	nodeHeight := atomic.LoadUint64(&bs.tipHeight)
+	lag := uint64(0)
+	if nodeHeight > localHeight {
+		lag = nodeHeight - localHeight
+	}
+
+	mw.gauge("hns_scanner_local_height", "Height of the last scanned block.", float64(localHeight))
+	mw.gauge("hns_scanner_node_height", "Latest block height reported by the node.", float64(nodeHeight))
+	mw.gauge("hns_scanner_lag_blocks", "Blocks between the node tip and the scanner.", float64(lag))
+
+	current := bs.State()
+	mw.header("hns_scanner_state", "Lifecycle state of the scanner, 1 for the current state.", "gauge")
+	for _, state := range scannerStates {
+		v := 0.0
+		if state == current {
+			v = 1
+		}
+		mw.value("hns_scanner_state", v, "state", state)
+	}
+
+	if state := bs.wm.LastNodeSyncState(); state != nil {
+		synced := 0.0
+		if state.Synced {
+			synced = 1
+		}
+		mw.gauge("hns_node_synced", "Whether the node passed the last sync check.", synced)
+		mw.gauge("hns_node_verification_progress", "Node verification progress at the last sync check.", state.Progress)
+		mw.gauge("hns_node_header_gap", "Headers the node has not yet connected as blocks.", float64(state.HeaderGap()))
+		if state.TipTime > 0 {
+			mw.gauge("hns_node_tip_age_seconds", "Age of the node tip block at the last sync check.", state.TipAge.Seconds())
+		}
+	}
+
+	m.mu.Lock()
+	blocksScanned := m.blocksScanned
+	extractBuckets := append([]uint64(nil), m.extractBuckets...)
+	extractCount, extractSum := m.extractCount, m.extractSum
+	m.mu.Unlock()
+
+	mw.header("hns_scanner_blocks_scanned_total", "Blocks scanned since the scanner started.", "counter")
+	mw.value("hns_scanner_blocks_scanned_total", float64(blocksScanned))
+	mw.gauge("hns_scanner_blocks_per_second", "Blocks scanned per second over the last minute.", m.blocksPerSecond())
+
+	name := "hns_scanner_extract_duration_seconds"
+	mw.header(name, "Time to extract a transaction.", "histogram")
+	cumulative := uint64(0)
+	for i, le := range extractDurationBuckets {
+		cumulative += extractBuckets[i]
+		mw.value(name+"_bucket", float64(cumulative), "le", strconv.FormatFloat(le, 'g', -1, 64))
+	}
+	mw.value(name+"_bucket", float64(extractCount), "le", "+Inf")
+	mw.value(name+"_sum", extractSum)
+	mw.value(name+"_count", float64(extractCount))
+
+	rpc := bs.wm.NodeClient.RPCStats()
+	methods := make([]string, 0, len(rpc))
+	for method := range rpc {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	mw.header("hns_node_rpc_requests_total", "Node RPC requests by method.", "counter")
+	for _, method := range methods {
+		mw.value("hns_node_rpc_requests_total", float64(rpc[method].Requests), "method", method)
+	}
+	mw.header("hns_node_rpc_errors_total", "Node RPC errors by method.", "counter")
+	for _, method := range methods {
+		mw.value("hns_node_rpc_errors_total", float64(rpc[method].Errors), "method", method)
+	}
+
+	if queue, err := bs.GetRetryQueue(); err == nil {
+		mw.gauge("hns_scanner_retry_queue_items", "Failed blocks and transactions waiting to be retried.", float64(len(queue)))
+	}
+	if dead, err := bs.GetDeadLetters(); err == nil {
+		mw.gauge("hns_scanner_dead_letter_items", "Failed blocks and transactions moved to the dead-letter list.", float64(len(dead)))
+	}
+
+	mw.gauge("hns_mempool_size", "Transactions in the node mempool at the last mempool scan.", float64(atomic.LoadInt64(&m.mempoolSize)))
+	if bs.hasHNSMempoolObservers() {
+		if view, err := bs.GetMempoolView(); err == nil {
+			mw.gauge("hns_mempool_watched_txs", "Watched transactions in the mempool view.", float64(len(view)))
+		}
+	}
+}
+
+//serveMetrics 输出/metrics
+func (bs *HNSBlockScanner) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	bs.WriteMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+//serveHealth 输出/health，扫描器运行中返回200，否则返回503
+func (bs *HNSBlockScanner) serveHealth(w http.ResponseWriter, r *http.Request) {
+	state := bs.State()
+	w.Header().Set("Content-Type", "text/plain")
+	if state != ScannerStateRunning {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, state)
+}
+
+//startMetricsServer 配置了metricsListen时启动指标服务
+func (bs *HNSBlockScanner) startMetricsServer() error {
+
+	addr := bs.wm.Config.MetricsListen
+	if len(addr) == 0 {
+		return nil
+	}
+
+	bs.metricsMu.Lock()
+	defer bs.metricsMu.Unlock()
+
+	if bs.metricsServer != nil {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", bs.serveMetrics)
+	mux.HandleFunc("/health", bs.serveHealth)
+	server := &http.Server{Handler: mux}
+	bs.metricsServer = server
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			bs.wm.Log.Std.Error("metrics server unexpected error: %v", err)
+		}
+	}()
+
+	bs.wm.Log.Std.Info("metrics server listening on %s", listener.Addr().String())
+
+	return nil
+}
+
+//stopMetricsServer 关闭指标服务
+func (bs *HNSBlockScanner) stopMetricsServer() {
+	bs.metricsMu.Lock()
+	defer bs.metricsMu.Unlock()
+
+	if bs.metricsServer != nil {
+		bs.metricsServer.Close()
+		bs.metricsServer = nil
+	}
+}
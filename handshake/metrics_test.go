@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestWriteMetrics(t *testing.T) {
+
+	server := newTestChainServer()
+	defer server.Close()
+
+	wm, cleanup := newTestScannerWallet(t, server.URL)
+	defer cleanup()
+	bs := wm.Blockscanner
+
+	wm.GetBlockHash(10)
+	wm.GetBlockHash(11)
+	wm.GetTxOut("t1", 0)
+	bs.setTipHeight(120)
+	bs.metrics.blockScanned()
+	bs.metrics.observeExtract(20 * time.Millisecond)
+	bs.metrics.setMempoolSize(7)
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(99, "t2", "connection refused", wm.Symbol()))
+
+	rec := httptest.NewRecorder()
+	bs.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"hns_scanner_local_height 0",
+		"hns_scanner_node_height 120",
+		"hns_scanner_lag_blocks 120",
+		"hns_scanner_blocks_scanned_total 1",
+		`hns_scanner_extract_duration_seconds_bucket{le="0.01"} 0`,
+		`hns_scanner_extract_duration_seconds_bucket{le="0.025"} 1`,
+		`hns_scanner_extract_duration_seconds_bucket{le="+Inf"} 1`,
+		"hns_scanner_extract_duration_seconds_count 1",
+		`hns_node_rpc_requests_total{method="getblockhash"} 2`,
+		`hns_node_rpc_errors_total{method="getblockhash"} 0`,
+		"hns_scanner_retry_queue_items 1",
+		"hns_scanner_dead_letter_items 0",
+		"hns_mempool_size 7",
+		"# TYPE hns_scanner_blocks_scanned_total counter",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %q", line)
+		}
+	}
+	//节点找不到交易单
+	if !strings.Contains(body, `hns_node_rpc_errors_total{method="getrawtransaction"}`) || strings.Contains(body, `hns_node_rpc_errors_total{method="getrawtransaction"} 0`) {
+		t.Error("rpc errors not counted")
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
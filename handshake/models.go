@@ -17,11 +17,13 @@ package handshake
 
 import (
 	"encoding/hex"
+	"errors"
 	"github.com/blocktree/handshake-adapter/handshakeTransaction"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/shopspring/decimal"
 	"github.com/tidwall/gjson"
+	"strconv"
 	"strings"
 )
 
@@ -77,6 +79,8 @@ type Unspent struct {
 	ScriptPubKey  string `json:"scriptPubKey"`
 	Amount        string `json:"amount"`
 	Confirmations uint64 `json:"confirmations"`
+	Height        uint64 `json:"height"`
+	Coinbase      bool   `json:"coinbase"`
 	Type          uint64 `json:"type"`
 	Action        string `json:"action"`
 	Spendable     bool   `json:"spendable"`
@@ -117,6 +121,11 @@ func NewUnspent(json *gjson.Result) *Unspent {
 
 	obj.Amount = amountDecimal.Div(div).String()
 	//obj.Confirmations = gjson.Get(json.Raw, "confirmations").Uint()
+	//内存池的未花高度为-1，确认数由最新高度计算
+	if height := gjson.Get(json.Raw, "height").Int(); height > 0 {
+		obj.Height = uint64(height)
+	}
+	obj.Coinbase = gjson.Get(json.Raw, "coinbase").Bool()
 	//obj.Spendable = gjson.Get(json.Raw, "spendable").Bool()
 	obj.Type = gjson.Get(json.Raw, "covenant").Get("type").Uint()
 	obj.Action = gjson.Get(json.Raw, "covenant").Get("action").String()
@@ -190,41 +199,17 @@ type Block struct {
 	Version           uint64
 	Time              uint64
 	Fork              bool
+	Partial           bool     //部分交易单获取失败，通知区块观测者的交易单不完整
+	MissingTxs        []string //获取失败的交易单
 	txDetails         []*Transaction
 	isVerbose         bool
 }
 
 func (wm *WalletManager) NewBlock(json *gjson.Result) *Block {
-	obj := &Block{}
-	//解析json
-	obj.Height = gjson.Get(json.Raw, "height").Uint()
-	obj.Hash = gjson.Get(json.Raw, "hash").String()
-	obj.Confirmations = gjson.Get(json.Raw, "confirmations").Uint()
-	obj.Merkleroot = gjson.Get(json.Raw, "merkleroot").String()
-	obj.Previousblockhash = gjson.Get(json.Raw, "previousblockhash").String()
-	obj.Version = gjson.Get(json.Raw, "version").Uint()
-	obj.Time = gjson.Get(json.Raw, "time").Uint()
-
-	txs := make([]string, 0)
-	txDetails := make([]*Transaction, 0)
-	for _, tx := range gjson.Get(json.Raw, "tx").Array() {
-		if tx.IsObject() {
-			obj.isVerbose = true
-			txObj := wm.newTxByCore(&tx)
-			txObj.BlockHeight = obj.Height
-			txObj.BlockHash = obj.Hash
-			txObj.Blocktime = int64(obj.Time)
-			txDetails = append(txDetails, txObj)
-		} else {
-			obj.isVerbose = false
-			txs = append(txs, tx.String())
-		}
-
+	obj := newBlock(json)
+	for _, tx := range obj.txDetails {
+		tx.Decimals = wm.Decimal()
 	}
-
-	obj.tx = txs
-	obj.txDetails = txDetails
-
 	return obj
 }
 
@@ -272,6 +257,11 @@ type Vin struct {
 	Value    string
 }
 
+//IsCoinbase 是否coinbase交易单的输入，包括空投和域名认领，没有上一笔输出
+func (v *Vin) IsCoinbase() bool {
+	return v.Coinbase == "true"
+}
+
 type Vout struct {
 	N            uint64
 	Addr         string
@@ -279,6 +269,13 @@ type Vout struct {
 	ScriptPubKey string
 	Type         string
 	Action       string
+	Items        []string //契约参数，hex
+}
+
+//CovenantType 契约类型
+func (v *Vout) CovenantType() uint64 {
+	t, _ := strconv.ParseUint(v.Type, 10, 64)
+	return t
 }
 
 func (wm *WalletManager) newTxByCore(json *gjson.Result) *Transaction {
@@ -448,21 +445,84 @@ func newBlock(json *gjson.Result) *Block {
 	obj.Hash = gjson.Get(json.Raw, "hash").String()
 	obj.Confirmations = gjson.Get(json.Raw, "confirmations").Uint()
 	obj.Merkleroot = gjson.Get(json.Raw, "merkleroot").String()
+	obj.Previousblockhash = gjson.Get(json.Raw, "previousblockhash").String()
+	obj.Height = gjson.Get(json.Raw, "height").Uint()
+	obj.Version = gjson.Get(json.Raw, "version").Uint()
+	obj.Time = gjson.Get(json.Raw, "time").Uint()
 
+	//details = 1 时，tx为交易单对象数组
 	txs := make([]string, 0)
+	txDetails := make([]*Transaction, 0)
 	for _, tx := range gjson.Get(json.Raw, "tx").Array() {
-		txs = append(txs, tx.String())
+		if tx.IsObject() {
+			obj.isVerbose = true
+			txObj, err := newBlockTx(&tx)
+			if err != nil {
+				//解析失败的交易单，通过txid逐笔查询
+				txs = append(txs, tx.Get("txid").String())
+				continue
+			}
+			txObj.BlockHeight = obj.Height
+			txObj.BlockHash = obj.Hash
+			txObj.Blocktime = int64(obj.Time)
+			txDetails = append(txDetails, txObj)
+		} else {
+			txs = append(txs, tx.String())
+		}
 	}
 
 	obj.tx = txs
-	obj.Previousblockhash = gjson.Get(json.Raw, "previousblockhash").String()
-	obj.Height = gjson.Get(json.Raw, "height").Uint()
-	//obj.Version = gjson.Get(json.Raw, "version").String()
-	obj.Time = gjson.Get(json.Raw, "time").Uint()
+	obj.txDetails = txDetails
 
 	return obj
 }
 
+//newBlockTx 解析区块内的交易单详情，输入的地址和数量留待提取时追溯
+func newBlockTx(json *gjson.Result) (*Transaction, error) {
+
+	obj := Transaction{}
+	//解析json
+	obj.TxID = gjson.Get(json.Raw, "txid").String()
+	if len(obj.TxID) == 0 {
+		return nil, errors.New("transaction txid is empty")
+	}
+	obj.Version = gjson.Get(json.Raw, "version").Uint()
+	obj.LockTime = gjson.Get(json.Raw, "locktime").Int()
+	obj.Confirmations = gjson.Get(json.Raw, "confirmations").Uint()
+	obj.Size = gjson.Get(json.Raw, "size").Uint()
+
+	obj.Vins = make([]*Vin, 0)
+	if vins := gjson.Get(json.Raw, "vin"); vins.IsArray() {
+		for i, vin := range vins.Array() {
+			if vin.Get("coinbase").Bool() {
+				obj.IsCoinBase = true
+				obj.Vins = append(obj.Vins, &Vin{Coinbase: "true", N: uint64(i)})
+				continue
+			}
+			obj.Vins = append(obj.Vins, &Vin{
+				TxID: vin.Get("txid").String(),
+				Vout: vin.Get("vout").Uint(),
+				N:    uint64(i),
+			})
+		}
+	}
+
+	obj.Vouts = make([]*Vout, 0)
+	if vouts := gjson.Get(json.Raw, "vout"); vouts.IsArray() {
+		for _, vout := range vouts.Array() {
+			output, err := newTxVout(&vout)
+			if err != nil {
+				return nil, err
+			}
+			if output != nil {
+				obj.Vouts = append(obj.Vouts, output)
+			}
+		}
+	}
+
+	return &obj, nil
+}
+
 func (c Client) newTx(json *gjson.Result) (*Transaction, error) {
 	/*
 
@@ -490,11 +550,11 @@ func (c Client) newTx(json *gjson.Result) (*Transaction, error) {
 	obj.LockTime = gjson.Get(json.Raw, "locktime").Int()
 	obj.BlockHash = gjson.Get(json.Raw, "blockhash").String()
 	if obj.BlockHash != "" {
-		block, err := c.getBlock(obj.BlockHash)
+		height, err := c.getBlockHeightByHash(obj.BlockHash)
 		if err != nil {
 			return &Transaction{}, err
 		}
-		obj.BlockHeight = block.Height
+		obj.BlockHeight = height
 	}
 
 	obj.Confirmations = gjson.Get(json.Raw, "confirmations").Uint()
@@ -503,9 +563,11 @@ func (c Client) newTx(json *gjson.Result) (*Transaction, error) {
 
 	obj.Vins = make([]*Vin, 0)
 	if vins := gjson.Get(json.Raw, "vin"); vins.IsArray() {
-		for _, vin := range vins.Array() {
-			if vin.Get("coinbase").String() == "true" {
-				break
+		for i, vin := range vins.Array() {
+			if vin.Get("coinbase").Bool() {
+				obj.IsCoinBase = true
+				obj.Vins = append(obj.Vins, &Vin{Coinbase: "true", N: uint64(i)})
+				continue
 			}
 			input, err := c.newTxVin(&vin)
 			if err != nil {
@@ -591,6 +653,9 @@ func newTxVout(json *gjson.Result) (*Vout, error) {
 	obj.Addr = handshakeTransaction.AddressEncode(hash)
 	obj.Type = gjson.Get(json.Raw, "covenant").Get("type").String()
 	obj.Action = gjson.Get(json.Raw, "covenant").Get("action").String()
+	for _, item := range gjson.Get(json.Raw, "covenant.items").Array() {
+		obj.Items = append(obj.Items, item.String())
+	}
 
 	return &obj, nil
 }
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestNewBlock_Details(t *testing.T) {
+	json := gjson.Parse(`{
+		"hash": "b1",
+		"height": 100,
+		"time": 1584030329,
+		"tx": [
+			{
+				"txid": "t1",
+				"vin": [{"coinbase": true, "txid": "0000", "vout": 4294967295}],
+				"vout": [{"value": 2000, "n": 0, "address": {"version": 0, "hash": "b302960fb163255e3abf855babd47da1d819bb85"}, "covenant": {"type": 0, "action": "NONE"}}]
+			},
+			{
+				"txid": "t2",
+				"vin": [{"coinbase": false, "txid": "t0", "vout": 1}],
+				"vout": []
+			},
+			{
+				"vin": []
+			}
+		]
+	}`)
+
+	block := newBlock(&json)
+	if !block.isVerbose {
+		t.Fatalf("block should be verbose")
+	}
+	if len(block.txDetails) != 2 {
+		t.Fatalf("unexpected txDetails: %d", len(block.txDetails))
+	}
+	if len(block.tx) != 1 {
+		t.Errorf("unparsed tx should fall back to txid list, got %d", len(block.tx))
+	}
+
+	coinbase := block.txDetails[0]
+	if !coinbase.IsCoinBase || len(coinbase.Vins) != 1 || !coinbase.Vins[0].IsCoinbase() || len(coinbase.Vouts) != 1 || coinbase.BlockHeight != 100 || coinbase.BlockHash != "b1" {
+		t.Errorf("unexpected coinbase tx: %+v", coinbase)
+	}
+
+	spend := block.txDetails[1]
+	if len(spend.Vins) != 1 || spend.Vins[0].TxID != "t0" || spend.Vins[0].Vout != 1 {
+		t.Errorf("unexpected tx input: %+v", spend.Vins)
+	}
+}
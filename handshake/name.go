@@ -0,0 +1,320 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"github.com/shopspring/decimal"
+	"github.com/tidwall/gjson"
+)
+
+//名称的竞拍状态
+const (
+	NameStateOpening = "OPENING" //开启竞拍，等待进入出价期
+	NameStateBidding = "BIDDING" //出价期
+	NameStateReveal  = "REVEAL"  //揭示期
+	NameStateClosed  = "CLOSED"  //竞拍结束，名称已有所有者
+	NameStateRevoked = "REVOKED" //名称已被撤销
+)
+
+//NameOutpoint 名称所有者的输出
+type NameOutpoint struct {
+	TxID  string
+	Index uint64
+}
+
+//NameInfo 名称状态
+type NameInfo struct {
+	Name              string
+	NameHash          string
+	State             string        //竞拍状态，名称未开启竞拍时为空
+	Reserved          bool          //是否保留名称
+	StartHeight       uint64        //名称可以开启竞拍的高度
+	Height            uint64        //开启竞拍的高度
+	Renewal           uint64        //最近续期的高度
+	Owner             *NameOutpoint //当前所有者的输出
+	Value             string        //竞拍成交价
+	Highest           string        //最高出价
+	Data              string        //资源记录原始数据
+	Transfer          uint64        //转移开始的高度
+	Revoked           uint64        //撤销的高度
+	Claimed           uint64        //认领的高度
+	Renewals          uint64        //续期次数
+	Registered        bool          //是否已注册
+	Expired           bool          //是否已过期
+	Weak              bool          //是否弱认领
+	ExpiryHeight      uint64        //过期的高度
+	BlocksUntilExpire int64         //距离过期的区块数
+}
+
+//Available 名称未开启竞拍或已过期，可以开启竞拍
+func (info *NameInfo) Available() bool {
+	return len(info.State) == 0 || info.Expired
+}
+
+//NameRecord 名称资源记录
+type NameRecord struct {
+	Type       string   //记录类型：DS，NS，GLUE4，GLUE6，SYNTH4，SYNTH6，TXT
+	NS         string   //域名服务器
+	Address    string   //IP地址
+	TXT        []string //文本
+	KeyTag     uint64
+	Algorithm  uint64
+	DigestType uint64
+	Digest     string
+}
+
+//NameResource 名称资源
+type NameResource struct {
+	Records []*NameRecord
+}
+
+//newNameInfo 解析getnameinfo的结果，decimals用于转换金额
+func newNameInfo(name string, json *gjson.Result, decimals int32) *NameInfo {
+
+	/*
+		{
+			"start": {
+				"reserved": false,
+				"week": 20,
+				"start": 3024
+			},
+			"info": {
+				"name": "handshake",
+				"nameHash": "3aa2528576f96bd40fcff35f2f9b5b0a1aa6bd8c2d6f9d4e8e0c3a0a8a0b1c2d",
+				"state": "CLOSED",
+				"height": 2987,
+				"renewal": 2987,
+				"owner": {
+					"hash": "f3b3e4e1ea1b1b9bd1e9c5c5b5c5d5e5f5a5b5c5d5e5f5a5b5c5d5e5f5a5b5c5",
+					"index": 0
+				},
+				"value": 1000000,
+				"highest": 2000000,
+				"data": "0006018e6e73310b68616e647368616b650000",
+				"transfer": 0,
+				"revoked": 0,
+				"claimed": 0,
+				"renewals": 0,
+				"registered": true,
+				"expired": false,
+				"weak": false,
+				"stats": {
+					"renewalPeriodStart": 2987,
+					"renewalPeriodEnd": 108107,
+					"blocksUntilExpire": 105120,
+					"daysUntilExpire": 730
+				}
+			}
+		}
+	*/
+
+	obj := &NameInfo{}
+	obj.Name = name
+	obj.Reserved = gjson.Get(json.Raw, "start.reserved").Bool()
+	obj.StartHeight = gjson.Get(json.Raw, "start.start").Uint()
+
+	info := gjson.Get(json.Raw, "info")
+	if !info.IsObject() {
+		//名称未开启竞拍
+		return obj
+	}
+
+	obj.Name = info.Get("name").String()
+	obj.NameHash = info.Get("nameHash").String()
+	obj.State = info.Get("state").String()
+	obj.Height = info.Get("height").Uint()
+	obj.Renewal = info.Get("renewal").Uint()
+	if owner := info.Get("owner"); owner.IsObject() {
+		obj.Owner = &NameOutpoint{
+			TxID:  owner.Get("hash").String(),
+			Index: owner.Get("index").Uint(),
+		}
+	}
+	obj.Value = decimal.New(info.Get("value").Int(), -decimals).String()
+	obj.Highest = decimal.New(info.Get("highest").Int(), -decimals).String()
+	obj.Data = info.Get("data").String()
+	obj.Transfer = info.Get("transfer").Uint()
+	obj.Revoked = info.Get("revoked").Uint()
+	obj.Claimed = info.Get("claimed").Uint()
+	obj.Renewals = info.Get("renewals").Uint()
+	obj.Registered = info.Get("registered").Bool()
+	obj.Expired = info.Get("expired").Bool()
+	obj.Weak = info.Get("weak").Bool()
+	obj.ExpiryHeight = info.Get("stats.renewalPeriodEnd").Uint()
+	obj.BlocksUntilExpire = info.Get("stats.blocksUntilExpire").Int()
+
+	return obj
+}
+
+//newNameResource 解析getnameresource的结果
+func newNameResource(json *gjson.Result) *NameResource {
+
+	/*
+		{
+			"records": [
+				{
+					"type": "NS",
+					"ns": "ns1.handshake."
+				},
+				{
+					"type": "GLUE4",
+					"ns": "ns1.handshake.",
+					"address": "10.0.0.1"
+				},
+				{
+					"type": "TXT",
+					"txt": ["hello"]
+				}
+			]
+		}
+	*/
+
+	obj := &NameResource{
+		Records: make([]*NameRecord, 0),
+	}
+
+	for _, r := range gjson.Get(json.Raw, "records").Array() {
+		record := &NameRecord{
+			Type:       r.Get("type").String(),
+			NS:         r.Get("ns").String(),
+			Address:    r.Get("address").String(),
+			KeyTag:     r.Get("keyTag").Uint(),
+			Algorithm:  r.Get("algorithm").Uint(),
+			DigestType: r.Get("digestType").Uint(),
+			Digest:     r.Get("digest").String(),
+		}
+		for _, txt := range r.Get("txt").Array() {
+			record.TXT = append(record.TXT, txt.String())
+		}
+		obj.Records = append(obj.Records, record)
+	}
+
+	return obj
+}
+
+func (c Client) getNameInfo(name string) (*gjson.Result, error) {
+	request := []interface{}{
+		name,
+	}
+
+	result, err := c.Call("getnameinfo", request)
+	if err != nil {
+		result, err = c.Call("getnameinfo", request)
+		if err != nil {
+			result, err = c.Call("getnameinfo", request)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (c Client) getNameResource(name string) (*gjson.Result, error) {
+	request := []interface{}{
+		name,
+	}
+
+	result, err := c.Call("getnameresource", request)
+	if err != nil {
+		result, err = c.Call("getnameresource", request)
+		if err != nil {
+			result, err = c.Call("getnameresource", request)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (c Client) getNameByHash(nameHash string) (string, error) {
+	request := []interface{}{
+		nameHash,
+	}
+
+	result, err := c.Call("getnamebyhash", request)
+	if err != nil {
+		result, err = c.Call("getnamebyhash", request)
+		if err != nil {
+			result, err = c.Call("getnamebyhash", request)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return result.String(), nil
+}
+
+func (c Client) getNames() (*gjson.Result, error) {
+	request := []interface{}{}
+
+	result, err := c.Call("getnames", request)
+	if err != nil {
+		result, err = c.Call("getnames", request)
+		if err != nil {
+			result, err = c.Call("getnames", request)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+//GetNameInfo 获取名称的状态
+func (wm *WalletManager) GetNameInfo(name string) (*NameInfo, error) {
+	result, err := wm.NodeClient.getNameInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	return newNameInfo(name, result, wm.Decimal()), nil
+}
+
+//GetNameResource 获取名称的资源记录，名称没有资源时返回空记录
+func (wm *WalletManager) GetNameResource(name string) (*NameResource, error) {
+	result, err := wm.NodeClient.getNameResource(name)
+	if err != nil {
+		return nil, err
+	}
+	return newNameResource(result), nil
+}
+
+//GetNameByHash 通过名称哈希获取名称
+func (wm *WalletManager) GetNameByHash(nameHash string) (string, error) {
+	return wm.NodeClient.getNameByHash(nameHash)
+}
+
+//GetNames 获取节点中所有名称的状态
+func (wm *WalletManager) GetNames() ([]*NameInfo, error) {
+	result, err := wm.NodeClient.getNames()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]*NameInfo, 0)
+	for _, info := range result.Array() {
+		//getnames返回的是名称状态，与getnameinfo的info结构相同
+		wrapped := gjson.Parse(`{"info":` + info.Raw + `}`)
+		names = append(names, newNameInfo(info.Get("name").String(), &wrapped, wm.Decimal()))
+	}
+
+	return names, nil
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestNewNameInfo(t *testing.T) {
+	closed := gjson.Parse(`{
+		"start": {"reserved": false, "week": 20, "start": 3024},
+		"info": {
+			"name": "handshake", "nameHash": "3aa2", "state": "CLOSED", "height": 2987, "renewal": 2987,
+			"owner": {"hash": "f3b3", "index": 1}, "value": 1000000, "highest": 2500000,
+			"registered": true, "expired": false,
+			"stats": {"renewalPeriodStart": 2987, "renewalPeriodEnd": 108107, "blocksUntilExpire": 105120}
+		}
+	}`)
+
+	info := newNameInfo("handshake", &closed, 6)
+	if info.State != NameStateClosed || info.Available() {
+		t.Errorf("unexpected state: %s", info.State)
+	}
+	if info.Owner == nil || info.Owner.TxID != "f3b3" || info.Owner.Index != 1 {
+		t.Errorf("unexpected owner: %+v", info.Owner)
+	}
+	if info.Value != "1" || info.Highest != "2.5" || info.ExpiryHeight != 108107 {
+		t.Errorf("unexpected name info: %+v", info)
+	}
+
+	unopened := gjson.Parse(`{"start": {"reserved": false, "week": 20, "start": 3024}, "info": null}`)
+	info = newNameInfo("available", &unopened, 6)
+	if !info.Available() || info.Name != "available" || info.StartHeight != 3024 {
+		t.Errorf("unexpected name info: %+v", info)
+	}
+}
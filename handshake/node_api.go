@@ -19,7 +19,6 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"github.com/blocktree/handshake-adapter/handshakeTransaction"
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/imroc/req"
@@ -40,6 +39,8 @@ type Client struct {
 	AccessToken string
 	Debug       bool
 	client      *req.Req
+	cache       *nodeCache //交易单及区块缓存
+	stats       *rpcStats  //按方法的调用统计
 	//Client *req.Req
 }
 
@@ -59,15 +60,47 @@ func NewClient(url, token string, debug bool) *Client {
 	}
 
 	api := req.New()
+	//提前创建http客户端，req在首次请求时才创建，并发请求会产生竞争
+	api.Client()
 	//trans, _ := api.Client().Transport.(*http.Transport)
 	//trans.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	c.client = api
+	c.cache = newNodeCache(defaultTxCacheSize, defaultBlockCacheSize)
+	c.stats = newRPCStats()
 
 	return &c
 }
 
+//SetCacheSize 重新设置交易单和区块缓存的容量，原有缓存会被清空
+func (c *Client) SetCacheSize(txSize, blockSize int) {
+	//扫描线程共用同一个缓存，原地修改容量，不替换缓存对象
+	c.cache.resize(txSize, blockSize)
+}
+
+//InvalidateBlockCache 区块被回滚后，清除该区块相关的缓存
+func (c *Client) InvalidateBlockCache(blockHash string) {
+	c.cache.invalidateBlock(blockHash)
+}
+
+//CacheStats 缓存命中统计
+func (c *Client) CacheStats() NodeCacheStats {
+	return c.cache.stats()
+}
+
+//RPCStats 按方法的调用和错误统计
+func (c *Client) RPCStats() map[string]RPCMethodStats {
+	return c.stats.snapshot()
+}
+
 // Call calls a remote procedure on another node, specified by the path.
 func (c *Client) Call(path string, request []interface{}) (*gjson.Result, error) {
+	result, err := c.call(path, request)
+	c.stats.record(path, err)
+	return result, err
+}
+
+//call 发送json-rpc请求
+func (c *Client) call(path string, request []interface{}) (*gjson.Result, error) {
 
 	var (
 		body = make(map[string]interface{}, 0)
@@ -130,6 +163,9 @@ func (c *Client) Call(path string, request []interface{}) (*gjson.Result, error)
 	resp := gjson.ParseBytes(r.Bytes())
 	err = isError(&resp)
 	if err != nil {
+		if rpcErr, ok := AsRPCError(err); ok {
+			rpcErr.Method = path
+		}
 		return nil, err
 	}
 
@@ -175,10 +211,10 @@ func isError(result *gjson.Result) error {
 		return nil
 	}
 
-	errInfo := fmt.Sprintf("[%d]%s",
-		result.Get("error.code").Int(),
-		result.Get("error.message").String())
-	err = errors.New(errInfo)
+	err = &RPCError{
+		Code:    result.Get("error.code").Int(),
+		Message: result.Get("error.message").String(),
+	}
 
 	return err
 }
@@ -197,6 +233,8 @@ func (c Client) getBlockHeight() (uint64, error) {
 		}
 	}
 
+	c.cache.setTip(result.Uint())
+
 	return result.Uint(), nil
 
 }
@@ -221,10 +259,11 @@ func (c Client) getBlockHash(height uint64) (string, error) {
 }
 
 func (c Client) getBlock(hash string) (*Block, error) {
+	//verbose = 1, details = 1，一次请求返回区块内所有交易单详情
 	request := []interface{}{
 		hash,
 		1,
-		0,
+		1,
 	}
 	result, err := c.Call("getblock", request)
 	if err != nil {
@@ -237,7 +276,18 @@ func (c Client) getBlock(hash string) (*Block, error) {
 		}
 	}
 
-	return newBlock(result), nil
+	block := newBlock(result)
+	c.cache.addBlock(block.Hash, &cachedBlock{height: block.Height, time: block.Time})
+
+	//缓存区块内的交易单，同一区块内花费的输入无需再查询节点
+	for _, tx := range result.Get("tx").Array() {
+		if tx.IsObject() {
+			raw := tx
+			c.cache.addTx(raw.Get("txid").String(), &raw)
+		}
+	}
+
+	return block, nil
 }
 func (c Client) getTxsInMemPool() ([]string, error) {
 	request := []interface{}{
@@ -263,6 +313,46 @@ func (c Client) getTxsInMemPool() ([]string, error) {
 }
 
 func (c Client) getTransaction(txid string) (*Transaction, error) {
+	result, cached := c.cache.getTx(txid, true)
+	if !cached {
+		var err error
+		result, err = c.fetchRawTransaction(txid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	trx, err := c.newTx(result)
+	if err != nil {
+		return nil, err
+	}
+
+	//缓存中的确认数已过期，按节点的最新高度重新计算
+	if cached {
+		confirmations, ok := c.cache.confirmations(trx.BlockHeight)
+		if !ok {
+			if _, err := c.getBlockHeight(); err != nil {
+				return nil, err
+			}
+			confirmations, _ = c.cache.confirmations(trx.BlockHeight)
+		}
+		trx.Confirmations = confirmations
+	}
+
+	return trx, nil
+}
+
+//getRawTransaction 获取原始交易单，优先读取缓存
+//confirmedOnly为false时，允许使用未确认交易单的缓存，用于追溯输入源头
+func (c Client) getRawTransaction(txid string, confirmedOnly bool) (*gjson.Result, error) {
+	if raw, ok := c.cache.getTx(txid, confirmedOnly); ok {
+		return raw, nil
+	}
+	return c.fetchRawTransaction(txid)
+}
+
+//fetchRawTransaction 从节点获取原始交易单，并写入缓存
+func (c Client) fetchRawTransaction(txid string) (*gjson.Result, error) {
 	request := []interface{}{
 		txid,
 		1,
@@ -278,34 +368,56 @@ func (c Client) getTransaction(txid string) (*Transaction, error) {
 		}
 	}
 
-	return c.newTx(result)
+	c.cache.addTx(txid, result)
+
+	return result, nil
 }
 
-func (c Client) getAddressAndAmoutOfInput(txid string, vout uint64) (string, string, error) {
+//getBlockHeightByHash 根据区块hash获取区块高度
+func (c Client) getBlockHeightByHash(hash string) (uint64, error) {
+	if block, ok := c.cache.getBlock(hash); ok {
+		return block.height, nil
+	}
+
 	request := []interface{}{
-		txid,
-		1,
+		hash,
+		true,
 	}
-	result, err := c.Call("getrawtransaction", request)
+	result, err := c.Call("getblockheader", request)
 	if err != nil {
-		result, err = c.Call("getrawtransaction", request)
+		result, err = c.Call("getblockheader", request)
 		if err != nil {
-			result, err = c.Call("getrawtransaction", request)
+			result, err = c.Call("getblockheader", request)
 			if err != nil {
-				return "", "", err
+				return 0, err
 			}
 		}
 	}
 
+	block := &cachedBlock{
+		height: result.Get("height").Uint(),
+		time:   result.Get("time").Uint(),
+	}
+	c.cache.addBlock(hash, block)
+
+	return block.height, nil
+}
+
+func (c Client) getAddressAndAmoutOfInput(txid string, vout uint64) (string, string, error) {
+	result, err := c.getRawTransaction(txid, false)
+	if err != nil {
+		return "", "", err
+	}
+
 	outs := result.Get("vout").Array()
 
-	if int(vout) > len(outs) {
+	if int(vout) >= len(outs) {
 		return "", "", errors.New("vout is too big")
 	}
 
 	hashStr := outs[int(vout)].Get("address").Get("hash").String()
 	hash, _ := hex.DecodeString(hashStr)
-	if outs[int(vout)].Get("address").Get("version").Uint() != 0 || err != nil {
+	if outs[int(vout)].Get("address").Get("version").Uint() != 0 {
 		return "", "", errors.New("unknown address version")
 	}
 
@@ -313,30 +425,20 @@ func (c Client) getAddressAndAmoutOfInput(txid string, vout uint64) (string, str
 }
 
 func (c Client) getVout(txid string, vout uint64) (*Vout, error) {
-	request := []interface{}{
-		txid,
-		1,
-	}
-	result, err := c.Call("getrawtransaction", request)
+	result, err := c.getRawTransaction(txid, false)
 	if err != nil {
-		result, err = c.Call("getrawtransaction", request)
-		if err != nil {
-			result, err = c.Call("getrawtransaction", request)
-			if err != nil {
-				return nil, err
-			}
-		}
+		return nil, err
 	}
 
 	outs := result.Get("vout").Array()
 
-	if int(vout) > len(outs) {
+	if int(vout) >= len(outs) {
 		return nil, errors.New("vout is too big")
 	}
 
 	hashStr := outs[int(vout)].Get("address").Get("hash").String()
 	hash, _ := hex.DecodeString(hashStr)
-	if outs[int(vout)].Get("address").Get("version").Uint() != 0 || err != nil {
+	if outs[int(vout)].Get("address").Get("version").Uint() != 0 {
 		return nil, errors.New("unknown address version")
 	}
 
@@ -350,26 +452,37 @@ func (c Client) getVout(txid string, vout uint64) (*Vout, error) {
 	}, nil
 }
 
+//getAddressCoins 获取地址的全部未花，包括带契约的输出
+func (c Client) getAddressCoins(address string) ([]gjson.Result, error) {
+
+	path := "/coin/address/" + address
+
+	result, err := c.Call(path, nil)
+	if err != nil {
+		result, err = c.Call(path, nil)
+		if err != nil {
+			result, err = c.Call(path, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result.Array(), nil
+}
+
 func (c Client) listUnspend(addresses ...string) ([]*Unspent, error) {
 
 	var (
 		utxos = make([]*Unspent, 0)
 	)
 	for _, address := range addresses {
-		path := "/coin/address/" + address
 
-		result, err := c.Call(path, nil)
+		array, err := c.getAddressCoins(address)
 		if err != nil {
-			result, err = c.Call(path, nil)
-			if err != nil {
-				result, err = c.Call(path, nil)
-				if err != nil {
-					return nil, err
-				}
-			}
+			return nil, err
 		}
 
-		array := result.Array()
 		for _, a := range array {
 			u := NewUnspent(&a)
 			if u.Type == 0 && u.Action == "NONE" {
@@ -397,16 +510,20 @@ func (c Client) sendTransaction(rawHex string) (string, error) {
 		rawHex,
 	}
 
-	result, err := c.Call("sendrawtransaction", request)
-	if err != nil {
+	var (
+		result *gjson.Result
+		err    error
+	)
+	for i := 0; i < 3; i++ {
 		result, err = c.Call("sendrawtransaction", request)
-		if err != nil {
-			result, err = c.Call("sendrawtransaction", request)
-			if err != nil {
-				return "", nil
-			}
+		if err == nil {
+			return result.String(), nil
+		}
+		//节点已拒绝交易单，重试没有意义
+		if _, ok := AsRPCError(err); ok {
+			return "", err
 		}
 	}
 
-	return result.String(), nil
+	return "", err
 }
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	节点同步检查：
+	hsd同步中时，最新高度已过期，扫描器会在过期的高度报告已扫描到最新，创建交易单会使用过期的未花。
+	扫描新区块和创建交易单前检查节点的同步进度、区块头与区块的差距和最新区块的时间，
+	未同步时返回NodeNotSyncedError。检查结果缓存syncCheckInterval，避免频繁请求节点。
+	各项阈值为0时不检查，没有持续出块的测试网络需要把syncMaxTipAgeSeconds设为0。
+*/
+
+const (
+	defaultSyncMinProgress  = 0.9999        //最低的同步进度
+	defaultSyncMaxHeaderGap = 2             //区块头领先区块的最大数量
+	defaultSyncMaxTipAge    = 2 * time.Hour //最新区块距今的最长时间
+	syncCheckInterval       = 10 * time.Second
+)
+
+//NodeSyncState 节点同步状态
+type NodeSyncState struct {
+	Synced    bool
+	Reason    string //未同步的原因
+	Blocks    uint64
+	Headers   uint64
+	Progress  float64 //同步进度，verificationprogress
+	TipTime   int64   //最新区块的时间
+	TipAge    time.Duration
+	CheckedAt time.Time
+}
+
+//HeaderGap 区块头领先区块的数量
+func (s *NodeSyncState) HeaderGap() uint64 {
+	if s.Headers > s.Blocks {
+		return s.Headers - s.Blocks
+	}
+	return 0
+}
+
+//NodeNotSyncedError 节点未完成同步
+type NodeNotSyncedError struct {
+	State *NodeSyncState
+}
+
+//Error 实现error接口
+func (e *NodeNotSyncedError) Error() string {
+	return "node not synced: " + e.State.Reason
+}
+
+//IsNodeNotSynced 是否节点未完成同步的错误
+func IsNodeNotSynced(err error) bool {
+	_, ok := err.(*NodeNotSyncedError)
+	return ok
+}
+
+//evaluateSyncState 按阈值判断节点是否已同步
+func (wm *WalletManager) evaluateSyncState(info *BlockchainInfo, tipTime int64, now time.Time) *NodeSyncState {
+
+	state := &NodeSyncState{
+		Blocks:    info.Blocks,
+		Headers:   info.Headers,
+		TipTime:   tipTime,
+		CheckedAt: now,
+	}
+	state.Progress, _ = strconv.ParseFloat(info.Verificationprogress, 64)
+	if tipTime > 0 {
+		state.TipAge = now.Sub(time.Unix(tipTime, 0))
+	}
+
+	reasons := make([]string, 0)
+	if min := wm.Config.SyncMinProgress; min > 0 && state.Progress < min {
+		reasons = append(reasons, fmt.Sprintf("verification progress %.6f below %.6f", state.Progress, min))
+	}
+	if max := wm.Config.SyncMaxHeaderGap; max > 0 && state.HeaderGap() > max {
+		reasons = append(reasons, fmt.Sprintf("blocks %d behind headers %d", state.Blocks, state.Headers))
+	}
+	if max := wm.Config.SyncMaxTipAge; max > 0 && state.TipAge > max {
+		reasons = append(reasons, fmt.Sprintf("tip is %v old", state.TipAge.Truncate(time.Second)))
+	}
+
+	state.Synced = len(reasons) == 0
+	state.Reason = strings.Join(reasons, "; ")
+
+	return state
+}
+
+//getTipTime 最新区块的时间
+func (wm *WalletManager) getTipTime(hash string) (int64, error) {
+	result, err := wm.NodeClient.Call("getblockheader", []interface{}{hash, true})
+	if err != nil {
+		return 0, err
+	}
+	return result.Get("time").Int(), nil
+}
+
+//CheckNodeSync 查询节点的同步状态，syncCheckInterval内使用缓存的结果
+func (wm *WalletManager) CheckNodeSync() (*NodeSyncState, error) {
+
+	wm.syncMu.Lock()
+	defer wm.syncMu.Unlock()
+
+	now := time.Now()
+	if wm.syncState != nil && now.Sub(wm.syncState.CheckedAt) < syncCheckInterval {
+		return wm.syncState, nil
+	}
+
+	info, err := wm.GetBlockChainInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	tipTime := int64(0)
+	if wm.Config.SyncMaxTipAge > 0 {
+		tipTime, err = wm.getTipTime(info.Bestblockhash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state := wm.evaluateSyncState(info, tipTime, now)
+	if !state.Synced && (wm.syncState == nil || wm.syncState.Synced) {
+		wm.Log.Std.Warning("node not synced: %s", state.Reason)
+	}
+	wm.syncState = state
+
+	return state, nil
+}
+
+//LastNodeSyncState 最近一次检查的同步状态，未检查时为nil
+func (wm *WalletManager) LastNodeSyncState() *NodeSyncState {
+	wm.syncMu.Lock()
+	defer wm.syncMu.Unlock()
+	return wm.syncState
+}
+
+//ensureNodeSynced 节点未同步时返回NodeNotSyncedError
+func (wm *WalletManager) ensureNodeSynced() error {
+	state, err := wm.CheckNodeSync()
+	if err != nil {
+		return err
+	}
+	if !state.Synced {
+		return &NodeNotSyncedError{State: state}
+	}
+	return nil
+}
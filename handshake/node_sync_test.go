@@ -0,0 +1,101 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+func TestEvaluateSyncState(t *testing.T) {
+
+	wm := NewWalletManager()
+	now := time.Now()
+
+	tests := []struct {
+		info    *BlockchainInfo
+		tipTime int64
+		synced  bool
+	}{
+		{&BlockchainInfo{Blocks: 100, Headers: 100, Verificationprogress: "1"}, now.Add(-10 * time.Minute).Unix(), true},
+		{&BlockchainInfo{Blocks: 100, Headers: 102, Verificationprogress: "0.99999"}, now.Unix(), true},
+		{&BlockchainInfo{Blocks: 100, Headers: 100, Verificationprogress: "0.5"}, now.Unix(), false},
+		{&BlockchainInfo{Blocks: 100, Headers: 5000, Verificationprogress: "1"}, now.Unix(), false},
+		{&BlockchainInfo{Blocks: 100, Headers: 100, Verificationprogress: "1"}, now.Add(-3 * time.Hour).Unix(), false},
+	}
+	for i, test := range tests {
+		state := wm.evaluateSyncState(test.info, test.tipTime, now)
+		if state.Synced != test.synced {
+			t.Errorf("case %d: synced = %v, reason: %s", i, state.Synced, state.Reason)
+		}
+	}
+
+	//阈值为0时不检查
+	wm.Config.SyncMinProgress = 0
+	wm.Config.SyncMaxHeaderGap = 0
+	wm.Config.SyncMaxTipAge = 0
+	state := wm.evaluateSyncState(&BlockchainInfo{Blocks: 1, Headers: 5000, Verificationprogress: "0.1"}, now.Add(-48*time.Hour).Unix(), now)
+	if !state.Synced {
+		t.Errorf("disabled checks still failed: %s", state.Reason)
+	}
+}
+
+func TestCheckNodeSync(t *testing.T) {
+
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&requests, 1)
+		switch gjson.GetBytes(body, "method").String() {
+		case "getblockchaininfo":
+			fmt.Fprint(w, `{"result":{"chain":"main","blocks":100,"headers":9000,"bestblockhash":"h100","verificationprogress":0.2},"error":null,"id":"1"}`)
+		case "getblockheader":
+			fmt.Fprintf(w, `{"result":{"hash":"h100","height":100,"time":%d},"error":null,"id":"1"}`, time.Now().Add(-30*24*time.Hour).Unix())
+		default:
+			fmt.Fprint(w, `{"result":null,"error":{"code":-32601,"message":"Method not found"},"id":"1"}`)
+		}
+	}))
+	defer server.Close()
+
+	wm := NewWalletManager()
+	wm.NodeClient = NewClient(server.URL, "", false)
+
+	err := wm.ensureNodeSynced()
+	if !IsNodeNotSynced(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	state := wm.LastNodeSyncState()
+	if state.Blocks != 100 || state.HeaderGap() != 8900 || state.Progress != 0.2 || state.TipAge < 24*time.Hour {
+		t.Errorf("unexpected sync state: %+v", state)
+	}
+	if owErr := ConvertNodeError(err); owErr.Code() != openwallet.ErrCallFullNodeAPIFailed {
+		t.Errorf("unexpected openwallet error code: %d", owErr.Code())
+	}
+
+	//检查结果缓存
+	wm.ensureNodeSynced()
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("sync state not cached, requests: %d", requests)
+	}
+}
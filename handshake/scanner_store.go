@@ -0,0 +1,89 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/v2/common/file"
+)
+
+const (
+	scannerDBFile = "blockscanner.db" //扫描器数据库文件
+)
+
+//scannerStore 扫描器的本地数据库，首次使用时打开，扫描器停止时关闭
+type scannerStore struct {
+	mu   sync.Mutex
+	path string
+	db   *storm.DB
+}
+
+//newScannerStore 创建扫描器数据库，dir为数据库目录
+func newScannerStore(dir string) *scannerStore {
+	return &scannerStore{
+		path: filepath.Join(dir, scannerDBFile),
+	}
+}
+
+//DB 打开数据库
+func (s *scannerStore) DB() (*storm.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db != nil {
+		return s.db, nil
+	}
+
+	file.MkdirAll(filepath.Dir(s.path))
+	db, err := storm.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+	return s.db, nil
+}
+
+//Close 关闭数据库
+func (s *scannerStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+//scannerDB 扫描器数据库，数据目录在加载配置后才确定，所以延迟创建
+func (bs *HNSBlockScanner) scannerDB() (*storm.DB, error) {
+	bs.storeOnce.Do(func() {
+		bs.store = newScannerStore(bs.wm.Config.DBPath)
+	})
+	return bs.store.DB()
+}
+
+//closeScannerDB 关闭扫描器数据库，再次使用时重新打开
+func (bs *HNSBlockScanner) closeScannerDB() error {
+	bs.storeOnce.Do(func() {
+		bs.store = newScannerStore(bs.wm.Config.DBPath)
+	})
+	return bs.store.Close()
+}
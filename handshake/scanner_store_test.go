@@ -0,0 +1,47 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+//useTestScannerDB 扫描器数据库使用临时目录，返回的清理函数关闭数据库并删除目录
+func useTestScannerDB(t *testing.T, bs *HNSBlockScanner) func() {
+
+	dir, err := ioutil.TempDir("", "hns_scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.wm.Config.DBPath = dir
+
+	return func() {
+		bs.closeScannerDB()
+		os.RemoveAll(dir)
+	}
+}
+
+//newTestScannerWallet 创建扫描器数据库在临时目录的钱包管理器，url不为空时连接测试节点
+func newTestScannerWallet(t *testing.T, url string) (*WalletManager, func()) {
+
+	wm := NewWalletManager()
+	if len(url) > 0 {
+		wm.NodeClient = NewClient(url, "", false)
+	}
+	return wm, useTestScannerDB(t, wm.Blockscanner)
+}
@@ -0,0 +1,457 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+)
+
+/*
+	hsd的websocket使用bsock协议，兼容socket.io(engine.io v3)的websocket传输。
+	节点推送的区块和交易单是二进制数据，以附件的形式发送，
+	这里把附件还原为hex字符串，事件处理函数统一处理json参数。
+*/
+
+//engine.io包类型
+const (
+	engineOpen    = '0'
+	engineClose   = '1'
+	enginePing    = '2'
+	enginePong    = '3'
+	engineMessage = '4'
+)
+
+//socket.io包类型
+const (
+	socketConnect     = '0'
+	socketDisconnect  = '1'
+	socketEvent       = '2'
+	socketAck         = '3'
+	socketError       = '4'
+	socketBinaryEvent = '5'
+	socketBinaryAck   = '6'
+)
+
+const (
+	defaultSocketPingInterval = 25 * time.Second
+	defaultSocketPingTimeout  = 60 * time.Second
+)
+
+//socketHandler 事件处理函数，args为事件参数
+type socketHandler func(args []gjson.Result)
+
+//socketPacket 解析后的socket.io包
+type socketPacket struct {
+	kind        byte
+	ackID       int64
+	attachments int
+	data        string
+}
+
+//hsdSocket hsd的websocket客户端
+type hsdSocket struct {
+	conn         *websocket.Conn
+	writeMu      sync.Mutex
+	mu           sync.Mutex
+	handlers     map[string]socketHandler
+	acks         map[int64]chan []gjson.Result
+	ackID        int64
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	pending      *socketPacket //等待二进制附件的包
+	buffers      [][]byte      //已收到的二进制附件
+	events       chan func()   //按顺序执行的事件处理
+	closed       chan struct{}
+	closeOnce    sync.Once
+	onClose      func()
+}
+
+//socketURL 根据节点API地址生成websocket地址
+func socketURL(nodeAPI string) (string, error) {
+	apiUrl, err := url.Parse(nodeAPI)
+	if err != nil {
+		return "", err
+	}
+	scheme := "ws"
+	if apiUrl.Scheme == "https" {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s/socket.io/?EIO=3&transport=websocket", scheme, apiUrl.Host), nil
+}
+
+//dialHSDSocket 连接hsd的websocket，onClose在连接断开时调用一次
+func dialHSDSocket(nodeAPI string, onClose func()) (*hsdSocket, error) {
+
+	wsURL, err := socketURL(nodeAPI)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &hsdSocket{
+		conn:         conn,
+		handlers:     make(map[string]socketHandler),
+		acks:         make(map[int64]chan []gjson.Result),
+		pingInterval: defaultSocketPingInterval,
+		pingTimeout:  defaultSocketPingTimeout,
+		events:       make(chan func(), 64),
+		closed:       make(chan struct{}),
+		onClose:      onClose,
+	}
+
+	go s.readLoop()
+	go s.pingLoop()
+	go s.eventLoop()
+
+	return s, nil
+}
+
+//On 注册事件处理函数，需要在订阅前注册
+func (s *hsdSocket) On(event string, handler socketHandler) {
+	s.mu.Lock()
+	s.handlers[event] = handler
+	s.mu.Unlock()
+}
+
+//Close 关闭连接
+func (s *hsdSocket) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+}
+
+//Closed 连接是否已断开
+func (s *hsdSocket) Closed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+//Fire 发送事件，不等待回复
+func (s *hsdSocket) Fire(event string, args ...interface{}) error {
+	payload, err := json.Marshal(append([]interface{}{event}, args...))
+	if err != nil {
+		return err
+	}
+	return s.write(string(engineMessage) + string(socketEvent) + string(payload))
+}
+
+//Call 调用节点的hook，等待节点回复
+func (s *hsdSocket) Call(timeout time.Duration, event string, args ...interface{}) (*gjson.Result, error) {
+
+	payload, err := json.Marshal(append([]interface{}{event}, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan []gjson.Result, 1)
+	s.mu.Lock()
+	s.ackID++
+	id := s.ackID
+	s.acks[id] = ch
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.acks, id)
+		s.mu.Unlock()
+	}()
+
+	err = s.write(string(engineMessage) + string(socketEvent) + strconv.FormatInt(id, 10) + string(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		//回复格式：[err, result]
+		if len(res) > 0 && res[0].Type != gjson.Null {
+			msg := res[0].Get("message").String()
+			if len(msg) == 0 {
+				msg = res[0].String()
+			}
+			return nil, fmt.Errorf("socket call %s failed: %s", event, msg)
+		}
+		result := gjson.Result{}
+		if len(res) > 1 {
+			result = res[1]
+		}
+		return &result, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("socket call %s timeout", event)
+	case <-s.closed:
+		return nil, errors.New("socket closed")
+	}
+}
+
+func (s *hsdSocket) write(msg string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+//eventLoop 执行事件处理，避免阻塞读取和心跳
+func (s *hsdSocket) eventLoop() {
+	for {
+		select {
+		case f := <-s.events:
+			f()
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+//timeouts 心跳间隔和超时时间
+func (s *hsdSocket) timeouts() (time.Duration, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pingInterval, s.pingTimeout
+}
+
+//pingLoop 定时发送心跳
+func (s *hsdSocket) pingLoop() {
+	for {
+		interval, _ := s.timeouts()
+		select {
+		case <-time.After(interval):
+			if err := s.write(string(enginePing)); err != nil {
+				s.Close()
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+//readLoop 读取节点推送的数据
+func (s *hsdSocket) readLoop() {
+	defer s.Close()
+
+	for {
+		interval, timeout := s.timeouts()
+		s.conn.SetReadDeadline(time.Now().Add(interval + timeout))
+		msgType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if msgType == websocket.BinaryMessage {
+			s.handleBinary(data)
+			continue
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+
+		switch data[0] {
+		case engineOpen:
+			open := gjson.ParseBytes(data[1:])
+			s.mu.Lock()
+			if v := open.Get("pingInterval").Int(); v > 0 {
+				s.pingInterval = time.Duration(v) * time.Millisecond
+			}
+			if v := open.Get("pingTimeout").Int(); v > 0 {
+				s.pingTimeout = time.Duration(v) * time.Millisecond
+			}
+			s.mu.Unlock()
+		case enginePing:
+			if err := s.write(string(enginePong)); err != nil {
+				return
+			}
+		case engineClose:
+			return
+		case engineMessage:
+			packet, err := parseSocketPacket(string(data[1:]))
+			if err != nil {
+				continue
+			}
+			if packet.kind == socketDisconnect {
+				return
+			}
+			if packet.attachments > 0 {
+				s.pending = packet
+				s.buffers = make([][]byte, 0, packet.attachments)
+				continue
+			}
+			s.dispatch(packet)
+		}
+	}
+}
+
+//handleBinary 收集二进制附件，收齐后还原事件
+func (s *hsdSocket) handleBinary(data []byte) {
+	if s.pending == nil {
+		return
+	}
+	//engine.io的二进制消息以包类型4开头
+	if len(data) > 0 && data[0] == 4 {
+		data = data[1:]
+	}
+	s.buffers = append(s.buffers, data)
+	if len(s.buffers) < s.pending.attachments {
+		return
+	}
+
+	packet := s.pending
+	packet.data = fillPlaceholders(packet.data, s.buffers)
+	s.pending = nil
+	s.buffers = nil
+	s.dispatch(packet)
+}
+
+//dispatch 分发事件或回复
+func (s *hsdSocket) dispatch(packet *socketPacket) {
+
+	args := gjson.Parse(packet.data).Array()
+
+	switch packet.kind {
+	case socketEvent, socketBinaryEvent:
+		if len(args) == 0 {
+			return
+		}
+		s.mu.Lock()
+		handler, ok := s.handlers[args[0].String()]
+		s.mu.Unlock()
+		if ok {
+			select {
+			case s.events <- func() { handler(args[1:]) }:
+			case <-s.closed:
+			}
+		}
+	case socketAck, socketBinaryAck:
+		s.mu.Lock()
+		ch, ok := s.acks[packet.ackID]
+		s.mu.Unlock()
+		if ok {
+			select {
+			case ch <- args:
+			default:
+			}
+		}
+	}
+}
+
+//parseSocketPacket 解析socket.io包：类型[附件数-][/命名空间,][ackID][json]
+func parseSocketPacket(text string) (*socketPacket, error) {
+	if len(text) == 0 {
+		return nil, errors.New("empty packet")
+	}
+
+	packet := &socketPacket{kind: text[0], ackID: -1}
+	text = text[1:]
+
+	if packet.kind == socketBinaryEvent || packet.kind == socketBinaryAck {
+		pos := strings.IndexByte(text, '-')
+		if pos < 0 {
+			return nil, errors.New("invalid binary packet")
+		}
+		n, err := strconv.Atoi(text[:pos])
+		if err != nil {
+			return nil, err
+		}
+		packet.attachments = n
+		text = text[pos+1:]
+	}
+
+	if strings.HasPrefix(text, "/") {
+		pos := strings.IndexByte(text, ',')
+		if pos < 0 {
+			text = ""
+		} else {
+			text = text[pos+1:]
+		}
+	}
+
+	end := 0
+	for end < len(text) && text[end] >= '0' && text[end] <= '9' {
+		end++
+	}
+	if end > 0 {
+		id, err := strconv.ParseInt(text[:end], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		packet.ackID = id
+		text = text[end:]
+	}
+
+	packet.data = text
+	return packet, nil
+}
+
+//fillPlaceholders 把{"_placeholder":true,"num":n}替换为第n个附件的hex字符串
+func fillPlaceholders(data string, buffers [][]byte) string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		return data
+	}
+
+	var fill func(v interface{}) interface{}
+	fill = func(v interface{}) interface{} {
+		switch obj := v.(type) {
+		case map[string]interface{}:
+			if isPlaceholder, _ := obj["_placeholder"].(bool); isPlaceholder {
+				num, _ := obj["num"].(float64)
+				if int(num) < len(buffers) {
+					return hex.EncodeToString(buffers[int(num)])
+				}
+				return ""
+			}
+			for k, item := range obj {
+				obj[k] = fill(item)
+			}
+			return obj
+		case []interface{}:
+			for i, item := range obj {
+				obj[i] = fill(item)
+			}
+			return obj
+		}
+		return v
+	}
+
+	b, err := json.Marshal(fill(v))
+	if err != nil {
+		return data
+	}
+	return string(b)
+}
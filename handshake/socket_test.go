@@ -0,0 +1,113 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package handshake
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+)
+
+func TestParseSocketPacket(t *testing.T) {
+	packet, err := parseSocketPacket(`51-["tx",{"_placeholder":true,"num":0}]`)
+	if err != nil {
+		t.Fatalf("parse packet failed: %v", err)
+	}
+	if packet.kind != socketBinaryEvent || packet.attachments != 1 || packet.ackID != -1 {
+		t.Errorf("unexpected packet: %+v", packet)
+	}
+
+	data := gjson.Parse(fillPlaceholders(packet.data, [][]byte{{0x01, 0xab}})).Array()
+	if len(data) != 2 || data[1].String() != "01ab" {
+		t.Errorf("unexpected event args: %v", data)
+	}
+
+	packet, err = parseSocketPacket(`312[null,true]`)
+	if err != nil || packet.kind != socketAck || packet.ackID != 12 || packet.data != "[null,true]" {
+		t.Errorf("unexpected ack packet: %+v, %v", packet, err)
+	}
+}
+
+//newTestSocketServer 模拟hsd的websocket，拒绝auth，收到auth时通知authed
+func newTestSocketServer(authed chan<- struct{}) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`0{"pingInterval":25000,"pingTimeout":60000}`))
+		conn.WriteMessage(websocket.TextMessage, []byte("40"))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if len(data) < 2 || data[0] != engineMessage {
+				continue
+			}
+			packet, err := parseSocketPacket(string(data[1:]))
+			if err != nil || packet.kind != socketEvent {
+				continue
+			}
+			if gjson.Parse(packet.data).Get("0").String() == "auth" {
+				select {
+				case authed <- struct{}{}:
+				default:
+				}
+				reply := "43" + strconv.FormatInt(packet.ackID, 10) + `[{"message":"invalid key"}]`
+				conn.WriteMessage(websocket.TextMessage, []byte(reply))
+			}
+		}
+	}))
+}
+
+func TestSetupSocketIO_AuthRejected(t *testing.T) {
+
+	authed := make(chan struct{}, 1)
+	server := newTestSocketServer(authed)
+	defer server.Close()
+
+	bs := newTestWorkerScanner(t, server.URL)
+	bs.wm.Config.NodeAPI = server.URL
+	bs.wm.Config.RpcPassword = "bad"
+	bs.wm.Config.EnableSocket = true
+	bs.wm.Config.StopTimeout = 2 * time.Second
+	bs.PeriodOfTask = time.Hour
+
+	if err := bs.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-authed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket auth not received")
+	}
+	//等待认证失败后关闭连接
+	time.Sleep(100 * time.Millisecond)
+
+	//认证失败后重连线程不能阻塞，Stop需要在超时前结束
+	if err := bs.Stop(); err != nil {
+		t.Fatalf("Stop after rejected auth: %v", err)
+	}
+}
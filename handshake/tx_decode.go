@@ -145,6 +145,11 @@ func (decoder *TransactionDecoder) CreateHNSRawTransaction(wrapper openwallet.Wa
 		limit = 2000
 	)
 
+	//节点未同步时未花已过期
+	if err := decoder.wm.ensureNodeSynced(); err != nil {
+		return ConvertNodeError(err)
+	}
+
 	address, err := wrapper.GetAddressList(0, limit, "AccountID", rawTx.Account.AccountID)
 	if err != nil {
 		return err
@@ -439,6 +444,11 @@ func (decoder *TransactionDecoder) CreateHNSSummaryRawTransaction(wrapper openwa
 	//	return nil, fmt.Errorf("mini transfer amount must be greater than address retained balance")
 	//}
 
+	//节点未同步时未花已过期
+	if err := decoder.wm.ensureNodeSynced(); err != nil {
+		return nil, ConvertNodeError(err)
+	}
+
 	address, err := wrapper.GetAddressList(sumRawTx.AddressStartIndex, sumRawTx.AddressLimit, "AccountID", sumRawTx.Account.AccountID)
 	if err != nil {
 		return nil, err
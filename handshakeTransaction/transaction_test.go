@@ -103,4 +103,16 @@ func Test_4fadb5ceb93c405cb068f78d891edb1a8d32468a13eb0d228d7f0a380a885f03(t *te
 	} else {
 		t.Error("verify tx failed")
 	}
-}
\ No newline at end of file
+}
+func Test_GetTxID(t *testing.T) {
+	signedTrans := "0000000001ec823cbfcd7e6e49491e5d3c2ad09d0b76f770bfa24d3cd877e2ab323674d52200000000ffffffff02e803000000000000001453266cf015e64178eaff9eaaab6ed2904cad3cf1000078aa0a00000000000014ddc9fb4cb9445237af90b86d3ebec5217e0308d5000000000000024155cfd748f2cb768ebad5601d164adf36e754f45adf69ea4cde6b885d12e9a95b05b023a4939d2e79b469a02f8a4e4dca1771945bb998cbe2dfc6384c12790af6012103ac2c33b23097cc8b442015f824fa90c1e2cd64b9a681add03aa1e82e7014edc1"
+
+	txid, err := GetTxID(signedTrans)
+	if err != nil {
+		t.Error("get txid failed! - ", err)
+		return
+	}
+	if txid != "9a9e2b836d2b9640103633857febf62f488e78b4bc86806603382fcadc61a4f8" {
+		t.Error("wrong txid : ", txid)
+	}
+}
@@ -0,0 +1,122 @@
+package handshakeTransaction
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/blocktree/go-owcrypt"
+)
+
+//GetTxID 计算已签名交易单的txid，txid为不含见证数据部分的blake2b256哈希
+func GetTxID(signedTrans string) (string, error) {
+	tx, err := hex.DecodeString(signedTrans)
+	if err != nil {
+		return "", errors.New("Invalid transaction data!")
+	}
+
+	end, err := getBaseSize(tx)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(owcrypt.Hash(tx[:end], 32, owcrypt.HASH_ALG_BLAKE2B)), nil
+}
+
+//getBaseSize 解析交易单不含见证数据部分的长度
+func getBaseSize(tx []byte) (int, error) {
+	limit := len(tx)
+	index := 0
+
+	//version
+	index += 4
+	if index > limit {
+		return 0, errors.New("Invalid transaction data!")
+	}
+
+	inCount, size, err := readVarInt(tx[index:])
+	if err != nil {
+		return 0, err
+	}
+	index += size
+	if inCount == 0 {
+		return 0, errors.New("Invalid transaction data!")
+	}
+
+	//txid + vout + sequence
+	for i := uint64(0); i < inCount; i++ {
+		index += 40
+		if index > limit {
+			return 0, errors.New("Invalid transaction data!")
+		}
+	}
+
+	outCount, size, err := readVarInt(tx[index:])
+	if err != nil {
+		return 0, err
+	}
+	index += size
+
+	for i := uint64(0); i < outCount; i++ {
+		//amount + address version
+		index += 9
+		if index+1 > limit {
+			return 0, errors.New("Invalid transaction data!")
+		}
+		//address hash
+		index += 1 + int(tx[index])
+		//covenant type
+		index++
+		if index > limit {
+			return 0, errors.New("Invalid transaction data!")
+		}
+		itemCount, size, err := readVarInt(tx[index:])
+		if err != nil {
+			return 0, err
+		}
+		index += size
+		for j := uint64(0); j < itemCount; j++ {
+			itemLen, size, err := readVarInt(tx[index:])
+			if err != nil {
+				return 0, err
+			}
+			index += size + int(itemLen)
+			if index > limit {
+				return 0, errors.New("Invalid transaction data!")
+			}
+		}
+	}
+
+	//locktime
+	index += 4
+	if index > limit {
+		return 0, errors.New("Invalid transaction data!")
+	}
+
+	return index, nil
+}
+
+//readVarInt 读取变长整数，返回数值和占用的字节数
+func readVarInt(data []byte) (uint64, int, error) {
+	if len(data) < 1 {
+		return 0, 0, errors.New("Invalid transaction data!")
+	}
+	switch data[0] {
+	case 0xfd:
+		if len(data) < 3 {
+			return 0, 0, errors.New("Invalid transaction data!")
+		}
+		return uint64(data[1]) | uint64(data[2])<<8, 3, nil
+	case 0xfe:
+		if len(data) < 5 {
+			return 0, 0, errors.New("Invalid transaction data!")
+		}
+		return uint64(littleEndianBytesToUint32(data[1:5])), 5, nil
+	case 0xff:
+		if len(data) < 9 {
+			return 0, 0, errors.New("Invalid transaction data!")
+		}
+		return littleEndianBytesToUint64(data[1:9]), 9, nil
+	default:
+		return uint64(data[0]), 1, nil
+	}
+}